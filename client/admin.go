@@ -0,0 +1,407 @@
+package client
+
+import (
+	"flag"
+	"fmt"
+	"gbb/srv"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+
+	Comandos de administración
+
+	gbb admin user ... permite gestionar los usuarios, gbb admin filter ...
+	las reglas de filtro y gbb admin thread ... los hilos fijados desde la
+	línea de comandos a través de la API. El administrador se autentica
+	igual que al abrir el tablón y los cambios se aplican en el servidor al
+	momento. Los hilos se indican con el principio de su id, como los
+	muestra thread list.
+
+*/
+
+const ADMIN_USAGE = `Uso:
+	gbb admin user list
+	gbb admin user add <login>
+	gbb admin user check <login>
+	gbb admin user ban <login> [--readonly] [--days N] [--reason texto]
+	gbb admin user unban <login>
+	gbb admin user promote|demote <login>
+	gbb admin user roles <login> [moderator|moderator@<categoría>|admin@<categoría> ...]
+	gbb admin user resetpassword <login>
+	gbb admin user revoke <login>
+	gbb admin user unlock <login>
+	gbb admin user unlock --addr <dirección>
+	gbb admin filter list
+	gbb admin filter add word|regex <patrón> [--action reject|hold|mask] [--dry-run]
+	gbb admin filter add links <enlaces> [--action reject|hold|mask] [--dry-run]
+	gbb admin filter dryrun|enable <id>
+	gbb admin filter rm <id>
+	gbb admin thread list
+	gbb admin thread pin <id> [--days N] [--order N] [--announce]
+	gbb admin thread unpin <id>`
+
+func AdminInit(args []string) {
+	InitLog(false)
+
+	if len(args) < 2 || (args[0] != "user" && args[0] != "filter" && args[0] != "thread") {
+		fmt.Println(ADMIN_USAGE)
+		os.Exit(1)
+	}
+	cmd := args[1]
+	target := ""
+	options := []string{}
+	if len(args) > 2 {
+		target = args[2]
+		options = args[3:]
+	}
+	if cmd != "list" && target == "" {
+		fmt.Println(ADMIN_USAGE)
+		os.Exit(1)
+	}
+
+	if !login() {
+		os.Exit(1)
+	}
+	if args[0] == "thread" && !clientUser.CanSomewhere(srv.PERM_FIX) {
+		fmt.Println("Error: Operación solo para moderadores")
+		os.Exit(1)
+	}
+	if args[0] != "thread" && !clientUser.Can(srv.PERM_MANAGE_USERS, "") {
+		fmt.Println("Error: Operación solo para administradores")
+		os.Exit(1)
+	}
+
+	var err error
+	if args[0] == "filter" {
+		err = runAdminFilterCommand(cmd, target, options)
+	} else if args[0] == "thread" {
+		err = runAdminThreadCommand(cmd, target, options)
+	} else {
+		err = runAdminUserCommand(cmd, target, options)
+	}
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func runAdminUserCommand(cmd string, login string, options []string) error {
+	switch cmd {
+	case "list":
+		users, err := ListUsers()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "LOGIN\tADMIN\tROLES\tBLOQUEO")
+		for _, u := range users {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", u.Login, yesNo(u.IsAdmin), rolesText(u), banText(u))
+		}
+		return w.Flush()
+
+	case "add":
+		cred, err := CreateUser(login)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Creado el usuario %s con la contraseña: %s\n", cred.Login, cred.Password)
+
+	case "check":
+		u, err := FetchUser(login)
+		if err != nil {
+			return err
+		}
+		if u == nil {
+			return fmt.Errorf("No existe un usuario con ese nombre")
+		}
+		fmt.Printf("%s existe. Admin: %s. Roles: %s. Bloqueo: %s\n", u.Login, yesNo(u.IsAdmin), rolesText(u), banText(u))
+
+	case "ban":
+		flags := flag.NewFlagSet("ban", flag.ExitOnError)
+		readonly := flags.Bool("readonly", false, "Permite leer pero no escribir")
+		days := flags.Int("days", 0, "Días que dura el bloqueo. 0 para un bloqueo indefinido")
+		reason := flags.String("reason", "", "Motivo del bloqueo")
+		flags.Parse(options)
+
+		ban := srv.BanRequest{Level: srv.BAN_FULL, Reason: *reason}
+		if *readonly {
+			ban.Level = srv.BAN_READONLY
+		}
+		if *days > 0 {
+			ban.Expires = time.Now().AddDate(0, 0, *days)
+		}
+		err := BanUser(login, ban)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Usuario %s bloqueado\n", login)
+
+	case "unban", "promote", "demote":
+		err := UpdateUserStatus(login, cmd)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Usuario %s actualizado\n", login)
+
+	case "roles":
+		grants := make([]srv.RoleGrant, 0)
+		for _, opt := range options {
+			role, category := opt, ""
+			if i := strings.Index(opt, "@"); i >= 0 {
+				role, category = opt[:i], opt[i+1:]
+			}
+			grants = append(grants, srv.RoleGrant{Role: role, Category: category})
+		}
+		err := SetUserRoles(login, grants)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Roles de %s actualizados\n", login)
+
+	case "revoke":
+		err := UpdateUserStatus(login, cmd)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Cerradas todas las sesiones de %s\n", login)
+
+	case "unlock":
+		if login == "--addr" {
+			if len(options) != 1 {
+				fmt.Println(ADMIN_USAGE)
+				os.Exit(1)
+			}
+			err := UnlockAddress(options[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Desbloqueada la dirección %s tras los intentos fallidos de inicio de sesión\n", options[0])
+			return nil
+		}
+		err := UpdateUserStatus(login, cmd)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Desbloqueado %s tras los intentos fallidos de inicio de sesión\n", login)
+
+	case "resetpassword":
+		cred, err := ResetUserPassword(login)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Nueva contraseña para %s: %s\n", cred.Login, cred.Password)
+
+	default:
+		fmt.Println(ADMIN_USAGE)
+		os.Exit(1)
+	}
+	return nil
+}
+
+func runAdminFilterCommand(cmd string, target string, options []string) error {
+	switch cmd {
+	case "list":
+		rules, err := FetchFilters()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTIPO\tPATRÓN\tACCIÓN\tPRUEBA\tCREADA POR")
+		for _, f := range rules {
+			pattern := f.Pattern
+			if f.Kind == srv.FILTER_LINKS {
+				pattern = fmt.Sprintf("más de %d", f.MaxLinks)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", f.Id, f.Kind, pattern, f.Action, yesNo(f.DryRun), f.CreatedBy)
+		}
+		return w.Flush()
+
+	case "add":
+		if len(options) == 0 {
+			fmt.Println(ADMIN_USAGE)
+			os.Exit(1)
+		}
+		flags := flag.NewFlagSet("add", flag.ExitOnError)
+		action := flags.String("action", srv.FILTER_REJECT, "Acción: reject, hold o mask")
+		dryRun := flags.Bool("dry-run", false, "Solo registra en el log lo que haría la regla")
+		flags.Parse(options[1:])
+
+		f := &srv.FilterRule{Kind: target, Pattern: options[0], Action: *action, DryRun: *dryRun}
+		if target == srv.FILTER_LINKS {
+			n, err := strconv.Atoi(options[0])
+			if err != nil {
+				return fmt.Errorf("El número de enlaces no es válido: %s", options[0])
+			}
+			f.Pattern, f.MaxLinks = "", n
+		}
+		saved, err := SaveFilter(f)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Creada la regla %d\n", saved.Id)
+
+	case "dryrun", "enable":
+		f, err := findFilter(target)
+		if err != nil {
+			return err
+		}
+		f.DryRun = (cmd == "dryrun")
+		_, err = SaveFilter(f)
+		if err != nil {
+			return err
+		}
+		if f.DryRun {
+			fmt.Printf("La regla %d pasa a modo de prueba\n", f.Id)
+		} else {
+			fmt.Printf("La regla %d está activa\n", f.Id)
+		}
+
+	case "rm":
+		f, err := findFilter(target)
+		if err != nil {
+			return err
+		}
+		err = DeleteFilter(f.Id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Borrada la regla %d\n", f.Id)
+
+	default:
+		fmt.Println(ADMIN_USAGE)
+		os.Exit(1)
+	}
+	return nil
+}
+
+func findFilter(id string) (*srv.FilterRule, error) {
+	rules, err := FetchFilters()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range rules {
+		if strconv.Itoa(f.Id) == id {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("No existe una regla con ese id")
+}
+
+func runAdminThreadCommand(cmd string, target string, options []string) error {
+	switch cmd {
+	case "list":
+		b := FetchBoard()
+		if b == nil {
+			return fmt.Errorf("No se pudo leer el tablón")
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tFIJADO\tORDEN\tHASTA\tANUNCIO\tTÍTULO")
+		for _, th := range b.Threads {
+			until := "-"
+			if !th.PinExpires.IsZero() {
+				until = th.PinExpires.Local().Format("2006-01-02 15:04")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", th.Id[:8], yesNo(th.IsFixed), th.PinOrder, until,
+				yesNo(th.Announcement), th.Title)
+		}
+		return w.Flush()
+
+	case "pin":
+		flags := flag.NewFlagSet("pin", flag.ExitOnError)
+		days := flags.Int("days", 0, "Días que el hilo sigue fijado. 0 para no soltarlo")
+		order := flags.Int("order", 0, "Orden entre los hilos fijados, de menor a mayor")
+		announce := flags.Bool("announce", false, "Muestra el hilo al arrancar el cliente hasta que cada usuario lo confirma")
+		flags.Parse(options)
+
+		th, err := findThread(target)
+		if err != nil {
+			return err
+		}
+		pin := srv.PinRequest{Order: *order, Announcement: *announce}
+		if *days > 0 {
+			pin.Expires = time.Now().AddDate(0, 0, *days)
+		}
+		err = PinThread(th, pin)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Hilo %s fijado\n", th.Id[:8])
+
+	case "unpin":
+		th, err := findThread(target)
+		if err != nil {
+			return err
+		}
+		err = UpdateThreadStatus(th, "free")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Hilo %s soltado\n", th.Id[:8])
+
+	default:
+		fmt.Println(ADMIN_USAGE)
+		os.Exit(1)
+	}
+	return nil
+}
+
+// Busca el hilo cuyo id empieza por prefix
+func findThread(prefix string) (*srv.Thread, error) {
+	b := FetchBoard()
+	if b == nil {
+		return nil, fmt.Errorf("No se pudo leer el tablón")
+	}
+	var found *srv.Thread
+	for _, th := range b.Threads {
+		if strings.HasPrefix(th.Id, prefix) {
+			if found != nil {
+				return nil, fmt.Errorf("Hay varios hilos cuyo id empieza por %s", prefix)
+			}
+			found = th
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("No existe un hilo con ese id")
+	}
+	return found, nil
+}
+
+func banText(u *srv.User) string {
+	switch u.BanLevel {
+	case srv.BAN_READONLY:
+		return "solo lectura"
+	case srv.BAN_FULL:
+		return "total"
+	}
+	return "no"
+}
+
+func rolesText(u *srv.User) string {
+	if len(u.Roles) == 0 && u.GroupRole == "" {
+		return "-"
+	}
+	list := make([]string, 0, len(u.Roles)+1)
+	if u.GroupRole != "" {
+		list = append(list, u.GroupRole+"(grupo)")
+	}
+	for _, g := range u.Roles {
+		if g.Category == "" {
+			list = append(list, g.Role)
+		} else {
+			list = append(list, g.Role+"@"+g.Category)
+		}
+	}
+	return strings.Join(list, " ")
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "sí"
+	}
+	return "no"
+}
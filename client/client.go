@@ -1,8 +1,8 @@
 package client
 
 import (
-	"crypto/sha256"
 	"fmt"
+	"gbb/srv"
 	"io/ioutil"
 	"log"
 	"os"
@@ -12,7 +12,7 @@ import (
 	"golang.org/x/term"
 )
 
-var APP_TITLE = "GBB v1.2"
+var APP_TITLE = "GBB v" + srv.VERSION
 var WELCOME = `
 
    ,o888888o.    8 888888888o   8 888888888o   
@@ -36,6 +36,12 @@ var logFile *os.File
 var logFileName = "/tmp/gbb-debug.log"
 var Username string
 
+// Editor con el que se escriben los mensajes. Puede llevar argumentos
+var Editor = "nano"
+
+// Login con el que se inicia sesión. Vacío para usar el usuario del sistema
+var Login = ""
+
 /*
 
 	Client Core
@@ -91,45 +97,85 @@ func logEvent(text string) {
 	log.Printf("%s\n", text)
 }
 
-func ClientInit(cmd string, exDir string) {
-
-	if cmd == "--debug" {
-		InitLog(true)
-	} else {
-		InitLog(false)
+// Proceso de autenticación del usuario del sistema contra el servidor.
+// Retorna false si no se pudo iniciar sesión
+func login() bool {
+	err := configureTLS()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return false
 	}
-	defer logFile.Close()
+	configureSocket()
 
-	user, err := user.Current()
+	_, err = CheckServer()
 	if err != nil {
-		panic(err)
+		fmt.Printf("Error: %s\n", err)
+		return false
 	}
-	Username = user.Username
 
-	PrintWellcome(exDir)
-
-	/*
+	if isLocalSocket() {
+		// el servidor nos identifica por el socket, sin contraseña
+		session, err := LocalAuth()
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			return false
+		}
+		Username = session.Login
+		SetSessionToken(session.Token)
+	} else if !passwordLogin() {
+		return false
+	}
 
-		Auth process
+	clientUser, err = FetchUser(Username)
+	if err != nil || clientUser == nil {
+		fmt.Printf("Error: No se pudo obtener el usuario %s\n", Username)
+		return false
+	}
 
-	*/
+	if clientUser.BanLevel == srv.BAN_READONLY {
+		fmt.Println(clientUser.BanMessage())
+		setWarningMessage(clientUser.BanMessage())
+	}
+	return true
+}
 
-	clientUser = FetchUser(Username)
-	if clientUser == nil {
-		fmt.Println("Error: El usuario "+Username+" no existe. Debe solicitar un nuevo usuario")
-		return
+// Inicia sesión pidiendo la contraseña del usuario
+func passwordLogin() bool {
+	Username = Login
+	if Username == "" {
+		user, err := user.Current()
+		if err != nil {
+			panic(err)
+		}
+		Username = user.Username
 	}
 
 	fmt.Print("Contraseña: ")
 	password := readPassword()
-	sum := sha256.Sum256([]byte(password))
-	token := AuthUser(Username, fmt.Sprintf("%x", sum))
+	token, err := AuthUser(Username, password)
 
-	if len(token) == 0 {
-		fmt.Println("Error: Credenciales incorrectas")
-		return
+	if err != nil || len(token) == 0 {
+		fmt.Printf("Error: %s\n", err)
+		return false
 	}
 	SetSessionToken(token)
+	return true
+}
+
+func ClientInit(cmd string, exDir string) {
+
+	if cmd == "--debug" {
+		InitLog(true)
+	} else {
+		InitLog(false)
+	}
+	defer logFile.Close()
+
+	PrintWellcome(exDir)
+
+	if !login() {
+		return
+	}
 
 	/*
 		Renew Password
@@ -141,8 +187,7 @@ func ClientInit(cmd string, exDir string) {
 		fmt.Print("Nueva contraseña (otra vez): ")
 		npassword2 := readPassword()
 		if npassword1 == npassword2 {
-			sum := sha256.Sum256([]byte(npassword1))
-			u := RenewPassword(Username, fmt.Sprintf("%x", sum))
+			u := RenewPassword(Username, npassword1)
 			if u == nil {
 				fmt.Println("La contraseña no fue cambiada. Fallo la petición.")
 			}
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/gdamore/tcell"
+)
+
+/*
+
+	Resaltado de sintaxis de los bloques de código
+
+	Los bloques de código que indican su lenguaje tras la marca de apertura
+	(```go, ```bash, ```yaml...) se trocean en tramos según el tipo de cada
+	elemento: palabras reservadas, cadenas, comentarios y números. No es un
+	analizador completo de cada lenguaje, solo lo necesario para colorear.
+
+	Los bloques sin lenguaje o con uno desconocido se muestran como código
+	sin colorear.
+
+*/
+
+// Columnas que se desplaza un bloque de código con cada pulsación
+const CODE_SCROLL_STEP = 8
+
+const (
+	TOKEN_NONE    = 0
+	TOKEN_KEYWORD = 1
+	TOKEN_STRING  = 2
+	TOKEN_COMMENT = 3
+	TOKEN_NUMBER  = 4
+	TOKEN_KEY     = 5 // claves en yaml y variables en shell
+)
+
+type syntax struct {
+	keywords      map[string]bool
+	lineComment   string
+	blockComment  [2]string
+	quotes        string
+	keyBeforeChar rune   // los identificadores seguidos de este carácter se marcan como TOKEN_KEY
+	varPrefix     rune   // los identificadores que empiezan por este carácter se marcan como TOKEN_KEY
+	identExtra    string // caracteres que, además de letras y números, forman parte de un identificador
+}
+
+var syntaxes = map[string]*syntax{
+	"go": {
+		keywords: wordSet(`break case chan const continue default defer else fallthrough for func go goto if
+			import interface map package range return select struct switch type var
+			nil true false iota append len cap make new panic recover
+			bool byte rune string error int int8 int16 int32 int64 uint uint8 uint16 uint32 uint64 float32 float64`),
+		lineComment:  "//",
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+	},
+	"bash": {
+		keywords: wordSet(`if then else elif fi case esac for while until do done in function select time
+			return exit export local readonly declare unset shift source alias echo cd test true false sudo`),
+		lineComment: "#",
+		quotes:      "\"'`",
+		varPrefix:   '$',
+		identExtra:  "-.",
+	},
+	"yaml": {
+		keywords:      wordSet(`true false yes no on off null`),
+		lineComment:   "#",
+		quotes:        "\"'",
+		keyBeforeChar: ':',
+		identExtra:    "-.",
+	},
+	"python": {
+		keywords: wordSet(`and as assert break class continue def del elif else except finally for from global
+			if import in is lambda nonlocal not or pass raise return try while with yield None True False self`),
+		lineComment: "#",
+		quotes:      "\"'",
+	},
+	"json": {
+		keywords:      wordSet(`true false null`),
+		quotes:        "\"",
+		keyBeforeChar: ':',
+	},
+}
+
+// Nombres alternativos con los que se puede indicar un lenguaje
+var syntaxAliases = map[string]string{
+	"golang": "go",
+	"sh":     "bash",
+	"shell":  "bash",
+	"zsh":    "bash",
+	"yml":    "yaml",
+	"py":     "python",
+}
+
+func wordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+	return set
+}
+
+func getSyntax(lang string) *syntax {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if alias, ok := syntaxAliases[lang]; ok {
+		lang = alias
+	}
+	return syntaxes[lang]
+}
+
+// Color con el que se dibuja cada tipo de elemento
+func tokenColor(token int) tcell.Color {
+	switch token {
+	case TOKEN_KEYWORD:
+		return tcell.ColorFuchsia
+	case TOKEN_STRING:
+		return tcell.ColorYellow
+	case TOKEN_COMMENT:
+		return tcell.ColorGray
+	case TOKEN_NUMBER:
+		return tcell.ColorAqua
+	case TOKEN_KEY:
+		return tcell.ColorLightSkyBlue
+	}
+	return tcell.ColorLightGreen
+}
+
+// Estado del resaltado que pasa de una línea a la siguiente: si estamos
+// dentro de un comentario de bloque o de una cadena de varias líneas
+type highlightState struct {
+	inComment bool
+	inString  rune
+}
+
+// Trocea una línea de código en tramos coloreados según la sintaxis del
+// lenguaje. Si el lenguaje no se conoce retorna la línea en un único tramo
+func highlightLine(line string, lang string, state *highlightState) []Run {
+	syn := getSyntax(lang)
+	if syn == nil {
+		return []Run{{Text: line, Code: true}}
+	}
+
+	runs := make([]Run, 0)
+	rs := []rune(line)
+	add := func(text string, token int) {
+		if text == "" {
+			return
+		}
+		if n := len(runs); n > 0 && runs[n-1].Token == token {
+			runs[n-1].Text += text
+			return
+		}
+		runs = append(runs, Run{Text: text, Code: true, Token: token})
+	}
+
+	i := 0
+	for i < len(rs) {
+		rest := string(rs[i:])
+
+		if state.inComment {
+			end := strings.Index(rest, syn.blockComment[1])
+			if end < 0 {
+				add(rest, TOKEN_COMMENT)
+				break
+			}
+			end += len(syn.blockComment[1])
+			add(rest[:end], TOKEN_COMMENT)
+			i += len([]rune(rest[:end]))
+			state.inComment = false
+			continue
+		}
+
+		if state.inString != 0 {
+			j := i
+			for j < len(rs) && rs[j] != state.inString {
+				if rs[j] == '\\' && state.inString != '`' {
+					j++
+				}
+				j++
+			}
+			if j >= len(rs) {
+				add(string(rs[i:]), TOKEN_STRING)
+				break
+			}
+			add(string(rs[i:j+1]), TOKEN_STRING)
+			state.inString = 0
+			i = j + 1
+			continue
+		}
+
+		if syn.lineComment != "" && strings.HasPrefix(rest, syn.lineComment) {
+			// en shell y yaml '#' solo abre comentario al principio de una palabra
+			if syn.lineComment != "#" || i == 0 || unicode.IsSpace(rs[i-1]) {
+				add(rest, TOKEN_COMMENT)
+				break
+			}
+		}
+
+		if syn.blockComment[0] != "" && strings.HasPrefix(rest, syn.blockComment[0]) {
+			state.inComment = true
+			add(syn.blockComment[0], TOKEN_COMMENT)
+			i += len([]rune(syn.blockComment[0]))
+			continue
+		}
+
+		if strings.ContainsRune(syn.quotes, rs[i]) {
+			state.inString = rs[i]
+			add(string(rs[i]), TOKEN_STRING)
+			i++
+			continue
+		}
+
+		if syn.varPrefix != 0 && rs[i] == syn.varPrefix {
+			j := i + 1
+			for j < len(rs) && (isIdentRune(rs[j]) || rs[j] == '{' || rs[j] == '}') {
+				j++
+			}
+			add(string(rs[i:j]), TOKEN_KEY)
+			i = j
+			continue
+		}
+
+		if unicode.IsDigit(rs[i]) && (i == 0 || !isIdentRune(rs[i-1])) {
+			j := i
+			for j < len(rs) && (isIdentRune(rs[j]) || rs[j] == '.') {
+				j++
+			}
+			add(string(rs[i:j]), TOKEN_NUMBER)
+			i = j
+			continue
+		}
+
+		if isIdentRune(rs[i]) {
+			j := i
+			for j < len(rs) && (isIdentRune(rs[j]) || strings.ContainsRune(syn.identExtra, rs[j])) {
+				j++
+			}
+			word := string(rs[i:j])
+			token := TOKEN_NONE
+			if syn.keyBeforeChar != 0 && j < len(rs) && rs[j] == syn.keyBeforeChar {
+				token = TOKEN_KEY
+			} else if syn.keywords[word] {
+				token = TOKEN_KEYWORD
+			}
+			add(word, token)
+			i = j
+			continue
+		}
+
+		add(string(rs[i]), TOKEN_NONE)
+		i++
+	}
+
+	if len(runs) == 0 {
+		runs = append(runs, Run{Text: "", Code: true})
+	}
+	return runs
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,388 @@
+package client
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/gdamore/tcell"
+)
+
+/*
+
+	Marcado ligero de los mensajes
+
+	El texto de un mensaje admite un pequeño dialecto de marcado:
+
+		*negrita*  _cursiva_  `código`
+		```        bloques de código (nunca se reparten en varias líneas)
+		> cita
+		- elemento de una lista (también con *)
+
+	El texto se trocea en líneas de tramos (Run) con su propio estilo. Las
+	líneas ya vienen cortadas a la anchura del panel respetando el word
+	wrapping, salvo las de los bloques de código que se dibujan tal cual.
+
+	Las marcas [[palabra]] que deja marksMatchesWord tras una búsqueda se
+	convierten también en un tramo resaltado.
+
+	Los bloques de código con lenguaje se colorean con highlightLine (ver
+	highlight.go). Las líneas que no caben en el panel se desplazan en
+	horizontal en vez de cortarse.
+
+*/
+
+const (
+	LINE_TEXT   = 0
+	LINE_HEADER = 1
+	LINE_QUOTE  = 2
+	LINE_BULLET = 3
+	LINE_CODE   = 4
+)
+
+const QUOTE_PREFIX = "│ "
+const BULLET_PREFIX = "• "
+const CODE_FENCE = "```"
+
+type Run struct {
+	Text   string
+	Bold   bool
+	Italic bool
+	Code   bool
+	Mark   bool
+	Token  int // tipo de elemento dentro de un bloque de código
+}
+
+type CodeBlock struct {
+	Lang string
+	Text string
+}
+
+type StyledLine struct {
+	Kind int
+	Runs []Run
+}
+
+func NewTextLine(text string) StyledLine {
+	return StyledLine{Kind: LINE_TEXT, Runs: []Run{{Text: text}}}
+}
+
+// Retorna el texto de la línea sin estilos
+func (l StyledLine) String() string {
+	text := ""
+	for _, r := range l.Runs {
+		text += r.Text
+	}
+	return text
+}
+
+// Retorna el estilo con el que se dibuja un tramo a partir del estilo base
+// de la línea
+func (r Run) Style(base tcell.Style) tcell.Style {
+	style := base
+	if r.Bold {
+		style = style.Bold(true)
+	}
+	if r.Italic {
+		style = style.Italic(true)
+	}
+	if r.Code {
+		style = style.Foreground(tokenColor(r.Token))
+	}
+	if r.Mark {
+		style = style.Reverse(true)
+	}
+	return style
+}
+
+// Trocea el texto de un mensaje en líneas con estilo de como máximo nchars
+// caracteres. Las líneas de los bloques de código no se cortan
+func ParseMarkup(text string, nchars int) []StyledLine {
+	lines := make([]StyledLine, 0)
+	inCode := false
+	lang := ""
+	var state highlightState
+
+	for _, raw := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		trimmed := strings.TrimSpace(raw)
+
+		if strings.HasPrefix(trimmed, CODE_FENCE) {
+			inCode = !inCode
+			lang = strings.TrimSpace(strings.TrimPrefix(trimmed, CODE_FENCE))
+			state = highlightState{}
+			continue
+		}
+
+		if inCode {
+			raw = strings.Replace(raw, "\t", strings.Repeat(" ", TABSPACES), -1)
+			lines = append(lines, StyledLine{Kind: LINE_CODE, Runs: highlightLine(raw, lang, &state)})
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, ">") {
+			content := strings.TrimSpace(strings.TrimPrefix(trimmed, ">"))
+			for _, runs := range wrapRuns(parseInline(content), nchars-len([]rune(QUOTE_PREFIX))) {
+				runs = append([]Run{{Text: QUOTE_PREFIX}}, runs...)
+				lines = append(lines, StyledLine{Kind: LINE_QUOTE, Runs: runs})
+			}
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* ") {
+			content := strings.TrimSpace(trimmed[2:])
+			indent := strings.Repeat(" ", len([]rune(BULLET_PREFIX)))
+			for i, runs := range wrapRuns(parseInline(content), nchars-len([]rune(BULLET_PREFIX))) {
+				prefix := BULLET_PREFIX
+				if i > 0 {
+					prefix = indent
+				}
+				runs = append([]Run{{Text: prefix}}, runs...)
+				lines = append(lines, StyledLine{Kind: LINE_BULLET, Runs: runs})
+			}
+			continue
+		}
+
+		if trimmed == "" {
+			lines = append(lines, NewTextLine(""))
+			continue
+		}
+
+		for _, runs := range wrapRuns(parseInline(raw), nchars) {
+			lines = append(lines, StyledLine{Kind: LINE_TEXT, Runs: runs})
+		}
+	}
+	return lines
+}
+
+// Retorna el contenido de los bloques de código de un mensaje
+func ExtractCodeBlocks(text string) []CodeBlock {
+	blocks := make([]CodeBlock, 0)
+	var current *CodeBlock
+	lines := make([]string, 0)
+
+	for _, raw := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(raw)
+		if strings.HasPrefix(trimmed, CODE_FENCE) {
+			if current == nil {
+				current = &CodeBlock{Lang: strings.TrimSpace(strings.TrimPrefix(trimmed, CODE_FENCE))}
+				lines = make([]string, 0)
+			} else {
+				current.Text = strings.Join(lines, "\n") + "\n"
+				blocks = append(blocks, *current)
+				current = nil
+			}
+			continue
+		}
+		if current != nil {
+			lines = append(lines, raw)
+		}
+	}
+	return blocks
+}
+
+// Busca en la línea los marcadores de estilo en línea y retorna los tramos
+// resultantes
+func parseInline(text string) []Run {
+	runs := make([]Run, 0)
+	rs := []rune(text)
+	plain := make([]rune, 0)
+
+	flush := func() {
+		if len(plain) > 0 {
+			runs = append(runs, Run{Text: string(plain)})
+			plain = make([]rune, 0)
+		}
+	}
+
+	for i := 0; i < len(rs); i++ {
+		if rs[i] == '[' && i+1 < len(rs) && rs[i+1] == '[' {
+			if end := indexFrom(rs, "]]", i+2); end > i+2 {
+				flush()
+				runs = append(runs, Run{Text: string(rs[i+2 : end]), Mark: true})
+				i = end + 1
+				continue
+			}
+		}
+
+		if rs[i] == '`' {
+			if end := indexFrom(rs, "`", i+1); end > i+1 {
+				flush()
+				runs = append(runs, Run{Text: string(rs[i+1 : end]), Code: true})
+				i = end
+				continue
+			}
+		}
+
+		if (rs[i] == '*' || rs[i] == '_') && isOpeningMark(rs, i) {
+			if end := closingMark(rs, rs[i], i+1); end > 0 {
+				flush()
+				for _, r := range parseInline(string(rs[i+1 : end])) {
+					if rs[i] == '*' {
+						r.Bold = true
+					} else {
+						r.Italic = true
+					}
+					runs = append(runs, r)
+				}
+				i = end
+				continue
+			}
+		}
+
+		plain = append(plain, rs[i])
+	}
+	flush()
+	return runs
+}
+
+func indexFrom(rs []rune, sep string, from int) int {
+	if from > len(rs) {
+		return -1
+	}
+	i := strings.Index(string(rs[from:]), sep)
+	if i < 0 {
+		return -1
+	}
+	return from + len([]rune(string(rs[from:])[:i]))
+}
+
+// Un marcador abre un estilo si va al principio de una palabra. Así no se
+// confunden los guiones bajos de nombres_como_este
+func isOpeningMark(rs []rune, i int) bool {
+	if i+1 >= len(rs) || unicode.IsSpace(rs[i+1]) {
+		return false
+	}
+	return i == 0 || unicode.IsSpace(rs[i-1]) || unicode.IsPunct(rs[i-1])
+}
+
+// Retorna la posición del marcador que cierra el estilo o -1 si no se cierra
+// en la misma línea
+func closingMark(rs []rune, mark rune, from int) int {
+	for j := from + 1; j < len(rs); j++ {
+		if rs[j] != mark || unicode.IsSpace(rs[j-1]) {
+			continue
+		}
+		if j+1 == len(rs) || unicode.IsSpace(rs[j+1]) || unicode.IsPunct(rs[j+1]) {
+			return j
+		}
+	}
+	return -1
+}
+
+// Reparte los tramos en líneas de como máximo nchars caracteres cortando por
+// los espacios. Una palabra que no cabe en una línea se corta a la fuerza
+func wrapRuns(runs []Run, nchars int) [][]Run {
+	if nchars < 1 {
+		nchars = 1
+	}
+	lines := make([][]Run, 0)
+	line := make([]Run, 0)
+	count := 0
+
+	newLine := func() {
+		lines = append(lines, trimRightRuns(line))
+		line = make([]Run, 0)
+		count = 0
+	}
+
+	for _, run := range runs {
+		for _, word := range splitWords(run.Text) {
+			wlen := len([]rune(word))
+			isSpace := strings.TrimSpace(word) == ""
+			if count+wlen > nchars && !isSpace && count > 0 {
+				newLine()
+			}
+			if count == 0 && isSpace {
+				continue
+			}
+			for wlen > nchars {
+				part := []rune(word)[:nchars-count]
+				line = appendRun(line, run, string(part))
+				newLine()
+				word = string([]rune(word)[len(part):])
+				wlen = len([]rune(word))
+			}
+			line = appendRun(line, run, word)
+			count += wlen
+		}
+	}
+	if len(line) > 0 || len(lines) == 0 {
+		lines = append(lines, trimRightRuns(line))
+	}
+	return lines
+}
+
+// Separa un texto en palabras y bloques de espacios conservando ambos
+func splitWords(text string) []string {
+	words := make([]string, 0)
+	current := make([]rune, 0)
+	for _, r := range text {
+		if len(current) > 0 && unicode.IsSpace(r) != unicode.IsSpace(current[len(current)-1]) {
+			words = append(words, string(current))
+			current = make([]rune, 0)
+		}
+		current = append(current, r)
+	}
+	if len(current) > 0 {
+		words = append(words, string(current))
+	}
+	return words
+}
+
+// Añade texto a la línea juntándolo con el último tramo si tiene el mismo estilo
+func appendRun(line []Run, style Run, text string) []Run {
+	if n := len(line); n > 0 {
+		last := line[n-1]
+		if last.Bold == style.Bold && last.Italic == style.Italic && last.Code == style.Code && last.Mark == style.Mark && last.Token == style.Token {
+			line[n-1].Text += text
+			return line
+		}
+	}
+	style.Text = text
+	return append(line, style)
+}
+
+func trimRightRuns(line []Run) []Run {
+	for len(line) > 0 {
+		n := len(line) - 1
+		line[n].Text = strings.TrimRightFunc(line[n].Text, unicode.IsSpace)
+		if line[n].Text != "" {
+			break
+		}
+		line = line[:n]
+	}
+	return line
+}
+
+// Dibuja una línea con estilos a partir del punto (x,y) sin pasar de la
+// columna x2. En las líneas de código se saltan los primeros offset
+// caracteres y se marca con « y » si queda texto fuera por algún lado.
+// Retorna la columna donde terminó de escribir
+func drawStyledLine(s tcell.Screen, x, y, x2 int, base tcell.Style, line StyledLine, offset int) int {
+	col := x
+	if line.Kind == LINE_QUOTE {
+		base = base.Foreground(tcell.ColorSilver).Italic(true)
+	}
+	if line.Kind != LINE_CODE {
+		offset = 0
+	}
+	skipped := 0
+	for _, run := range line.Runs {
+		style := run.Style(base)
+		for _, r := range run.Text {
+			if skipped < offset {
+				skipped++
+				continue
+			}
+			if col >= x2 {
+				s.SetContent(x2-1, y, '»', nil, base.Reverse(true))
+				return col
+			}
+			s.SetContent(col, y, r, nil, style)
+			col++
+		}
+	}
+	if skipped > 0 {
+		s.SetContent(x, y, '«', nil, base.Reverse(true))
+	}
+	return col
+}
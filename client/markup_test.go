@@ -0,0 +1,114 @@
+package client
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseInline(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []Run
+	}{
+		{"negrita", "*negrita*", []Run{{Text: "negrita", Bold: true}}},
+		{"cursiva", "_cursiva_", []Run{{Text: "cursiva", Italic: true}}},
+		{"código", "`código`", []Run{{Text: "código", Code: true}}},
+		{"en medio del texto", "a *b* c", []Run{{Text: "a "}, {Text: "b", Bold: true}, {Text: " c"}}},
+		{"antes de puntuación", "*hola*, adiós", []Run{{Text: "hola", Bold: true}, {Text: ", adiós"}}},
+		{"anidados", "*negrita _y cursiva_*", []Run{{Text: "negrita ", Bold: true}, {Text: "y cursiva", Bold: true, Italic: true}}},
+		{"código sin estilos dentro", "`*a*`", []Run{{Text: "*a*", Code: true}}},
+		{"marca de búsqueda", "ver [[palabra]]", []Run{{Text: "ver "}, {Text: "palabra", Mark: true}}},
+		{"negrita sin cerrar", "*sin cerrar", []Run{{Text: "*sin cerrar"}}},
+		{"cursiva sin cerrar", "a _b c", []Run{{Text: "a _b c"}}},
+		{"código sin cerrar", "`sin cerrar", []Run{{Text: "`sin cerrar"}}},
+		{"marca sin cerrar", "[[sin cerrar", []Run{{Text: "[[sin cerrar"}}},
+		{"marcadores vacíos", "** y ``", []Run{{Text: "** y ``"}}},
+		{"marcador seguido de espacio", "* no * es negrita", []Run{{Text: "* no * es negrita"}}},
+		{"guiones bajos en nombres", "nombres_como_este", []Run{{Text: "nombres_como_este"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseInline(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseInline(%q) = %+v, se esperaba %+v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+type markupLine struct {
+	kind int
+	text string
+}
+
+func TestParseMarkup(t *testing.T) {
+	longCode := "esta línea de código no se corta nunca"
+	tests := []struct {
+		name   string
+		text   string
+		nchars int
+		want   []markupLine
+	}{
+		{"texto cortado por palabras", "hola mundo cruel", 10,
+			[]markupLine{{LINE_TEXT, "hola mundo"}, {LINE_TEXT, "cruel"}}},
+		{"palabra más larga que la línea", "abcdefghij", 4,
+			[]markupLine{{LINE_TEXT, "abcd"}, {LINE_TEXT, "efgh"}, {LINE_TEXT, "ij"}}},
+		{"líneas vacías", "a\n\nb", 10,
+			[]markupLine{{LINE_TEXT, "a"}, {LINE_TEXT, ""}, {LINE_TEXT, "b"}}},
+		{"cita", "> una cita", 20,
+			[]markupLine{{LINE_QUOTE, QUOTE_PREFIX + "una cita"}}},
+		{"cita cortada", "> uno dos tres", 7,
+			[]markupLine{{LINE_QUOTE, QUOTE_PREFIX + "uno"}, {LINE_QUOTE, QUOTE_PREFIX + "dos"}, {LINE_QUOTE, QUOTE_PREFIX + "tres"}}},
+		{"cita de una cita", "> > anidada", 20,
+			[]markupLine{{LINE_QUOTE, QUOTE_PREFIX + "> anidada"}}},
+		{"lista dentro de una cita", "> - elemento", 20,
+			[]markupLine{{LINE_QUOTE, QUOTE_PREFIX + "- elemento"}}},
+		{"lista con guiones y asteriscos", "- uno\n* dos", 20,
+			[]markupLine{{LINE_BULLET, BULLET_PREFIX + "uno"}, {LINE_BULLET, BULLET_PREFIX + "dos"}}},
+		{"elemento cortado con sangría", "- uno dos tres", 8,
+			[]markupLine{{LINE_BULLET, BULLET_PREFIX + "uno"}, {LINE_BULLET, "  dos"}, {LINE_BULLET, "  tres"}}},
+		{"lista sangrada", "  - sangrado", 20,
+			[]markupLine{{LINE_BULLET, BULLET_PREFIX + "sangrado"}}},
+		{"cita dentro de una lista", "- > no es cita", 20,
+			[]markupLine{{LINE_BULLET, BULLET_PREFIX + "> no es cita"}}},
+		{"bloque de código sin cortar", "```\n" + longCode + "\n```", 10,
+			[]markupLine{{LINE_CODE, longCode}}},
+		{"tabuladores en el código", "```\n\tx\n```", 10,
+			[]markupLine{{LINE_CODE, strings.Repeat(" ", TABSPACES) + "x"}}},
+		{"marcas dentro del código", "```\n> *no* - es marcado\n```", 10,
+			[]markupLine{{LINE_CODE, "> *no* - es marcado"}}},
+		{"bloque sin cerrar", "antes\n```\n" + longCode, 10,
+			[]markupLine{{LINE_TEXT, "antes"}, {LINE_CODE, longCode}}},
+		{"texto tras el bloque", "```go\nx := 1\n```\nuno dos", 4,
+			[]markupLine{{LINE_CODE, "x := 1"}, {LINE_TEXT, "uno"}, {LINE_TEXT, "dos"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]markupLine, 0)
+			for _, l := range ParseMarkup(tt.text, tt.nchars) {
+				got = append(got, markupLine{l.Kind, l.String()})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseMarkup(%q, %d) = %q, se esperaba %q", tt.text, tt.nchars, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMarkupKeepsStylesWhenWrapping(t *testing.T) {
+	lines := ParseMarkup("- *uno dos* tres", 8)
+	want := [][]Run{
+		{{Text: BULLET_PREFIX}, {Text: "uno", Bold: true}},
+		{{Text: "  "}, {Text: "dos", Bold: true}},
+		{{Text: "  "}, {Text: "tres"}},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("se esperaban %d líneas y hay %d: %+v", len(want), len(lines), lines)
+	}
+	for i, l := range lines {
+		if !reflect.DeepEqual(l.Runs, want[i]) {
+			t.Errorf("línea %d = %+v, se esperaba %+v", i, l.Runs, want[i])
+		}
+	}
+}
@@ -6,10 +6,16 @@ import (
 	"errors"
 	"fmt"
 	"gbb/srv"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
+	"net/url"
 	"sort"
+	"strings"
+	"syscall"
+	"time"
 )
 
 /*
@@ -20,7 +26,10 @@ import (
 
 const STATUS_OK = "200 OK"
 
-var client = &http.Client{}
+// Tiempo máximo de espera de cada petición al servidor
+const REQUEST_TIMEOUT = 30 * time.Second
+
+var client = &http.Client{Timeout: REQUEST_TIMEOUT}
 var tokenSession *http.Cookie
 
 func SetSessionToken(tokenValue string) {
@@ -36,10 +45,113 @@ func SetSessionToken(tokenValue string) {
 	}
 }
 
+// Retorna el error que el servidor manda en el cuerpo de una respuesta
+// fallida. Si no se puede leer se usa el texto por defecto. Los errores de
+// validación se retornan como *srv.ValidationError para saber qué campo
+// los provocó
+func responseError(resp *http.Response, defaultText string) error {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		defaultText = fmt.Sprintf("Demasiadas peticiones. Inténtelo de nuevo en %s segundos", resp.Header.Get("Retry-After"))
+	}
+	var body json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return errors.New(defaultText)
+	}
+	verr := new(srv.ValidationError)
+	if json.Unmarshal(body, verr) == nil && verr.Field != "" {
+		return verr
+	}
+	text := ""
+	if err := json.Unmarshal(body, &text); err != nil || text == "" {
+		return errors.New(defaultText)
+	}
+	return errors.New(text)
+}
+
+// Retorna el campo que provocó un error de validación o "" si err no lo es
+func invalidField(err error) string {
+	if verr, ok := err.(*srv.ValidationError); ok {
+		return verr.Field
+	}
+	return ""
+}
+
+// URL base de las peticiones. Con un socket local el host no se usa
+func apiURL() string {
+	if isLocalSocket() {
+		return "http://gbb"
+	}
+	return srv.SERVER
+}
+
+// Retorna el http.Transport del cliente, creándolo si aún usa el de por defecto
+func clientTransport() *http.Transport {
+	if client.Transport == nil {
+		client.Transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	return client.Transport.(*http.Transport)
+}
+
+// Traduce un error de conexión con el servidor a un mensaje que explique qué
+// ha fallado
+func connectionError(err error) error {
+	reason := err.Error()
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	if errors.As(err, &dnsErr) {
+		reason = "no se encuentra el nombre " + dnsErr.Name
+	} else if errors.Is(err, syscall.ENOENT) {
+		reason = "no existe el socket, ¿está arrancado el servidor?"
+	} else if errors.Is(err, syscall.ECONNREFUSED) {
+		reason = "conexión rechazada, ¿está arrancado el servidor?"
+	} else if errors.As(err, &netErr) && netErr.Timeout() {
+		reason = "el servidor no responde"
+	} else if tlsReason := tlsErrorReason(err); tlsReason != "" {
+		reason = tlsReason
+	}
+	return fmt.Errorf("No se puede conectar con el servidor %s: %s", srv.SERVER, reason)
+}
+
+// Comprueba que el servidor responde y que su API es compatible con la del
+// cliente
+func CheckServer() (*srv.VersionInfo, error) {
+	u, err := url.Parse(srv.SERVER)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "unix") {
+		return nil, fmt.Errorf("La URL del servidor no es válida: %s", srv.SERVER)
+	}
+	r, err := http.NewRequest("GET", apiURL()+"/version", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, connectionError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest && resp.TLS == nil && strings.HasPrefix(srv.SERVER, "http:") {
+		body, _ := ioutil.ReadAll(resp.Body)
+		if strings.Contains(string(body), "HTTPS") {
+			return nil, fmt.Errorf("El servidor %s usa HTTPS, pruebe con una URL https://", srv.SERVER)
+		}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("El servidor %s es de una versión anterior incompatible con este cliente", srv.SERVER)
+	}
+	info := new(srv.VersionInfo)
+	if resp.Status != STATUS_OK || json.NewDecoder(resp.Body).Decode(info) != nil {
+		return nil, fmt.Errorf("%s no responde como un servidor GBB", srv.SERVER)
+	}
+	if info.Api != srv.API_VERSION {
+		return info, fmt.Errorf("El servidor usa la versión %s (API %d) y este cliente la %s (API %d). Actualice el que sea más antiguo",
+			info.Version, info.Api, srv.VERSION, srv.API_VERSION)
+	}
+	return info, nil
+}
+
 // Carga el tablón desde la API
 func FetchBoard() *srv.Board {
 	b := srv.CreateBoard()
-	url := fmt.Sprintf("%s/board", srv.SERVER)
+	url := fmt.Sprintf("%s/board", apiURL())
 	req, err := http.NewRequest("GET", url, nil)
 	req.AddCookie(tokenSession)
 	resp, err := client.Do(req)
@@ -54,7 +166,7 @@ func FetchBoard() *srv.Board {
 // Carga un thread desde la API
 func FetchThread(key string) *srv.Thread {
 	th := srv.NewThread("", &srv.Message{})
-	url := fmt.Sprintf("%s/threads/%s", srv.SERVER, key)
+	url := fmt.Sprintf("%s/threads/%s", apiURL(), key)
 	req, err := http.NewRequest("GET", url, nil)
 	req.AddCookie(tokenSession)
 	resp, err := client.Do(req)
@@ -73,7 +185,7 @@ func FetchThread(key string) *srv.Thread {
 // lo contengan
 func FindThreads(pattern string) []*srv.Thread {
 	matches := make([]*srv.Thread, 0)
-	url := fmt.Sprintf("%s/board/%s", srv.SERVER, pattern)
+	url := fmt.Sprintf("%s/board/%s", apiURL(), pattern)
 	r, err := http.NewRequest("GET", url, nil)
 	if err == nil {
 		r.AddCookie(tokenSession)
@@ -91,115 +203,169 @@ func FindThreads(pattern string) []*srv.Thread {
 func CreateThread(title string) (th *srv.Thread, err error) {
 	buf := new(bytes.Buffer)
 	err = json.NewEncoder(buf).Encode(title)
-	url := fmt.Sprintf("%s/board", srv.SERVER)
+	url := fmt.Sprintf("%s/board", apiURL())
 	r, err := http.NewRequest("POST", url, buf)
 	r.AddCookie(tokenSession)
 	resp, err := client.Do(r)
-	if err == nil && resp.Status == "200 OK" {
-		th = new(srv.Thread)
-		err = json.NewDecoder(resp.Body).Decode(th)
+	if err != nil {
+		return nil, err
 	}
+	if resp.Status != STATUS_OK {
+		return nil, responseError(resp, "Operación no permitida")
+	}
+	th = new(srv.Thread)
+	err = json.NewDecoder(resp.Body).Decode(th)
 	return th, err
 }
 
 // Borra un hilo completo a través de la API
 func DeleteThread(th *srv.Thread) error {
-	url := fmt.Sprintf("%s/threads/%s", srv.SERVER, th.Id)
+	url := fmt.Sprintf("%s/threads/%s", apiURL(), th.Id)
 	r, err := http.NewRequest("DELETE", url, nil)
 	r.AddCookie(tokenSession)
 	resp, err := client.Do(r)
-	if resp.Status != "200 OK" {
-		return errors.New("Borrado no autorizado")
+	if err != nil {
+		return err
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Borrado no autorizado")
 	}
-	return err
+	return nil
 }
 
 // Añade una respuesta a un hilo desde la API
 func UpdateThreadWithNewReply(m *srv.Message, key string) error {
 	buf := new(bytes.Buffer)
 	err := json.NewEncoder(buf).Encode(m)
-	url := fmt.Sprintf("%s/threads/%s", srv.SERVER, key)
+	url := fmt.Sprintf("%s/threads/%s", apiURL(), key)
 	r, err := http.NewRequest("PUT", url, buf)
 	r.AddCookie(tokenSession)
 	resp, err := client.Do(r)
-	if err == nil && resp.Status == "200 OK" {
-		return nil
+	if err != nil {
+		return err
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Operación no permitida")
 	}
-	return errors.New("Operación no permitida")
+	// el servidor puede haber enmascarado parte del texto o retenido el mensaje
+	return json.NewDecoder(resp.Body).Decode(m)
 }
 
 // Actualiza el estado de un thread en base al cmd enviado. El valor de
 // cmd puede ser: open|close|fixed|free
 func UpdateThreadStatus(th *srv.Thread, cmd string) error {
-	url := fmt.Sprintf("%s/threads/%s/%s", srv.SERVER, th.Id, cmd)
+	url := fmt.Sprintf("%s/threads/%s/%s", apiURL(), th.Id, cmd)
 	r, err := http.NewRequest("PUT", url, nil)
 	r.AddCookie(tokenSession)
 	resp, err := client.Do(r)
-	if err == nil && resp.Status == "200 OK" {
-		return nil
+	if err != nil {
+		return err
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Operación no permitida")
+	}
+	return nil
+}
+
+// Fija un hilo con caducidad, orden o como anuncio
+func PinThread(th *srv.Thread, pin srv.PinRequest) error {
+	buf := new(bytes.Buffer)
+	err := json.NewEncoder(buf).Encode(pin)
+	url := fmt.Sprintf("%s/threads/%s/fixed", apiURL(), th.Id)
+	r, err := http.NewRequest("PUT", url, buf)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Operación no permitida")
 	}
-	return errors.New("Operación no permitida")
+	return nil
 }
 
-// Actualiza el contenido de un mensaje
+// Actualiza el contenido de un mensaje sobre la versión m.Version. Si otro
+// usuario lo ha cambiado entre tanto retorna un *srv.EditConflict con la
+// versión actual
 func UpdateContentMessage(m *srv.Message) error {
 	buf := new(bytes.Buffer)
 	err := json.NewEncoder(buf).Encode(m)
-	url := fmt.Sprintf("%s/messages/%d", srv.SERVER, m.Id)
+	url := fmt.Sprintf("%s/messages/%d", apiURL(), m.Id)
 	r, err := http.NewRequest("PUT", url, buf)
 	r.AddCookie(tokenSession)
+	r.Header.Set("If-Match", fmt.Sprintf(`"%d"`, m.Version))
 	resp, err := client.Do(r)
-	if err == nil && resp.Status == "200 OK" {
-		return nil
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		conflict := new(srv.EditConflict)
+		if err := json.NewDecoder(resp.Body).Decode(conflict); err != nil || conflict.Current == nil {
+			return errors.New("El mensaje ha sido modificado por otro usuario")
+		}
+		return conflict
 	}
-	return errors.New("Operación no permitida")
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Operación no permitida")
+	}
+	return json.NewDecoder(resp.Body).Decode(m)
 }
 
 // Borra un mensaje desde la Api
 func DeleteMessage(m *srv.Message, key string) error {
-	url := fmt.Sprintf("%s/messages/%d", srv.SERVER, m.Id)
+	url := fmt.Sprintf("%s/messages/%d", apiURL(), m.Id)
 	r, err := http.NewRequest("DELETE", url, nil)
 	r.AddCookie(tokenSession)
 	resp, err := client.Do(r)
-	if err == nil && resp.Status == "200 OK" {
-		return nil
+	if err != nil {
+		return err
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Borrado no autorizado")
 	}
-	return errors.New("Borrado no autorizado")
+	return nil
 }
 
-// Retorna la info del usuario o nil si el usuario no existe
-func FetchUser(login string) *srv.User {
+// Retorna la info del usuario o nil si el usuario no existe. Necesita sesión
+func FetchUser(login string) (*srv.User, error) {
 	user := new(srv.User)
-	url := fmt.Sprintf("%s/users/%s", srv.SERVER, login)
+	url := fmt.Sprintf("%s/users/%s", apiURL(), login)
 	r, err := http.NewRequest("GET", url, nil)
+	r.AddCookie(tokenSession)
 	resp, err := client.Do(r)
-	if err == nil {
-		err = json.NewDecoder(resp.Body).Decode(user)
-		return user
+	if err != nil {
+		return nil, connectionError(err)
 	}
-	return nil
+	if resp.Status != STATUS_OK {
+		return nil, nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(user)
+	return user, err
 }
 
 // Envía la password y el login y recibe el token de sesión del usuario
-func AuthUser(login string, password string) string {
+func AuthUser(login string, password string) (string, error) {
 	buf := new(bytes.Buffer)
 	err := json.NewEncoder(buf).Encode(password)
-	url := fmt.Sprintf("%s/users/%s", srv.SERVER, login)
+	url := fmt.Sprintf("%s/users/%s", apiURL(), login)
 	r, err := http.NewRequest("POST", url, buf)
 	resp, err := client.Do(r)
 	token := ""
-	if err == nil && resp.Status == "200 OK" {
-		err = json.NewDecoder(resp.Body).Decode(&token)
-		return token
+	if err != nil {
+		return token, connectionError(err)
+	}
+	if resp.Status != STATUS_OK {
+		return token, responseError(resp, "Credenciales incorrectas")
 	}
-	return token
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	return token, err
 }
 
 // Envía la nueva password y recibe un usuario si todo ha ido bien
 func RenewPassword(login string, password string) *srv.User {
 	buf := new(bytes.Buffer)
 	err := json.NewEncoder(buf).Encode(password)
-	url := fmt.Sprintf("%s/users/%s/changePassword", srv.SERVER, login)
+	url := fmt.Sprintf("%s/users/%s/changePassword", apiURL(), login)
 	r, err := http.NewRequest("PUT", url, buf)
 	r.AddCookie(tokenSession)
 	resp, err := client.Do(r)
@@ -211,9 +377,56 @@ func RenewPassword(login string, password string) *srv.User {
 	return nil
 }
 
+// Cierra la sesión actual en el servidor
+func Logout() error {
+	url := fmt.Sprintf("%s/logout", apiURL())
+	r, err := http.NewRequest("POST", url, nil)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return connectionError(err)
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "No se pudo cerrar la sesión")
+	}
+	return nil
+}
+
+// Retorna las sesiones abiertas del usuario
+func FetchSessions() ([]*srv.Session, error) {
+	list := make([]*srv.Session, 0)
+	url := fmt.Sprintf("%s/sessions", apiURL())
+	r, err := http.NewRequest("GET", url, nil)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, connectionError(err)
+	}
+	if resp.Status != STATUS_OK {
+		return nil, responseError(resp, "No se pudieron leer las sesiones")
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	return list, err
+}
+
+// Revoca una de las sesiones del usuario
+func RevokeSession(s *srv.Session) error {
+	url := fmt.Sprintf("%s/sessions/%s", apiURL(), s.Id)
+	r, err := http.NewRequest("DELETE", url, nil)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return connectionError(err)
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "No se pudo revocar la sesión")
+	}
+	return nil
+}
+
 // Envía una peticion para que el servidor recarge la tabla de usuarios
 func ReloadUsers() error {
-	url := fmt.Sprintf("%s/board/users/reload", srv.SERVER)
+	url := fmt.Sprintf("%s/board/users/reload", apiURL())
 	r, err := http.NewRequest("GET", url, nil)
 	r.AddCookie(tokenSession)
 	resp, err := client.Do(r)
@@ -222,3 +435,402 @@ func ReloadUsers() error {
 	}
 	return errors.New("Recarga no autorizada")
 }
+
+// Cambia el título de un hilo. Solo para administradores
+func RenameThread(th *srv.Thread, title string) error {
+	buf := new(bytes.Buffer)
+	err := json.NewEncoder(buf).Encode(title)
+	url := fmt.Sprintf("%s/threads/%s/rename", apiURL(), th.Id)
+	r, err := http.NewRequest("PUT", url, buf)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Operación no permitida")
+	}
+	return nil
+}
+
+// Cambia la categoría de un hilo. Con la categoría vacía se la quita
+func SetThreadCategory(th *srv.Thread, category string) error {
+	buf := new(bytes.Buffer)
+	err := json.NewEncoder(buf).Encode(category)
+	url := fmt.Sprintf("%s/threads/%s/category", apiURL(), th.Id)
+	r, err := http.NewRequest("PUT", url, buf)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Operación no permitida")
+	}
+	return nil
+}
+
+// Fusiona el hilo src dentro del hilo dst. Solo para administradores
+func MergeThreads(dst *srv.Thread, src *srv.Thread) error {
+	url := fmt.Sprintf("%s/threads/%s/merge/%s", apiURL(), dst.Id, src.Id)
+	r, err := http.NewRequest("PUT", url, nil)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Operación no permitida")
+	}
+	return nil
+}
+
+// Divide un hilo a partir del mensaje m. Los mensajes desde m pasan a un
+// hilo nuevo con el título indicado. Solo para administradores
+func SplitThread(th *srv.Thread, m *srv.Message, title string) error {
+	buf := new(bytes.Buffer)
+	err := json.NewEncoder(buf).Encode(title)
+	url := fmt.Sprintf("%s/threads/%s/split/%d", apiURL(), th.Id, m.Id)
+	r, err := http.NewRequest("PUT", url, buf)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Operación no permitida")
+	}
+	return nil
+}
+
+// Mueve un mensaje a otro hilo. Solo para administradores
+func MoveMessage(m *srv.Message, dst *srv.Thread) error {
+	url := fmt.Sprintf("%s/messages/%d/move/%s", apiURL(), m.Id, dst.Id)
+	r, err := http.NewRequest("PUT", url, nil)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Operación no permitida")
+	}
+	return nil
+}
+
+// Retorna todos los usuarios del servidor. Solo para administradores
+func ListUsers() ([]*srv.User, error) {
+	users := make([]*srv.User, 0)
+	url := fmt.Sprintf("%s/admin/users", apiURL())
+	r, err := http.NewRequest("GET", url, nil)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != STATUS_OK {
+		return nil, responseError(resp, "Operación no permitida")
+	}
+	err = json.NewDecoder(resp.Body).Decode(&users)
+	return users, err
+}
+
+// Crea un usuario nuevo y retorna la contraseña que le ha asignado el servidor.
+// Solo para administradores
+func CreateUser(login string) (*srv.UserCredentials, error) {
+	buf := new(bytes.Buffer)
+	err := json.NewEncoder(buf).Encode(login)
+	url := fmt.Sprintf("%s/admin/users", apiURL())
+	r, err := http.NewRequest("POST", url, buf)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != STATUS_OK {
+		return nil, responseError(resp, "Operación no permitida")
+	}
+	cred := new(srv.UserCredentials)
+	err = json.NewDecoder(resp.Body).Decode(cred)
+	return cred, err
+}
+
+// Bloquea a un usuario. Solo para administradores
+func BanUser(login string, ban srv.BanRequest) error {
+	buf := new(bytes.Buffer)
+	err := json.NewEncoder(buf).Encode(ban)
+	url := fmt.Sprintf("%s/admin/users/%s/ban", apiURL(), login)
+	r, err := http.NewRequest("PUT", url, buf)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Operación no permitida")
+	}
+	return nil
+}
+
+// Sustituye los roles de un usuario. Solo para administradores
+func SetUserRoles(login string, grants []srv.RoleGrant) error {
+	buf := new(bytes.Buffer)
+	err := json.NewEncoder(buf).Encode(grants)
+	url := fmt.Sprintf("%s/admin/users/%s/roles", apiURL(), login)
+	r, err := http.NewRequest("PUT", url, buf)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Operación no permitida")
+	}
+	return nil
+}
+
+// Cambia el estado de un usuario en base al cmd enviado. El valor de cmd
+// puede ser: unban|promote|demote|revoke|unlock. Solo para administradores
+func UpdateUserStatus(login string, cmd string) error {
+	url := fmt.Sprintf("%s/admin/users/%s/%s", apiURL(), login, cmd)
+	r, err := http.NewRequest("PUT", url, nil)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Operación no permitida")
+	}
+	return nil
+}
+
+// Olvida los intentos fallidos de inicio de sesión desde una dirección. Solo
+// para administradores
+func UnlockAddress(addr string) error {
+	url := fmt.Sprintf("%s/admin/lockouts/%s", apiURL(), addr)
+	r, err := http.NewRequest("PUT", url, nil)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Operación no permitida")
+	}
+	return nil
+}
+
+// Asigna una contraseña aleatoria nueva a un usuario y la retorna. Solo para
+// administradores
+func ResetUserPassword(login string) (*srv.UserCredentials, error) {
+	url := fmt.Sprintf("%s/admin/users/%s/resetpassword", apiURL(), login)
+	r, err := http.NewRequest("PUT", url, nil)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != STATUS_OK {
+		return nil, responseError(resp, "Operación no permitida")
+	}
+	cred := new(srv.UserCredentials)
+	err = json.NewDecoder(resp.Body).Decode(cred)
+	return cred, err
+}
+
+// Consulta el registro de auditoría. Los filtros vacíos no se aplican y las
+// fechas van en formato AAAA-MM-DD. Solo para administradores
+func FetchAudit(actor string, action string, from string, to string) ([]*srv.AuditRecord, error) {
+	records := make([]*srv.AuditRecord, 0)
+	params := url.Values{}
+	for k, v := range map[string]string{"actor": actor, "action": action, "from": from, "to": to} {
+		if v != "" {
+			params.Set(k, v)
+		}
+	}
+	url := fmt.Sprintf("%s/admin/audit?%s", apiURL(), params.Encode())
+	r, err := http.NewRequest("GET", url, nil)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != STATUS_OK {
+		return nil, responseError(resp, "Operación no permitida")
+	}
+	err = json.NewDecoder(resp.Body).Decode(&records)
+	return records, err
+}
+
+// Denuncia un mensaje ante los administradores
+func ReportMessage(m *srv.Message, reason string) error {
+	buf := new(bytes.Buffer)
+	err := json.NewEncoder(buf).Encode(reason)
+	url := fmt.Sprintf("%s/messages/%d/report", apiURL(), m.Id)
+	r, err := http.NewRequest("POST", url, buf)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return connectionError(err)
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "No se pudo enviar la denuncia")
+	}
+	return nil
+}
+
+// Retorna las denuncias hechas por el usuario
+func FetchOwnReports() ([]*srv.Report, error) {
+	list := make([]*srv.Report, 0)
+	url := fmt.Sprintf("%s/reports", apiURL())
+	r, err := http.NewRequest("GET", url, nil)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, connectionError(err)
+	}
+	if resp.Status != STATUS_OK {
+		return nil, responseError(resp, "No se pudieron leer las denuncias")
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	return list, err
+}
+
+// Marca como vistas las denuncias resueltas con esos ids
+func AckReports(ids []int) error {
+	buf := new(bytes.Buffer)
+	err := json.NewEncoder(buf).Encode(ids)
+	url := fmt.Sprintf("%s/reports/notified", apiURL())
+	r, err := http.NewRequest("PUT", url, buf)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return connectionError(err)
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Operación no permitida")
+	}
+	return nil
+}
+
+// Retorna las denuncias abiertas de la cola de moderación. Solo para
+// administradores
+func FetchReports() ([]*srv.Report, error) {
+	list := make([]*srv.Report, 0)
+	url := fmt.Sprintf("%s/admin/reports", apiURL())
+	r, err := http.NewRequest("GET", url, nil)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, connectionError(err)
+	}
+	if resp.Status != STATUS_OK {
+		return nil, responseError(resp, "Operación no permitida")
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	return list, err
+}
+
+// Resuelve una denuncia. El valor de cmd puede ser: dismiss|delete|close|ban.
+// Solo para administradores
+func ModerateReport(rep *srv.Report, cmd string) error {
+	url := fmt.Sprintf("%s/admin/reports/%d/%s", apiURL(), rep.Id, cmd)
+	r, err := http.NewRequest("PUT", url, nil)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return connectionError(err)
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Operación no permitida")
+	}
+	return nil
+}
+
+// Retorna las reglas de filtro del servidor. Solo para administradores
+func FetchFilters() ([]*srv.FilterRule, error) {
+	list := make([]*srv.FilterRule, 0)
+	url := fmt.Sprintf("%s/admin/filters", apiURL())
+	r, err := http.NewRequest("GET", url, nil)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, connectionError(err)
+	}
+	if resp.Status != STATUS_OK {
+		return nil, responseError(resp, "Operación no permitida")
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	return list, err
+}
+
+// Crea una regla de filtro o, si ya tiene id, la sustituye. Retorna la
+// regla guardada. Solo para administradores
+func SaveFilter(f *srv.FilterRule) (*srv.FilterRule, error) {
+	buf := new(bytes.Buffer)
+	err := json.NewEncoder(buf).Encode(f)
+	method, url := "POST", fmt.Sprintf("%s/admin/filters", apiURL())
+	if f.Id != 0 {
+		method, url = "PUT", fmt.Sprintf("%s/admin/filters/%d", apiURL(), f.Id)
+	}
+	r, err := http.NewRequest(method, url, buf)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, connectionError(err)
+	}
+	if resp.Status != STATUS_OK {
+		return nil, responseError(resp, "Operación no permitida")
+	}
+	saved := new(srv.FilterRule)
+	err = json.NewDecoder(resp.Body).Decode(saved)
+	return saved, err
+}
+
+// Borra una regla de filtro. Solo para administradores
+func DeleteFilter(id int) error {
+	url := fmt.Sprintf("%s/admin/filters/%d", apiURL(), id)
+	r, err := http.NewRequest("DELETE", url, nil)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return connectionError(err)
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "Operación no permitida")
+	}
+	return nil
+}
+
+// Anuncios que el usuario todavía no ha confirmado
+func FetchAnnouncements() ([]*srv.Thread, error) {
+	list := make([]*srv.Thread, 0)
+	url := fmt.Sprintf("%s/announcements", apiURL())
+	r, err := http.NewRequest("GET", url, nil)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, connectionError(err)
+	}
+	if resp.Status != STATUS_OK {
+		return nil, responseError(resp, "No se pudieron leer los anuncios")
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	return list, err
+}
+
+// Marca un anuncio como confirmado
+func AckAnnouncement(th *srv.Thread) error {
+	url := fmt.Sprintf("%s/announcements/%s/ack", apiURL(), th.Id)
+	r, err := http.NewRequest("PUT", url, nil)
+	r.AddCookie(tokenSession)
+	resp, err := client.Do(r)
+	if err != nil {
+		return connectionError(err)
+	}
+	if resp.Status != STATUS_OK {
+		return responseError(resp, "No se pudo confirmar el anuncio")
+	}
+	return nil
+}
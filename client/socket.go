@@ -0,0 +1,53 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gbb/srv"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*
+
+	Socket local
+
+	Con una URL unix:///ruta/del/socket el cliente se conecta al servidor por
+	su socket local. El servidor identifica al usuario del sistema que se
+	conecta y abre la sesión sin pedir contraseña.
+
+*/
+
+func isLocalSocket() bool {
+	return strings.HasPrefix(srv.SERVER, "unix://")
+}
+
+// Hace que todas las peticiones vayan por el socket local
+func configureSocket() {
+	if !isLocalSocket() {
+		return
+	}
+	path := strings.TrimPrefix(srv.SERVER, "unix://")
+	clientTransport().DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+}
+
+// Abre una sesión como el usuario del sistema que ejecuta el cliente
+func LocalAuth() (*srv.LocalSession, error) {
+	url := fmt.Sprintf("%s/local/session", apiURL())
+	r, err := http.NewRequest("POST", url, nil)
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, connectionError(err)
+	}
+	if resp.Status != STATUS_OK {
+		return nil, responseError(resp, "No se pudo iniciar sesión por el socket local")
+	}
+	session := new(srv.LocalSession)
+	err = json.NewDecoder(resp.Body).Decode(session)
+	return session, err
+}
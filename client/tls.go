@@ -0,0 +1,125 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+/*
+
+	Verificación del certificado del servidor
+
+	Con HTTPS el cliente verifica el certificado del servidor contra las CA
+	del sistema y, si se indica, contra las de un fichero PEM adicional. Para
+	servidores con un certificado autofirmado se puede fijar en su lugar la
+	huella SHA-256 del certificado; entonces solo se acepta ese certificado.
+
+*/
+
+// Fichero PEM con CA adicionales en las que confía el cliente
+var CAFile = ""
+
+// Huella SHA-256 del certificado del servidor en hexadecimal, con o sin ':'
+var ServerFingerprint = ""
+
+type fingerprintError struct {
+	got string
+}
+
+func (e *fingerprintError) Error() string {
+	return "la huella del certificado del servidor no coincide con la configurada. El servidor presenta " + e.got
+}
+
+func formatFingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// Admite la huella tal y como la muestra openssl x509 -fingerprint -sha256
+func parseFingerprint(text string) ([]byte, error) {
+	if i := strings.Index(text, "="); i >= 0 {
+		text = text[i+1:]
+	}
+	text = strings.ReplaceAll(strings.TrimSpace(text), ":", "")
+	pin, err := hex.DecodeString(text)
+	if err != nil || len(pin) != sha256.Size {
+		return nil, errors.New("la huella del certificado debe ser un SHA-256 en hexadecimal")
+	}
+	return pin, nil
+}
+
+// Prepara el cliente HTTP con la verificación de certificados configurada
+func configureTLS() error {
+	if CAFile == "" && ServerFingerprint == "" {
+		return nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if CAFile != "" {
+		pem, err := ioutil.ReadFile(CAFile)
+		if err != nil {
+			return fmt.Errorf("No se pudo leer el fichero de CA: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("El fichero %s no contiene certificados PEM", CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if ServerFingerprint != "" {
+		pin, err := parseFingerprint(ServerFingerprint)
+		if err != nil {
+			return err
+		}
+		// la cadena no se verifica, solo se acepta el certificado fijado
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return &fingerprintError{"ningún certificado"}
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(sum[:], pin) {
+				return &fingerprintError{formatFingerprint(sum[:])}
+			}
+			return nil
+		}
+	}
+
+	clientTransport().TLSClientConfig = config
+	return nil
+}
+
+// Explica el fallo si err es un error de TLS. Si no lo es retorna ""
+func tlsErrorReason(err error) string {
+	var pinErr *fingerprintError
+	var authErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &pinErr) {
+		return pinErr.Error()
+	} else if errors.As(err, &authErr) {
+		return "el certificado del servidor no está firmado por una CA de confianza. Indique la CA con client.ca_file o fije su huella con client.fingerprint"
+	} else if errors.As(err, &hostErr) {
+		return "el certificado del servidor no es válido para " + hostErr.Host
+	} else if errors.As(err, &invalidErr) {
+		return "el certificado del servidor no es válido: " + invalidErr.Error()
+	} else if errors.As(err, &recordErr) {
+		return "el servidor no usa HTTPS, pruebe con una URL http://"
+	}
+	return ""
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Certificado autofirmado válido para 127.0.0.1, que hace también de CA
+func selfSignedCert(t *testing.T) (tls.Certificate, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "gbb test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, der
+}
+
+func writePEM(t *testing.T, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func fingerprintOf(der []byte) string {
+	sum := sha256.Sum256(der)
+	return formatFingerprint(sum[:])
+}
+
+// Arranca un servidor HTTPS con el certificado y deja el cliente sin
+// configuración TLS al terminar la prueba
+func startTLSServer(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ts.StartTLS()
+	t.Cleanup(func() {
+		ts.Close()
+		CAFile, ServerFingerprint = "", ""
+		client.Transport = nil
+	})
+	return ts.URL
+}
+
+// Configura el cliente y pide la URL
+func fetchWith(t *testing.T, url string, caFile string, fingerprint string) error {
+	t.Helper()
+	CAFile, ServerFingerprint = caFile, fingerprint
+	client.Transport = nil
+	err := configureTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(url)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func TestTLSCAFile(t *testing.T) {
+	cert, der := selfSignedCert(t)
+	_, otherDer := selfSignedCert(t)
+	url := startTLSServer(t, cert)
+
+	if err := fetchWith(t, url, writePEM(t, der), ""); err != nil {
+		t.Fatalf("no se acepta el certificado firmado por la CA del fichero: %s", err)
+	}
+	err := fetchWith(t, url, writePEM(t, otherDer), "")
+	if err == nil {
+		t.Fatal("se acepta un certificado de una CA que no es la del fichero")
+	}
+	if tlsErrorReason(err) == "" {
+		t.Fatalf("el error no se reconoce como de TLS: %s", err)
+	}
+}
+
+func TestTLSFingerprint(t *testing.T) {
+	cert, der := selfSignedCert(t)
+	_, otherDer := selfSignedCert(t)
+	url := startTLSServer(t, cert)
+
+	if err := fetchWith(t, url, "", fingerprintOf(der)); err != nil {
+		t.Fatalf("no se acepta el certificado con la huella fijada: %s", err)
+	}
+	err := fetchWith(t, url, "", fingerprintOf(otherDer))
+	var pinErr *fingerprintError
+	if !errors.As(err, &pinErr) {
+		t.Fatalf("se esperaba un error de huella y se obtuvo: %v", err)
+	}
+	if pinErr.got != fingerprintOf(der) {
+		t.Fatalf("el error muestra la huella %s en lugar de la del servidor", pinErr.got)
+	}
+}
+
+func TestTLSUntrustedWithoutConfig(t *testing.T) {
+	cert, _ := selfSignedCert(t)
+	url := startTLSServer(t, cert)
+
+	err := fetchWith(t, url, "", "")
+	if err == nil {
+		t.Fatal("se acepta un certificado autofirmado sin CA ni huella configuradas")
+	}
+}
+
+func TestParseFingerprint(t *testing.T) {
+	_, der := selfSignedCert(t)
+	sum := sha256.Sum256(der)
+	for _, text := range []string{fingerprintOf(der), "SHA256 Fingerprint=" + fingerprintOf(der)} {
+		pin, err := parseFingerprint(text)
+		if err != nil || string(pin) != string(sum[:]) {
+			t.Fatalf("no se lee la huella %q: %v", text, err)
+		}
+	}
+	if _, err := parseFingerprint("AB:CD"); err == nil {
+		t.Fatal("se acepta una huella demasiado corta")
+	}
+}
@@ -0,0 +1,202 @@
+package client
+
+import (
+	"fmt"
+	"gbb/srv"
+
+	"github.com/gdamore/tcell"
+)
+
+/*
+
+	Menú de administración
+
+	Desde el tablón o desde un hilo quien puede reestructurar el hilo abre
+	con 'm' un menú con las operaciones de reestructuración. Las operaciones
+	que necesitan otro hilo (fusionar y mover) usan como destino el hilo
+	marcado previamente desde el menú del tablón.
+
+*/
+
+type adminOption struct {
+	key  rune
+	text string
+}
+
+var boardAdminOptions = []adminOption{
+	{'t', "Renombrar el hilo"},
+	{'g', "Cambiar la categoría del hilo"},
+	{'k', "Marcar el hilo como destino"},
+	{'u', "Unir este hilo al hilo marcado"},
+}
+
+var threadAdminOptions = []adminOption{
+	{'t', "Renombrar el hilo"},
+	{'g', "Cambiar la categoría del hilo"},
+	{'v', "Mover el mensaje seleccionado al hilo marcado"},
+	{'s', "Dividir el hilo desde el mensaje seleccionado"},
+}
+
+// Id del hilo marcado como destino
+var markedThreadId string
+
+// Operación del menú que espera un texto en MODE_ADMIN_INPUT
+var adminAction rune
+
+func openAdminMenu() {
+	previous := lastActiveMode
+	lastActiveMode = activeMode
+	if !clientUser.Can(srv.PERM_RESTRUCTURE, adminSelectedThread().Category) {
+		lastActiveMode = previous
+		setWarningMessage("No tiene permiso para reestructurar este hilo")
+		return
+	}
+	activeMode = MODE_ADMIN_MENU
+}
+
+func adminOptions() []adminOption {
+	if lastActiveMode == MODE_THREAD {
+		return threadAdminOptions
+	}
+	return boardAdminOptions
+}
+
+// Hilo sobre el que actúa el menú: el seleccionado en el tablón o el abierto
+func adminSelectedThread() *srv.Thread {
+	if lastActiveMode == MODE_THREAD {
+		return activeThread
+	}
+	return clientboard.Threads[boardPanel.GetThreadSelectedIndex()]
+}
+
+// Dibuja el menú centrado sobre el panel activo
+func AdminMenuPanel(scr tcell.Screen) {
+	w, h := scr.Size()
+	options := adminOptions()
+	width := 56
+	height := len(options) + 6
+	x1 := (w - width) / 2
+	y1 := (h - height) / 2
+	menu := NewPanel(scr, x1, y1, x1+width, y1+height)
+	menu.Draw()
+
+	drawText(scr, x1+2, y1+1, x1+width-2, y1+1, DefaultStyle.Bold(true), "Administración")
+	for i, opt := range options {
+		drawText(scr, x1+2, y1+3+i, x1+width-2, y1+3+i, DefaultStyle, fmt.Sprintf("%c  -  %s", opt.key, opt.text))
+	}
+
+	marked := "Ninguno"
+	if th := getThread(markedThreadId); th != nil {
+		marked = th.Title
+	}
+	drawText(scr, x1+2, y1+height-1, x1+width-2, y1+height-1, DefaultStyle.Dim(true), "Destino: "+marked)
+}
+
+// Línea superior donde el administrador escribe el texto de una operación
+func AdminInputPanel(scr tcell.Screen) {
+	w, _ := scr.Size()
+	for col := 1; col < w; col++ {
+		scr.SetContent(col, 0, ' ', nil, DefaultStyle)
+	}
+	prompt := "Nuevo título:"
+	if adminAction == 'g' {
+		prompt = "Categoría:"
+	}
+	drawText(scr, 1, 0, 14, 0, DefaultStyle, prompt)
+	drawText(scr, 15, 0, w, 0, DefaultStyle, messageBuffer.Msg)
+
+	scr.ShowCursor(messageBuffer.Cursor, 0)
+}
+
+// Ejecuta la opción del menú asociada a la tecla pulsada
+func runAdminMenuOption(s tcell.Screen, key rune) {
+	valid := false
+	for _, opt := range adminOptions() {
+		if opt.key == key {
+			valid = true
+		}
+	}
+	if !valid {
+		return
+	}
+
+	thread := adminSelectedThread()
+	switch key {
+	case 't', 's', 'g':
+		adminAction = key
+		activeMode = MODE_ADMIN_INPUT
+		messageBuffer = NewMessageBuffer(s, 14)
+		if key == 'g' {
+			messageBuffer.Msg = thread.Category
+			messageBuffer.Cursor += len(thread.Category)
+		}
+		return
+
+	case 'k':
+		markedThreadId = thread.Id
+		setWarningMessage("Hilo marcado como destino")
+
+	case 'u':
+		dst := getThread(markedThreadId)
+		if dst == nil {
+			setWarningMessage("Primero debe marcar un hilo como destino")
+		} else if err := MergeThreads(dst, thread); err != nil {
+			setWarningMessage(fmt.Sprintf("Error: %s", err))
+			logError(err.Error(), "runAdminMenuOption")
+		} else {
+			setWarningMessage("Hilos fusionados")
+		}
+
+	case 'v':
+		dst := getThread(markedThreadId)
+		if dst == nil {
+			setWarningMessage("Primero debe marcar un hilo como destino")
+		} else if err := MoveMessage(threadPanel.GetSelectedMessage(), dst); err != nil {
+			setWarningMessage(fmt.Sprintf("Error: %s", err))
+			logError(err.Error(), "runAdminMenuOption")
+		} else {
+			setWarningMessage("Mensaje movido")
+		}
+	}
+
+	activeMode = MODE_BOARD
+	clientboard = FetchBoard()
+	refreshPanels(s, true)
+}
+
+// Ejecuta la operación pendiente con el texto introducido
+func runAdminInput(s tcell.Screen) {
+	thread := adminSelectedThread()
+	text := messageBuffer.Msg
+	var err error
+
+	switch adminAction {
+	case 't':
+		err = RenameThread(thread, text)
+	case 's':
+		err = SplitThread(thread, threadPanel.GetSelectedMessage(), text)
+	case 'g':
+		err = SetThreadCategory(thread, text)
+	}
+	if field := invalidField(err); field == "title" || field == "category" {
+		// se sigue editando el texto para corregirlo
+		setWarningMessage(fmt.Sprintf("Error: %s", err))
+		return
+	}
+	if err != nil {
+		setWarningMessage(fmt.Sprintf("Error: %s", err))
+		logError(err.Error(), "runAdminInput")
+	}
+
+	clientboard = FetchBoard()
+	activeMode = MODE_BOARD
+	if (adminAction == 't' || adminAction == 'g') && lastActiveMode == MODE_THREAD {
+		// tras renombrar o cambiar la categoría seguimos en el mismo hilo
+		if th := FetchThread(thread.Id); th != nil {
+			activeThread = th
+			activeMode = MODE_THREAD
+		}
+	}
+	adminAction = 0
+	refreshPanels(s, true)
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"fmt"
+	"gbb/srv"
+
+	"github.com/gdamore/tcell"
+)
+
+/*
+
+	Anuncios
+
+	Al arrancar, antes de mostrar el tablón, se muestran uno a uno los hilos
+	fijados como anuncio que el usuario no ha confirmado. 'Intro' confirma
+	el anuncio y ya no se vuelve a mostrar; ESC los deja para el próximo
+	arranque del cliente.
+
+*/
+
+var announcements []*srv.Thread
+
+// Los anuncios se muestran solo una vez por ejecución del cliente
+var announcementsShown bool
+
+func openAnnouncements() {
+	if announcementsShown {
+		return
+	}
+	announcementsShown = true
+	list, err := FetchAnnouncements()
+	if err != nil {
+		logError(err.Error(), "openAnnouncements")
+		return
+	}
+	if len(list) == 0 {
+		return
+	}
+	announcements = list
+	activeMode = MODE_ANNOUNCEMENT
+}
+
+func AnnouncementPanel(scr tcell.Screen) {
+	w, h := scr.Size()
+	if len(announcements) == 0 {
+		return
+	}
+	th := announcements[0]
+	NewPanel(scr, 0, 1, w, h-1).Draw()
+
+	header := "Anuncio"
+	if len(announcements) > 1 {
+		header += fmt.Sprintf(" (quedan %d más)", len(announcements)-1)
+	}
+	drawText(scr, 2, 2, w-1, 2, DefaultStyle.Bold(true), header)
+	drawText(scr, 2, 3, w-1, 3, DefaultStyle, "Intro: entendido   ESC: recordar en el próximo arranque")
+	drawText(scr, 2, 5, w-1, 5, DefaultStyle.Bold(true), th.Title)
+	if len(th.Messages) == 0 {
+		return
+	}
+	m := th.Messages[0]
+	drawText(scr, 2, 6, w-1, 6, DefaultStyle, fmt.Sprintf("%s, %s", m.Author, m.Stamp.Local().Format(srv.DATE_FORMAT)))
+	line := 8
+	for _, l := range srv.SplitStringInLines(m.Text+"\n", w-4) {
+		if line > h-3 {
+			break
+		}
+		drawText(scr, 2, line, w-1, line, DefaultStyle, l)
+		line++
+	}
+}
+
+// Confirma el anuncio que se está mostrando y pasa al siguiente
+func ackCurrentAnnouncement() {
+	if len(announcements) == 0 {
+		activeMode = MODE_BOARD
+		return
+	}
+	err := AckAnnouncement(announcements[0])
+	if err != nil {
+		setWarningMessage(fmt.Sprintf("Error: %s", err))
+		logError(err.Error(), "ackCurrentAnnouncement")
+	}
+	announcements = announcements[1:]
+	if len(announcements) == 0 {
+		activeMode = MODE_BOARD
+	}
+}
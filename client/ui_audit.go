@@ -0,0 +1,171 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"gbb/srv"
+	"strings"
+
+	"github.com/gdamore/tcell"
+)
+
+/*
+
+	Registro de auditoría
+
+	Desde el tablón un administrador puede abrir con 'l' el registro de
+	auditoría del servidor. La parte superior lista los registros, del más
+	reciente al más antiguo, y la inferior muestra los valores anterior y
+	nuevo del registro seleccionado. Con 'b' se escribe un filtro de la forma:
+
+		actor:login accion:nombre desde:AAAA-MM-DD hasta:AAAA-MM-DD
+
+*/
+
+// Líneas reservadas para el detalle del registro seleccionado
+const AUDIT_DETAIL_LINES = 8
+
+// Registros que avanzan AvPg y RePg
+const AUDIT_PAGE_LINES = 10
+
+var auditRecords []*srv.AuditRecord
+var auditSelected int
+var auditFirstShowed int
+var auditFilter string
+
+func openAuditLog() {
+	if !clientUser.Can(srv.PERM_AUDIT, "") {
+		setWarningMessage("Operación solo para administradores")
+		return
+	}
+	err := loadAuditLog(auditFilter)
+	if err != nil {
+		setWarningMessage(fmt.Sprintf("Error: %s", err))
+		logError(err.Error(), "openAuditLog")
+		return
+	}
+	activeMode = MODE_AUDIT
+}
+
+// Carga desde el servidor los registros que cumplen el filtro
+func loadAuditLog(filterText string) error {
+	params := map[string]string{}
+	for _, field := range strings.Fields(filterText) {
+		kv := strings.SplitN(field, ":", 2)
+		if len(kv) != 2 {
+			return errors.New("Filtro incorrecto: " + field)
+		}
+		switch kv[0] {
+		case "actor", "accion", "desde", "hasta":
+			params[kv[0]] = kv[1]
+		default:
+			return errors.New("Campo de filtro desconocido: " + kv[0])
+		}
+	}
+
+	records, err := FetchAudit(params["actor"], params["accion"], params["desde"], params["hasta"])
+	if err != nil {
+		return err
+	}
+	auditRecords = records
+	auditFilter = filterText
+	auditSelected = 0
+	auditFirstShowed = 0
+	return nil
+}
+
+func AuditPanel(scr tcell.Screen) {
+	w, h := scr.Size()
+	listBottom := h - AUDIT_DETAIL_LINES - 2
+	NewPanel(scr, 0, 1, w, listBottom).Draw()
+	NewPanel(scr, 0, listBottom, w, h-1).Draw()
+
+	title := fmt.Sprintf("Registro de auditoría (%d)", len(auditRecords))
+	if auditFilter != "" {
+		title += "  -  " + auditFilter
+	}
+	drawText(scr, 2, 2, w-1, 2, DefaultStyle.Bold(true), title)
+
+	// mantenemos el registro seleccionado dentro de la zona visible
+	visible := listBottom - 4
+	if auditSelected < auditFirstShowed {
+		auditFirstShowed = auditSelected
+	}
+	if visible > 0 && auditSelected >= auditFirstShowed+visible {
+		auditFirstShowed = auditSelected - visible + 1
+	}
+
+	line := 4
+	for i := auditFirstShowed; i < len(auditRecords) && line < listBottom; i++ {
+		rec := auditRecords[i]
+		style := DefaultStyle
+		if i == auditSelected {
+			style = style.Reverse(true)
+		}
+		target := rec.Thread
+		if rec.Message != 0 {
+			target += fmt.Sprintf(" #%d", rec.Message)
+		}
+		text := fmt.Sprintf("%s  %-12s %-18s %-24s %s",
+			rec.Stamp.Local().Format("2006-01-02 15:04:05"), rec.Actor, rec.Action, target, rec.Remote)
+		drawText(scr, 2, line, w-1, line, style, text)
+		line++
+	}
+
+	if auditSelected < len(auditRecords) {
+		rec := auditRecords[auditSelected]
+		line = listBottom + 1
+		line = drawAuditValue(scr, line, h-2, w, "Antes: ", rec.OldValue)
+		drawAuditValue(scr, line, h-2, w, "Después: ", rec.NewValue)
+	}
+}
+
+// Dibuja un valor del registro a partir de la línea y y retorna la siguiente
+// línea libre
+func drawAuditValue(scr tcell.Screen, y int, maxY int, w int, label string, value string) int {
+	if value == "" {
+		return y
+	}
+	// SplitStringInLines solo retorna la última línea si el texto acaba en
+	// salto de línea
+	text := label + strings.ReplaceAll(value, "\n", " ⏎ ") + "\n"
+	for _, l := range srv.SplitStringInLines(text, w-4) {
+		if y > maxY {
+			break
+		}
+		drawText(scr, 2, y, w-1, y, DefaultStyle, l)
+		y++
+	}
+	return y
+}
+
+func AuditFilterPanel(scr tcell.Screen) {
+	w, _ := scr.Size()
+	for col := 1; col < w; col++ {
+		scr.SetContent(col, 0, ' ', nil, DefaultStyle)
+	}
+	drawText(scr, 1, 0, 8, 0, DefaultStyle, "Filtro:")
+	drawText(scr, 9, 0, w, 0, DefaultStyle, messageBuffer.Msg)
+
+	scr.ShowCursor(messageBuffer.Cursor, 0)
+}
+
+func auditMoveCursor(delta int) {
+	auditSelected += delta
+	if auditSelected >= len(auditRecords) {
+		auditSelected = len(auditRecords) - 1
+	}
+	if auditSelected < 0 {
+		auditSelected = 0
+	}
+}
+
+// Aplica el filtro escrito por el administrador
+func runAuditFilter() {
+	err := loadAuditLog(messageBuffer.Msg)
+	if err != nil {
+		setWarningMessage(fmt.Sprintf("Error: %s", err))
+		logError(err.Error(), "runAuditFilter")
+	}
+	activeMode = MODE_AUDIT
+}
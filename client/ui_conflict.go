@@ -0,0 +1,111 @@
+package client
+
+import (
+	"fmt"
+	"gbb/srv"
+
+	"github.com/gdamore/tcell"
+)
+
+/*
+
+	Conflictos de edición
+
+	Si al guardar la edición de un mensaje otro usuario lo ha modificado
+	mientras tanto, el servidor la rechaza y retorna la versión actual. Se
+	muestra entonces el texto editado y con 'v' se alterna con la versión
+	actual. 'm' abre el editor con ambas versiones para mezclarlas a mano,
+	's' sobrescribe la versión actual con la editada y ESC descarta la
+	edición, que se conserva para volver a editar el mensaje.
+
+*/
+
+// Conflicto pendiente y la edición que lo provocó
+var editConflict *srv.EditConflict
+var conflictEdit *srv.Message
+var conflictShowCurrent bool
+
+func openConflict(edit *srv.Message, conflict *srv.EditConflict) {
+	mine := *edit
+	conflictEdit = &mine
+	editConflict = conflict
+	conflictShowCurrent = false
+}
+
+func closeConflict() {
+	editConflict = nil
+	conflictEdit = nil
+	activeMode = MODE_BOARD
+	clientboard = FetchBoard()
+}
+
+func ConflictPanel(scr tcell.Screen) {
+	w, h := scr.Size()
+	NewPanel(scr, 0, 1, w, h-1).Draw()
+
+	current := editConflict.Current
+	drawText(scr, 2, 2, w-1, 2, DefaultStyle.Bold(true),
+		fmt.Sprintf("El mensaje [%d] ha sido modificado mientras lo editaba", current.Id))
+	drawText(scr, 2, 3, w-1, 3, DefaultStyle,
+		"v: ver la otra versión   m: mezclar en el editor   s: sobrescribir   ESC: descartar")
+
+	title, text := "Su versión", conflictEdit.Text
+	if conflictShowCurrent {
+		title, text = fmt.Sprintf("Versión actual (%d)", current.Version), current.Text
+	}
+	drawText(scr, 2, 5, w-1, 5, DefaultStyle.Underline(true), title)
+	line := 7
+	for _, l := range srv.SplitStringInLines(text+"\n", w-4) {
+		if line >= h-2 {
+			break
+		}
+		drawText(scr, 2, line, w-1, line, DefaultStyle, l)
+		line++
+	}
+}
+
+// Texto con las dos versiones que se abre en el editor para mezclarlas
+func conflictMergeText() string {
+	return fmt.Sprintf("<<<<<<< su versión\n%s\n=======\n%s\n>>>>>>> versión actual (%d)\n",
+		conflictEdit.Text, editConflict.Current.Text, editConflict.Current.Version)
+}
+
+// Ejecuta la opción elegida. Retorna true si hay que abrir el editor
+func runConflictOption(key rune) bool {
+	switch key {
+	case 'v':
+		conflictShowCurrent = !conflictShowCurrent
+
+	case 'm':
+		merged := *editConflict.Current
+		newMessage = &merged
+		newMessageInitialText = conflictMergeText()
+		editConflict = nil
+		conflictEdit = nil
+		return true
+
+	case 's':
+		conflictEdit.Version = editConflict.Current.Version
+		err := UpdateContentMessage(conflictEdit)
+		if conflict, ok := err.(*srv.EditConflict); ok {
+			openConflict(conflictEdit, conflict)
+			setWarningMessage("El mensaje ha vuelto a cambiar. Revise la nueva versión")
+			return false
+		}
+		if err != nil {
+			setWarningMessage(fmt.Sprintf("Error: %s", err))
+			logError(err.Error(), "runConflictOption")
+		} else {
+			setWarningMessage("Mensaje sobrescrito")
+		}
+		closeConflict()
+	}
+	return false
+}
+
+// Descarta la edición. Su texto se recupera al volver a editar el mensaje
+func discardConflict() {
+	messageDraft, messageDraftId = conflictEdit.Text, conflictEdit.Id
+	closeConflict()
+	setWarningMessage("Edición descartada. El texto se recupera al volver a editar el mensaje")
+}
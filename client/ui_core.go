@@ -31,8 +31,13 @@ func runUI() {
 */
 
 func editorRoutine(c chan int) {
-	update := (len(newMessageInitialText) != 0)
-	err, content := InputMessageFromEditor(newMessageInitialText)
+	update := newMessage.Id != 0
+	initialText := newMessageInitialText
+	if messageDraft != "" && messageDraftId == newMessage.Id {
+		initialText = messageDraft
+	}
+	messageDraft = ""
+	err, content := InputMessageFromEditor(initialText)
 	newMessageInitialText = ""
 	if err == nil {
 		newMessage.Text = content
@@ -43,11 +48,19 @@ func editorRoutine(c chan int) {
 				err = UpdateContentMessage(newMessage)
 			}
 		}
-		newMessage = nil
-		if err != nil {
+		if conflict, ok := err.(*srv.EditConflict); ok {
+			openConflict(newMessage, conflict)
+		} else if invalidField(err) == "text" {
+			// se guarda para no perderlo al volver a abrir el editor
+			messageDraft, messageDraftId = content, newMessage.Id
+			setWarningMessage(fmt.Sprintf("Error: %s. Se conserva el texto", err))
+		} else if err != nil {
 			setWarningMessage("Error:" + fmt.Sprintf("%s", err))
 			logError(fmt.Sprintf("%s", err), "editorRoutine")
+		} else if newMessage.Held || (activeThread != nil && activeThread.Held) {
+			setWarningMessage("Publicado, pero pendiente de moderación hasta que lo revise un moderador")
 		}
+		newMessage = nil
 	}
 	c <- 1
 }
@@ -73,9 +86,16 @@ func UIRoutine(uic chan int) {
 	s.Clear()
 
 	activeMode = MODE_BOARD
+	if editConflict != nil {
+		activeMode = MODE_CONFLICT
+	}
 	confirmDelete = false
 
 	boardPanel = CreateBoardPanel(s, clientboard)
+	notifyResolvedReports()
+	if activeMode == MODE_BOARD {
+		openAnnouncements()
+	}
 	refreshPanels(s, true)
 
 	for !exit {
@@ -96,6 +116,9 @@ func UIRoutine(uic chan int) {
 			if ev.Rune() != 'd' {
 				confirmDelete = false
 			}
+			if ev.Rune() != 'x' {
+				confirmLogout = false
+			}
 
 			/*
 				'ESC' key commands:
@@ -117,6 +140,22 @@ func UIRoutine(uic chan int) {
 					activeMode = lastActiveMode
 				} else if activeMode == MODE_INPUT_THREAD || activeMode == MODE_SEARCH_THREAD {
 					activeMode = MODE_BOARD
+				} else if activeMode == MODE_ADMIN_MENU || activeMode == MODE_ADMIN_INPUT {
+					activeMode = lastActiveMode
+				} else if activeMode == MODE_AUDIT {
+					activeMode = MODE_BOARD
+				} else if activeMode == MODE_AUDIT_FILTER {
+					activeMode = MODE_AUDIT
+				} else if activeMode == MODE_SESSIONS {
+					activeMode = MODE_BOARD
+				} else if activeMode == MODE_CONFLICT {
+					discardConflict()
+				} else if activeMode == MODE_REPORT_INPUT {
+					activeMode = MODE_THREAD
+				} else if activeMode == MODE_REPORTS {
+					activeMode = MODE_BOARD
+				} else if activeMode == MODE_ANNOUNCEMENT {
+					activeMode = MODE_BOARD
 				}
 
 			} else if ev.Key() == tcell.KeyDown {
@@ -126,6 +165,15 @@ func UIRoutine(uic chan int) {
 				if activeMode == MODE_THREAD {
 					threadPanel.DownCursor()
 				}
+				if activeMode == MODE_AUDIT {
+					auditMoveCursor(1)
+				}
+				if activeMode == MODE_SESSIONS {
+					sessionMoveCursor(1)
+				}
+				if activeMode == MODE_REPORTS {
+					reportMoveCursor(1)
+				}
 			} else if ev.Key() == tcell.KeyUp {
 				if activeMode == MODE_BOARD {
 					boardPanel.UpCursor()
@@ -133,6 +181,23 @@ func UIRoutine(uic chan int) {
 				if activeMode == MODE_THREAD {
 					threadPanel.UpCursor()
 				}
+				if activeMode == MODE_AUDIT {
+					auditMoveCursor(-1)
+				}
+				if activeMode == MODE_SESSIONS {
+					sessionMoveCursor(-1)
+				}
+				if activeMode == MODE_REPORTS {
+					reportMoveCursor(-1)
+				}
+			} else if ev.Key() == tcell.KeyLeft {
+				if activeMode == MODE_THREAD {
+					threadPanel.GoToParent()
+				}
+			} else if ev.Key() == tcell.KeyRight {
+				if activeMode == MODE_THREAD {
+					threadPanel.GoToFirstChild()
+				}
 
 				/*
 					'Enter' key commands:
@@ -159,9 +224,12 @@ func UIRoutine(uic chan int) {
 					content := ""
 					newMessage = srv.NewMessage(Username, content)
 					activeThread, err = CreateThread(title)
-					if err != nil {
+					if invalidField(err) == "title" {
+						// se sigue editando el título para corregirlo
+						setWarningMessage(fmt.Sprintf("Error: %s", err))
+					} else if err != nil {
 						activeMode = MODE_BOARD
-						setWarningMessage("Error: No se ha podido crear el thread")
+						setWarningMessage(fmt.Sprintf("Error: No se ha podido crear el thread. %s", err))
 						logError("activeThread is nil before CreateThread. "+err.Error(), "uiRoutine")
 					} else {
 						exit = true // exit to run the editor and write the first message of the thread
@@ -178,16 +246,34 @@ func UIRoutine(uic chan int) {
 
 					activeMode = MODE_BOARD
 					refreshPanels(s, true)
+
+				} else if activeMode == MODE_ADMIN_INPUT {
+					runAdminInput(s)
+
+				} else if activeMode == MODE_AUDIT_FILTER {
+					runAuditFilter()
+
+				} else if activeMode == MODE_REPORT_INPUT {
+					runReport()
+
+				} else if activeMode == MODE_ANNOUNCEMENT {
+					ackCurrentAnnouncement()
 				}
 
 			} else if ev.Key() == tcell.KeyPgUp {
 				if activeMode == MODE_THREAD {
 					threadPanel.UpPage()
 				}
+				if activeMode == MODE_AUDIT {
+					auditMoveCursor(-AUDIT_PAGE_LINES)
+				}
 			} else if ev.Key() == tcell.KeyPgDn {
 				if activeMode == MODE_THREAD {
 					threadPanel.DownPage()
 				}
+				if activeMode == MODE_AUDIT {
+					auditMoveCursor(AUDIT_PAGE_LINES)
+				}
 			} else if ev.Key() == tcell.KeyDEL {
 				messageBuffer.DelRuneFromBuffer()
 
@@ -195,7 +281,71 @@ func UIRoutine(uic chan int) {
 				/*
 					Delete a full thread
 				*/
-				if activeMode == MODE_BOARD && ev.Rune() == 'd' {
+				if activeMode == MODE_ADMIN_MENU {
+					runAdminMenuOption(s, ev.Rune())
+
+				} else if activeMode == MODE_CONFLICT {
+					exit = runConflictOption(ev.Rune())
+
+				} else if activeMode == MODE_REPORTS {
+					runReportOption(ev.Rune())
+
+				} else if activeMode == MODE_BOARD && ev.Rune() == 'l' {
+					/*
+						Audit log
+					*/
+					openAuditLog()
+
+				} else if activeMode == MODE_BOARD && ev.Rune() == 'q' {
+					/*
+						Moderation queue
+					*/
+					openReports()
+
+				} else if activeMode == MODE_THREAD && ev.Rune() == '!' {
+					/*
+						Report the selected message
+					*/
+					startReport(s)
+
+				} else if activeMode == MODE_BOARD && ev.Rune() == 's' {
+					/*
+						Open sessions
+					*/
+					openSessions()
+
+				} else if activeMode == MODE_SESSIONS && ev.Rune() == 'd' {
+					if !confirmDelete {
+						setWarningMessage("¿Desea revocar la sesión? Pulse 'd' para confirmar o ESC para cancelar")
+						confirmDelete = true
+					} else {
+						revokeSelectedSession()
+						confirmDelete = false
+					}
+
+				} else if activeMode == MODE_BOARD && ev.Rune() == 'x' {
+					/*
+						Logout
+					*/
+					if !confirmLogout {
+						setWarningMessage("¿Desea cerrar la sesión? Pulse 'x' para confirmar o ESC para cancelar")
+						confirmLogout = true
+					} else {
+						logout(s)
+						confirmLogout = false
+					}
+
+				} else if activeMode == MODE_AUDIT && ev.Rune() == 'b' {
+					activeMode = MODE_AUDIT_FILTER
+					messageBuffer = NewMessageBuffer(s, 8)
+
+				} else if (activeMode == MODE_BOARD || activeMode == MODE_THREAD) && ev.Rune() == 'm' {
+					/*
+						Admin menu
+					*/
+					openAdminMenu()
+
+				} else if activeMode == MODE_BOARD && ev.Rune() == 'd' {
 					if !confirmDelete {
 						setWarningMessage("¿Desea borrar el hilo? Pulse 'd' para confirmar o ESC para cancelar")
 						confirmDelete = true
@@ -222,10 +372,10 @@ func UIRoutine(uic chan int) {
 						confirmDelete = true
 					} else {
 						thread := clientboard.Threads[boardPanel.GetThreadSelectedIndex()]
-						deleteMsg := thread.Messages[threadPanel.MessageSelected]
-						log.Println(deleteMsg.Id)
-						err := DeleteMessage(deleteMsg, thread.Id)
-						if err != nil {
+						deleteMsg := threadPanel.GetSelectedMessage()
+						if deleteMsg == nil {
+							setWarningMessage("No hay ningún mensaje seleccionado")
+						} else if err := DeleteMessage(deleteMsg, thread.Id); err != nil {
 							setWarningMessage(fmt.Sprintf("Error: %s", err))
 							logError("DeleteMessage return an error. "+err.Error(), "uiRoutine")
 						} else {
@@ -262,6 +412,62 @@ func UIRoutine(uic chan int) {
 						exit = true // exit to run the editor and write the first message of the thread
 					}
 
+				} else if activeMode == MODE_THREAD && ev.Rune() == 'r' {
+					/*
+						Reply to the selected message
+					*/
+					thread := clientboard.Threads[boardPanel.GetThreadSelectedIndex()]
+					if thread.IsClosed {
+						setWarningMessage("El hilo está cerrado y no admite cambios")
+					} else if selected := threadPanel.GetSelectedMessage(); selected == nil {
+						setWarningMessage("No hay ningún mensaje seleccionado")
+					} else {
+						newMessage = srv.NewMessage(Username, "")
+						newMessage.ReplyTo = selected.Id
+						exit = true // exit to run the editor and write the reply
+					}
+
+				} else if activeMode == MODE_THREAD && ev.Rune() == 't' {
+					/*
+						Switch between chronological and tree view
+					*/
+					threadPanel.ToggleTreeMode()
+
+				} else if activeMode == MODE_THREAD && ev.Rune() == ' ' {
+					threadPanel.ToggleCollapse()
+
+				} else if activeMode == MODE_THREAD && ev.Rune() == 'n' {
+					threadPanel.GoToSibling(1)
+
+				} else if activeMode == MODE_THREAD && ev.Rune() == 'p' {
+					threadPanel.GoToSibling(-1)
+
+				} else if activeMode == MODE_THREAD && (ev.Rune() == '<' || ev.Rune() == '>') {
+					/*
+						Scroll the code blocks of the selected message
+					*/
+					mp := threadPanel.Messages[threadPanel.MessageSelected]
+					if ev.Rune() == '<' {
+						mp.ScrollCode(-CODE_SCROLL_STEP)
+					} else {
+						mp.ScrollCode(CODE_SCROLL_STEP)
+					}
+
+				} else if activeMode == MODE_THREAD && ev.Rune() == 'y' {
+					/*
+						Copy a code block of the selected message
+					*/
+					mp := threadPanel.Messages[threadPanel.MessageSelected]
+					n, total, err := mp.CopyCodeBlock()
+					if err != nil {
+						setWarningMessage("Error: No se pudo copiar el bloque de código")
+						logError(err.Error(), "uiRoutine")
+					} else if total == 0 {
+						setWarningMessage("El mensaje no tiene bloques de código")
+					} else {
+						setWarningMessage(fmt.Sprintf("Copiado el bloque de código %d de %d", n, total))
+					}
+
 				} else if activeMode == MODE_BOARD && ev.Rune() == 'b' {
 					/*
 						Search a thread
@@ -276,9 +482,11 @@ func UIRoutine(uic chan int) {
 					thread := clientboard.Threads[boardPanel.GetThreadSelectedIndex()]
 					if thread.IsClosed {
 						setWarningMessage("El hilo está cerrado y no admite cambios")
+					} else if threadPanel.GetSelectedMessage() == nil {
+						setWarningMessage("No hay ningún mensaje seleccionado")
 					} else {
-						newMessage = thread.Messages[threadPanel.MessageSelected]
-						if (newMessage.Author == clientUser.Login) || clientUser.IsAdmin {
+						newMessage = threadPanel.GetSelectedMessage()
+						if (newMessage.Author == clientUser.Login) || clientUser.Can(srv.PERM_EDIT_ANY, thread.Category) {
 							newMessageInitialText = newMessage.Text
 							exit = true // exit to run the editor and write the first message of the thread
 						} else {
@@ -289,7 +497,7 @@ func UIRoutine(uic chan int) {
 					/*
 						Show help window
 					*/
-				} else if activeMode != MODE_INPUT_THREAD && ev.Rune() == '?' {
+				} else if activeMode != MODE_INPUT_THREAD && activeMode != MODE_ADMIN_INPUT && activeMode != MODE_AUDIT_FILTER && activeMode != MODE_REPORT_INPUT && ev.Rune() == '?' {
 					lastActiveMode = activeMode
 					activeMode = MODE_HELP
 
@@ -304,7 +512,7 @@ func UIRoutine(uic chan int) {
 						err = UpdateThreadStatus(thread, "fixed")
 					}
 					if err != nil {
-						setWarningMessage("Operación no permitida")
+						setWarningMessage(fmt.Sprintf("Error: %s", err))
 					} else {
 						thread.IsFixed = !thread.IsFixed
 						clientboard = FetchBoard()
@@ -322,7 +530,7 @@ func UIRoutine(uic chan int) {
 						err = UpdateThreadStatus(thread, "close")
 					}
 					if err != nil {
-						setWarningMessage("Operación no permitida")
+						setWarningMessage(fmt.Sprintf("Error: %s", err))
 					} else {
 						clientboard = FetchBoard()
 						refreshPanels(s, true)
@@ -331,7 +539,7 @@ func UIRoutine(uic chan int) {
 					/*
 						Writting in top buffer
 					*/
-				} else if activeMode == MODE_INPUT_THREAD || activeMode == MODE_SEARCH_THREAD {
+				} else if activeMode == MODE_INPUT_THREAD || activeMode == MODE_SEARCH_THREAD || activeMode == MODE_ADMIN_INPUT || activeMode == MODE_AUDIT_FILTER || activeMode == MODE_REPORT_INPUT {
 					messageBuffer.AddRuneToBuffer(ev.Rune())
 				}
 			}
@@ -20,15 +20,28 @@ const HELP_TEXT = `
 	a      -    Añade un hilo o un mensaje
 	d      -    Borrar un hilo o un mensaje
 	e      -    Editar un mensaje
-	r      -    Recarga los mensajes
+	r      -    Recarga los mensajes o responde al mensaje seleccionado
+	t      -    Cambiar entre vista cronológica y vista en árbol de un hilo
+	←→     -    En vista árbol: ir al mensaje respondido o a la primera respuesta
+	n p    -    En vista árbol: ir a la siguiente o anterior respuesta del mismo mensaje
+	Espacio -   En vista árbol: plegar o desplegar las respuestas de un mensaje
+	< >    -    Desplazar a izquierda o derecha los bloques de código de un mensaje
+	y      -    Copiar al portapapeles un bloque de código del mensaje
 	b      -    Buscar hilos por palabras clave
 	↑↓     -    Navegar entre hilos o mensajes
 	AvPg   - 	Avanzar página de un mensaje
 	RePg   -    Retroceder página de un mensaje
 	ESC    -    Ir a la ventana anterior
 	?      -    Mostrar este mensaje de ayuda
-	f      -    Fijar un hilo en la cabecera. Solo para administradores
-	c      -    Cerrar un hilo para nuevas respuestas. Solo para administradores
+	f      -    Fijar o soltar un hilo en la cabecera. Solo para moderadores
+	c      -    Cerrar un hilo para nuevas respuestas. Solo para moderadores
+	m      -    Menú de administración: renombrar, fusionar, dividir hilos, cambiar su categoría
+	            y mover mensajes
+	l      -    Registro de auditoría. Con 'b' se filtra por actor, accion, desde y hasta
+	s      -    Sesiones abiertas. Con 'd' se revoca la sesión seleccionada
+	!      -    Denunciar el mensaje seleccionado ante los moderadores
+	q      -    Cola de moderación con las denuncias abiertas. Solo para moderadores
+	x      -    Cerrar la sesión y salir
 
 
 
@@ -53,6 +66,15 @@ var uiChannel chan int
 var confirmDelete bool
 
 const (
+	MODE_ANNOUNCEMENT  = 13
+	MODE_REPORTS       = 12
+	MODE_REPORT_INPUT  = 11
+	MODE_CONFLICT      = 10
+	MODE_SESSIONS      = 9
+	MODE_AUDIT_FILTER  = 8
+	MODE_AUDIT         = 7
+	MODE_ADMIN_INPUT   = 6
+	MODE_ADMIN_MENU    = 5
 	MODE_SEARCH_THREAD = 4
 	MODE_HELP          = 3
 	MODE_INPUT_THREAD  = 2
@@ -67,6 +89,11 @@ var activeThread *srv.Thread
 var newMessage *srv.Message
 var newMessageInitialText string = ""
 
+// Texto que el servidor rechazó y el mensaje al que iba (0 si era nuevo). Se
+// carga en el editor la próxima vez que se escribe ese mensaje
+var messageDraft string
+var messageDraftId int
+
 func getThread(key string) *srv.Thread {
 	for _, th := range clientboard.Threads {
 		if th.Id == key {
@@ -279,6 +306,8 @@ func (bp *BoardPanel) Draw() {
 	col += 20
 	if clientUser.IsAdmin {
 		drawText(bp.Panel.screen, col, 0, col+20, 1, DefaultStyle, fmt.Sprintf("@%s [Admin]", Username))
+	} else if clientUser.CanSomewhere(srv.PERM_MODERATE) {
+		drawText(bp.Panel.screen, col, 0, col+20, 1, DefaultStyle, fmt.Sprintf("@%s [Moderador]", Username))
 	} else {
 		drawText(bp.Panel.screen, col, 0, col+20, 1, DefaultStyle, fmt.Sprintf("@%s", Username))
 	}
@@ -292,8 +321,9 @@ func (bp *BoardPanel) Draw() {
 			text := fmt.Sprintf("%s", bp.Board.Threads[i])
 			isSelected := line == bp.CursorLine
 			isFixed := bp.Board.Threads[i].IsFixed
+			isMarked := bp.Board.Threads[i].Id == markedThreadId
 
-			drawText(bp.Panel.screen, 1, line, bp.MaxCol, line, DefaultStyle.Reverse(isSelected).Bold(isFixed), text)
+			drawText(bp.Panel.screen, 1, line, bp.MaxCol, line, DefaultStyle.Reverse(isSelected).Bold(isFixed).Underline(isMarked), text)
 			line++
 		}
 	}
@@ -344,13 +374,15 @@ type ThreadPanel struct {
 	MaxLine         int
 	MinLine         int
 	MaxCol          int
+	TreeMode        bool
+	Collapsed       map[int]bool
+	nodes           []*replyNode
 }
 
 func CreateThreadPanel(scr tcell.Screen, thread *srv.Thread) *ThreadPanel {
 	tp := new(ThreadPanel)
 	w, h := scr.Size()
 	tp.Thread = thread
-	tp.Messages = make([]*MessagePanel, 0)
 	tp.Panel = NewPanel(scr, 0, 1, w, h-1)
 	tp.MaxLine = h - 2
 	tp.MinLine = 2
@@ -358,13 +390,60 @@ func CreateThreadPanel(scr tcell.Screen, thread *srv.Thread) *ThreadPanel {
 	tp.FirstLineShowed = 0
 	tp.MaxCol = w - 2
 	tp.MessageSelected = 0
+	tp.TreeMode = treeViewEnabled
+	tp.Collapsed = make(map[int]bool)
+	tp.buildMessagePanels()
+
+	return tp
+}
+
+// Crea los paneles de los mensajes en el orden en el que se muestran: el
+// cronológico o el del árbol de respuestas
+func (tp *ThreadPanel) buildMessagePanels() {
+	scr := tp.Panel.screen
+	tp.Messages = make([]*MessagePanel, 0)
+	tp.nodes = nil
 
-	for i, m := range tp.Thread.Messages {
-		mp := CreateMessagePanel(scr, m, tp, i)
+	if !tp.TreeMode {
+		for i, m := range tp.Thread.Messages {
+			mp := CreateMessagePanel(scr, m, tp, i, 0)
+			tp.Messages = append(tp.Messages, mp)
+		}
+		return
+	}
+
+	root := buildReplyTree(tp.Thread)
+	if root == nil {
+		return
+	}
+	tp.nodes = visibleNodes(root, tp.Collapsed)
+	for _, node := range tp.nodes {
+		mp := CreateMessagePanel(scr, node.Message, tp, node.Index, node.Depth)
+		if tp.Collapsed[node.Message.Id] {
+			mp.Lines[0].Runs[0].Text += fmt.Sprintf(" [+%d]", countDescendants(node))
+		}
 		tp.Messages = append(tp.Messages, mp)
 	}
+}
 
-	return tp
+// Retorna el mensaje seleccionado o nil si el hilo no tiene mensajes
+func (tp *ThreadPanel) GetSelectedMessage() *srv.Message {
+	if tp.MessageSelected < 0 || tp.MessageSelected >= len(tp.Messages) {
+		return nil
+	}
+	return tp.Messages[tp.MessageSelected].Message
+}
+
+func (tp *ThreadPanel) selectMessage(m *srv.Message) {
+	if m == nil {
+		return
+	}
+	for i, mp := range tp.Messages {
+		if mp.Message.Id == m.Id {
+			tp.MessageSelected = i
+			return
+		}
+	}
 }
 
 // Este método permite dibujar un thread completo en pantalla. El método barre el array de mensajes del hilo y
@@ -430,7 +509,8 @@ func (tp *ThreadPanel) DownPage() {
 	MessagePanel
 
 	Permite mostrar el contenido de un mensaje. Los mensajes los guardamos por líneas. Las líneas se
-	crearán tomando como medida la anchura del panel (w).
+	crearán tomando como medida la anchura del panel (w). Cada línea guarda sus tramos de texto con
+	estilo tras interpretar el marcado del mensaje (ver markup.go).
 
 	Además, guardamos un array de páginas. Una página no es más que una marca de las lineas de inicio y
 	fin de esta. El array de páginas nos permite saber de que línea a que línea podemos mostrar y
@@ -444,9 +524,13 @@ type MessagePanel struct {
 	Panel      *Panel
 	Parent     *ThreadPanel
 	Message    *srv.Message
-	Lines      []string
+	Lines      []StyledLine
 	Pages      []Page
 	ActivePage int
+	Indent     int
+	CodeOffset int // desplazamiento horizontal de las líneas de código
+	CodeBlocks []CodeBlock
+	NextBlock  int // siguiente bloque de código que se copiará
 }
 
 type Page struct {
@@ -458,7 +542,9 @@ func (p Page) Len() int {
 	return p.to - p.from
 }
 
-func CreateMessagePanel(scr tcell.Screen, msg *srv.Message, parent *ThreadPanel, indexMessage int) *MessagePanel {
+// El parámetro depth indica la profundidad del mensaje en el árbol de respuestas.
+// El mensaje se sangra hacia la derecha según su profundidad
+func CreateMessagePanel(scr tcell.Screen, msg *srv.Message, parent *ThreadPanel, indexMessage int, depth int) *MessagePanel {
 	mp := new(MessagePanel)
 	w, h := scr.Size()
 	mp.Panel = NewPanel(scr, 0, 1, w, h-1)
@@ -466,11 +552,29 @@ func CreateMessagePanel(scr tcell.Screen, msg *srv.Message, parent *ThreadPanel,
 	mp.Message = msg
 	mp.Pages = make([]Page, 0)
 	mp.ActivePage = 0
+	if depth > TREE_MAX_DEPTH {
+		depth = TREE_MAX_DEPTH
+	}
+	mp.Indent = depth * TREE_INDENT
 	pageSize := parent.MaxLine - 2
-	mp.Lines = msg.SplitInLines(w - 5)
+	mp.Lines = []StyledLine{NewTextLine(" ")}
+	mp.Lines = append(mp.Lines, ParseMarkup(msg.Text, w-5-mp.Indent)...)
+	mp.Lines = append(mp.Lines, NewTextLine(" "))
+	mp.CodeBlocks = ExtractCodeBlocks(msg.Text)
 	// add header of the message
 	header := fmt.Sprintf("#%d Por %s [%s]", indexMessage, msg.Author, msg.DateString())
-	mp.Lines = append([]string{header}, mp.Lines...)
+	if msg.ReplyTo != 0 && msg.Parent != nil {
+		for i, m := range msg.Parent.Messages {
+			if m.Id == msg.ReplyTo {
+				header += fmt.Sprintf(" en respuesta a #%d", i)
+				break
+			}
+		}
+	}
+	if msg.Held {
+		header += " (pendiente de moderación)"
+	}
+	mp.Lines = append([]StyledLine{{Kind: LINE_HEADER, Runs: []Run{{Text: header}}}}, mp.Lines...)
 
 	// Creo array de páginas
 	from := 0
@@ -509,12 +613,13 @@ func (mp *MessagePanel) Draw(startLine int, endLine int, npage int, isSelected b
 		if nline >= endLine {
 			return nline
 		}
+		col := 1 + mp.Indent
 		if i == 0 && npage == 0 && isSelected {
-			drawText(mp.Panel.screen, 1, nline, mp.Parent.MaxCol, nline, DefaultStyle.Reverse(true), line)
+			drawStyledLine(mp.Panel.screen, col, nline, mp.Parent.MaxCol, DefaultStyle.Reverse(true), line, mp.CodeOffset)
 		} else if i == 0 && npage == 0 {
-			drawText(mp.Panel.screen, 1, nline, mp.Parent.MaxCol, nline, DefaultStyle.Bold(true), line)
+			drawStyledLine(mp.Panel.screen, col, nline, mp.Parent.MaxCol, DefaultStyle.Bold(true), line, mp.CodeOffset)
 		} else {
-			drawText(mp.Panel.screen, 1, nline, mp.Parent.MaxCol, nline, DefaultStyle, line)
+			drawStyledLine(mp.Panel.screen, col, nline, mp.Parent.MaxCol, DefaultStyle, line, mp.CodeOffset)
 		}
 		nline++
 	}
@@ -530,16 +635,47 @@ func (mp *MessagePanel) DrawAll(startLine int, endLine int, isSelected bool) int
 		if nline >= (endLine - 1) {
 			return nline
 		}
+		col := 1 + mp.Indent
 		if i == 0 && isSelected {
-			drawText(mp.Panel.screen, 1, nline, mp.Parent.MaxCol, nline, DefaultStyle.Reverse(true), line)
+			drawStyledLine(mp.Panel.screen, col, nline, mp.Parent.MaxCol, DefaultStyle.Reverse(true), line, mp.CodeOffset)
 		} else {
-			drawText(mp.Panel.screen, 1, nline, mp.Parent.MaxCol, nline, DefaultStyle, line)
+			drawStyledLine(mp.Panel.screen, col, nline, mp.Parent.MaxCol, DefaultStyle, line, mp.CodeOffset)
 		}
 		nline++
 	}
 	return nline
 }
 
+// Desplaza en horizontal las líneas de código del mensaje
+func (mp *MessagePanel) ScrollCode(delta int) {
+	mp.CodeOffset += delta
+	if mp.CodeOffset < 0 {
+		mp.CodeOffset = 0
+	}
+	longest := 0
+	for _, line := range mp.Lines {
+		if n := len([]rune(line.String())); line.Kind == LINE_CODE && n > longest {
+			longest = n
+		}
+	}
+	if mp.CodeOffset > longest {
+		mp.CodeOffset = longest
+	}
+}
+
+// Copia al portapapeles el siguiente bloque de código del mensaje. Si hay
+// varios bloques, cada llamada copia uno distinto.
+// Retorna el número del bloque copiado (desde 1) y el total de bloques
+func (mp *MessagePanel) CopyCodeBlock() (int, int, error) {
+	if len(mp.CodeBlocks) == 0 {
+		return 0, 0, nil
+	}
+	n := mp.NextBlock % len(mp.CodeBlocks)
+	mp.NextBlock = n + 1
+	err := copyToClipboard(mp.CodeBlocks[n].Text)
+	return n + 1, len(mp.CodeBlocks), err
+}
+
 func (mp *MessagePanel) UpPage() {
 	if mp.ActivePage > 0 {
 		mp.ActivePage--
@@ -577,6 +713,39 @@ func refreshPanels(scr tcell.Screen, resize bool) {
 	} else if activeMode == MODE_HELP {
 		HelpPanel(scr)
 		scr.HideCursor()
+	} else if activeMode == MODE_ADMIN_MENU || activeMode == MODE_ADMIN_INPUT {
+		if lastActiveMode == MODE_THREAD {
+			threadPanel.Draw()
+		} else {
+			boardPanel.Draw()
+		}
+		if activeMode == MODE_ADMIN_MENU {
+			AdminMenuPanel(scr)
+			scr.HideCursor()
+		} else {
+			AdminInputPanel(scr)
+		}
+	} else if activeMode == MODE_AUDIT {
+		AuditPanel(scr)
+		scr.HideCursor()
+	} else if activeMode == MODE_AUDIT_FILTER {
+		AuditPanel(scr)
+		AuditFilterPanel(scr)
+	} else if activeMode == MODE_SESSIONS {
+		SessionsPanel(scr)
+		scr.HideCursor()
+	} else if activeMode == MODE_CONFLICT {
+		ConflictPanel(scr)
+		scr.HideCursor()
+	} else if activeMode == MODE_REPORT_INPUT {
+		threadPanel.Draw()
+		ReportInputPanel(scr)
+	} else if activeMode == MODE_REPORTS {
+		ReportsPanel(scr)
+		scr.HideCursor()
+	} else if activeMode == MODE_ANNOUNCEMENT {
+		AnnouncementPanel(scr)
+		scr.HideCursor()
 	}
 
 	if isBoardFiltered() {
@@ -632,7 +801,11 @@ func InputMessageFromEditor(initialText string) (error, string) {
 		return err, ""
 	}
 
-	cmd := exec.Command("nano", filename)
+	editor := strings.Fields(Editor)
+	if len(editor) == 0 {
+		editor = []string{"nano"}
+	}
+	cmd := exec.Command(editor[0], append(editor[1:], filename)...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -0,0 +1,242 @@
+package client
+
+import (
+	"fmt"
+	"gbb/srv"
+	"strings"
+
+	"github.com/gdamore/tcell"
+)
+
+/*
+
+	Denuncias
+
+	Desde un hilo '!' denuncia el mensaje seleccionado tras escribir el
+	motivo. Un moderador abre con 'q' desde el tablón la cola de
+	moderación con las denuncias abiertas. La parte superior las lista y la
+	inferior muestra el hilo, el autor y el texto del mensaje denunciado. Con
+	'i' se descarta la denuncia, con 'd' se borra el mensaje, con 'c' se
+	cierra el hilo y con 'b' se bloquea al autor. Borrar y bloquear se
+	confirman pulsando otra vez la misma tecla.
+
+	En la cola también aparece lo que retienen los filtros de contenido, con
+	la regla en lugar del denunciante. Descartar la denuncia lo publica.
+
+	Al entrar en el tablón se avisa al usuario de sus denuncias resueltas.
+
+*/
+
+// Líneas reservadas para el mensaje de la denuncia seleccionada
+const REPORT_DETAIL_LINES = 10
+
+var reports []*srv.Report
+var reportSelected int
+var reportFirstShowed int
+var reportConfirm rune
+
+// Mensaje que se está denunciando en MODE_REPORT_INPUT
+var reportedMessage *srv.Message
+
+// Texto con que se avisa de cada acción al denunciante
+var reportActions = map[string]string{
+	"dismiss": "descartada",
+	"delete":  "mensaje borrado",
+	"close":   "hilo cerrado",
+	"ban":     "autor bloqueado",
+}
+
+func startReport(s tcell.Screen) {
+	m := threadPanel.GetSelectedMessage()
+	if m.Author == clientUser.Login {
+		setWarningMessage("No puede denunciar sus propios mensajes")
+		return
+	}
+	reportedMessage = m
+	activeMode = MODE_REPORT_INPUT
+	messageBuffer = NewMessageBuffer(s, 8)
+}
+
+func ReportInputPanel(scr tcell.Screen) {
+	w, _ := scr.Size()
+	for col := 1; col < w; col++ {
+		scr.SetContent(col, 0, ' ', nil, DefaultStyle)
+	}
+	drawText(scr, 1, 0, 8, 0, DefaultStyle, "Motivo:")
+	drawText(scr, 9, 0, w, 0, DefaultStyle, messageBuffer.Msg)
+
+	scr.ShowCursor(messageBuffer.Cursor, 0)
+}
+
+// Envía la denuncia con el motivo escrito
+func runReport() {
+	err := ReportMessage(reportedMessage, messageBuffer.Msg)
+	if invalidField(err) == "reason" {
+		// se sigue editando el motivo para corregirlo
+		setWarningMessage(fmt.Sprintf("Error: %s", err))
+		return
+	}
+	if err != nil {
+		setWarningMessage(fmt.Sprintf("Error: %s", err))
+		logError(err.Error(), "runReport")
+	} else {
+		setWarningMessage("Denuncia enviada a los moderadores")
+	}
+	reportedMessage = nil
+	activeMode = MODE_THREAD
+}
+
+func openReports() {
+	if !clientUser.CanSomewhere(srv.PERM_MODERATE) {
+		setWarningMessage("Operación solo para moderadores")
+		return
+	}
+	err := loadReports()
+	if err != nil {
+		setWarningMessage(fmt.Sprintf("Error: %s", err))
+		logError(err.Error(), "openReports")
+		return
+	}
+	reportConfirm = 0
+	activeMode = MODE_REPORTS
+}
+
+func loadReports() error {
+	list, err := FetchReports()
+	if err != nil {
+		return err
+	}
+	reports = list
+	reportMoveCursor(0)
+	return nil
+}
+
+func ReportsPanel(scr tcell.Screen) {
+	w, h := scr.Size()
+	listBottom := h - REPORT_DETAIL_LINES - 2
+	NewPanel(scr, 0, 1, w, listBottom).Draw()
+	NewPanel(scr, 0, listBottom, w, h-1).Draw()
+
+	drawText(scr, 2, 2, w-1, 2, DefaultStyle.Bold(true), fmt.Sprintf("Denuncias abiertas (%d)", len(reports)))
+	drawText(scr, 2, 3, w-1, 3, DefaultStyle,
+		"i: descartar o publicar   d: borrar el mensaje   c: cerrar el hilo   b: bloquear al autor")
+
+	// mantenemos la denuncia seleccionada dentro de la zona visible
+	visible := listBottom - 5
+	if reportSelected < reportFirstShowed {
+		reportFirstShowed = reportSelected
+	}
+	if visible > 0 && reportSelected >= reportFirstShowed+visible {
+		reportFirstShowed = reportSelected - visible + 1
+	}
+
+	line := 5
+	for i := reportFirstShowed; i < len(reports) && line < listBottom; i++ {
+		rep := reports[i]
+		style := DefaultStyle
+		if i == reportSelected {
+			style = style.Reverse(true)
+		}
+		reporter, message := rep.Reporter, fmt.Sprintf("#%d", rep.MessageId)
+		if rep.Rule != 0 {
+			reporter = fmt.Sprintf("filtro %d", rep.Rule)
+		}
+		if rep.MessageId == 0 {
+			message = "título"
+		}
+		text := fmt.Sprintf("%s  %-12s %-7s %s", rep.Stamp.Local().Format("2006-01-02 15:04"), reporter,
+			message, strings.ReplaceAll(rep.Reason, "\n", " "))
+		drawText(scr, 2, line, w-1, line, style, text)
+		line++
+	}
+
+	if reportSelected < len(reports) {
+		rep := reports[reportSelected]
+		line = listBottom + 1
+		thread := rep.ThreadTitle
+		if rep.Deleted {
+			thread += " (mensaje borrado)"
+		}
+		line = drawAuditValue(scr, line, h-2, w, "Hilo: ", thread)
+		line = drawAuditValue(scr, line, h-2, w, "Autor: ", rep.Author)
+		drawAuditValue(scr, line, h-2, w, "", rep.Text)
+	}
+}
+
+func reportMoveCursor(delta int) {
+	reportSelected += delta
+	if reportSelected >= len(reports) {
+		reportSelected = len(reports) - 1
+	}
+	if reportSelected < 0 {
+		reportSelected = 0
+	}
+}
+
+// Ejecuta sobre la denuncia seleccionada la acción de la tecla pulsada
+func runReportOption(key rune) {
+	commands := map[rune]string{'i': "dismiss", 'd': "delete", 'c': "close", 'b': "ban"}
+	command, ok := commands[key]
+	if !ok || reportSelected >= len(reports) {
+		reportConfirm = 0
+		return
+	}
+	rep := reports[reportSelected]
+	if (key == 'd' || key == 'b') && reportConfirm != key {
+		reportConfirm = key
+		if key == 'd' {
+			setWarningMessage("¿Desea borrar el mensaje? Pulse 'd' para confirmar")
+		} else {
+			setWarningMessage(fmt.Sprintf("¿Desea bloquear a %s? Pulse 'b' para confirmar", rep.Author))
+		}
+		return
+	}
+	reportConfirm = 0
+
+	err := ModerateReport(rep, command)
+	if err != nil {
+		setWarningMessage(fmt.Sprintf("Error: %s", err))
+		logError(err.Error(), "runReportOption")
+		return
+	}
+	err = loadReports()
+	if err != nil {
+		setWarningMessage(fmt.Sprintf("Error: %s", err))
+		logError(err.Error(), "runReportOption")
+		return
+	}
+	if rep.Rule != 0 && command == "dismiss" {
+		setWarningMessage("Contenido retenido publicado")
+		return
+	}
+	setWarningMessage(fmt.Sprintf("Denuncia resuelta: %s", reportActions[command]))
+}
+
+// Avisa al usuario de las denuncias que le han resuelto desde la última vez
+func notifyResolvedReports() {
+	list, err := FetchOwnReports()
+	if err != nil {
+		logError(err.Error(), "notifyResolvedReports")
+		return
+	}
+	resolved := make([]*srv.Report, 0)
+	ids := make([]int, 0)
+	for _, rep := range list {
+		if rep.Status != srv.REPORT_OPEN && !rep.Notified {
+			resolved = append(resolved, rep)
+			ids = append(ids, rep.Id)
+		}
+	}
+	if len(resolved) == 0 {
+		return
+	}
+	text := fmt.Sprintf("Su denuncia del mensaje [%d] se ha resuelto: %s", resolved[0].MessageId, reportActions[resolved[0].Action])
+	if len(resolved) > 1 {
+		text += fmt.Sprintf(" (y %d más)", len(resolved)-1)
+	}
+	setWarningMessage(text)
+	err = AckReports(ids)
+	if err != nil {
+		logError(err.Error(), "notifyResolvedReports")
+	}
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"fmt"
+	"gbb/srv"
+
+	"github.com/gdamore/tcell"
+)
+
+/*
+
+	Sesiones
+
+	Desde el tablón 's' lista las sesiones abiertas del usuario en el
+	servidor, con la dirección desde la que se abrieron y su última
+	actividad. Con 'd' se revoca la sesión seleccionada. 'x' cierra la
+	sesión actual y sale del programa.
+
+*/
+
+var userSessions []*srv.Session
+var sessionSelected int
+var confirmLogout bool
+
+func openSessions() {
+	list, err := FetchSessions()
+	if err != nil {
+		setWarningMessage(fmt.Sprintf("Error: %s", err))
+		logError(err.Error(), "openSessions")
+		return
+	}
+	userSessions = list
+	if sessionSelected >= len(userSessions) {
+		sessionSelected = len(userSessions) - 1
+	}
+	if sessionSelected < 0 {
+		sessionSelected = 0
+	}
+	activeMode = MODE_SESSIONS
+}
+
+func SessionsPanel(scr tcell.Screen) {
+	w, h := scr.Size()
+	NewPanel(scr, 0, 1, w, h-1).Draw()
+	drawText(scr, 2, 2, w-1, 2, DefaultStyle.Bold(true), fmt.Sprintf("Sesiones abiertas (%d)", len(userSessions)))
+	drawText(scr, 2, 4, w-1, 4, DefaultStyle, fmt.Sprintf("%-19s  %-19s  %s", "INICIO", "ÚLTIMO USO", "DIRECCIÓN"))
+
+	line := 5
+	for i := 0; i < len(userSessions) && line < h-2; i++ {
+		s := userSessions[i]
+		style := DefaultStyle
+		if i == sessionSelected {
+			style = style.Reverse(true)
+		}
+		text := fmt.Sprintf("%s  %s  %s", s.Created.Local().Format("2006-01-02 15:04:05"),
+			s.Stamp.Local().Format("2006-01-02 15:04:05"), s.Remote)
+		if s.Current {
+			text += "  (esta sesión)"
+		}
+		drawText(scr, 2, line, w-1, line, style, text)
+		line++
+	}
+}
+
+func sessionMoveCursor(delta int) {
+	sessionSelected += delta
+	if sessionSelected >= len(userSessions) {
+		sessionSelected = len(userSessions) - 1
+	}
+	if sessionSelected < 0 {
+		sessionSelected = 0
+	}
+}
+
+// Revoca la sesión seleccionada. La sesión actual se cierra con 'x'
+func revokeSelectedSession() {
+	if sessionSelected >= len(userSessions) {
+		return
+	}
+	s := userSessions[sessionSelected]
+	if s.Current {
+		setWarningMessage("Esta es la sesión actual. Use 'x' desde el tablón para cerrarla")
+		return
+	}
+	err := RevokeSession(s)
+	if err != nil {
+		setWarningMessage(fmt.Sprintf("Error: %s", err))
+		logError(err.Error(), "revokeSelectedSession")
+		return
+	}
+	openSessions()
+	setWarningMessage("Sesión revocada")
+}
+
+// Cierra la sesión en el servidor y sale del programa
+func logout(scr tcell.Screen) {
+	err := Logout()
+	if err != nil {
+		setWarningMessage(fmt.Sprintf("Error: %s", err))
+		logError(err.Error(), "logout")
+		return
+	}
+	quit(scr)
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"gbb/srv"
+)
+
+/*
+
+	Árbol de respuestas
+
+	Los mensajes de un hilo se pueden ver en orden cronológico o como un árbol
+	en el que cada mensaje cuelga del mensaje al que responde (ReplyTo). Los
+	mensajes que responden al hilo, y no a un mensaje concreto, cuelgan del
+	primer mensaje del hilo.
+
+	En modo árbol el ThreadPanel guarda los nodos visibles en el mismo orden
+	que sus MessagePanel, de forma que MessageSelected sirve para ambos.
+
+*/
+
+const TREE_INDENT = 2
+const TREE_MAX_DEPTH = 8
+
+// Si está activo, los hilos se abren en modo árbol
+var treeViewEnabled = false
+
+type replyNode struct {
+	Message  *srv.Message
+	Index    int // posición cronológica del mensaje en el hilo
+	Depth    int
+	Parent   *replyNode
+	Children []*replyNode
+}
+
+// Construye el árbol de respuestas de un hilo y retorna su raíz (el primer
+// mensaje del hilo)
+func buildReplyTree(th *srv.Thread) *replyNode {
+	if len(th.Messages) == 0 {
+		return nil
+	}
+
+	nodes := make(map[int]*replyNode)
+	for i, m := range th.Messages {
+		nodes[m.Id] = &replyNode{Message: m, Index: i}
+	}
+
+	root := nodes[th.Messages[0].Id]
+	for _, m := range th.Messages[1:] {
+		node := nodes[m.Id]
+		parent, ok := nodes[m.ReplyTo]
+		if !ok || parent == node {
+			parent = root
+		}
+		node.Parent = parent
+		parent.Children = append(parent.Children, node)
+	}
+
+	setDepth(root, 0)
+	return root
+}
+
+func setDepth(node *replyNode, depth int) {
+	node.Depth = depth
+	for _, child := range node.Children {
+		setDepth(child, depth+1)
+	}
+}
+
+// Recorre el árbol en profundidad y retorna los nodos visibles: los que no
+// cuelgan de ningún nodo plegado
+func visibleNodes(node *replyNode, collapsed map[int]bool) []*replyNode {
+	nodes := []*replyNode{node}
+	if collapsed[node.Message.Id] {
+		return nodes
+	}
+	for _, child := range node.Children {
+		nodes = append(nodes, visibleNodes(child, collapsed)...)
+	}
+	return nodes
+}
+
+// Número total de respuestas que cuelgan de un nodo
+func countDescendants(node *replyNode) int {
+	n := len(node.Children)
+	for _, child := range node.Children {
+		n += countDescendants(child)
+	}
+	return n
+}
+
+// Posición de un nodo entre sus hermanos
+func siblingIndex(node *replyNode) int {
+	if node.Parent == nil {
+		return 0
+	}
+	for i, sibling := range node.Parent.Children {
+		if sibling == node {
+			return i
+		}
+	}
+	return 0
+}
+
+/*
+	Navegación del ThreadPanel en modo árbol
+*/
+
+// Cambia entre la vista cronológica y la vista en árbol manteniendo
+// seleccionado el mismo mensaje
+func (tp *ThreadPanel) ToggleTreeMode() {
+	selected := tp.GetSelectedMessage()
+	tp.TreeMode = !tp.TreeMode
+	treeViewEnabled = tp.TreeMode
+	tp.buildMessagePanels()
+	tp.selectMessage(selected)
+}
+
+// Pliega o despliega las respuestas del mensaje seleccionado
+func (tp *ThreadPanel) ToggleCollapse() {
+	if !tp.TreeMode || len(tp.nodes) == 0 {
+		return
+	}
+	node := tp.nodes[tp.MessageSelected]
+	if len(node.Children) == 0 {
+		return
+	}
+	id := node.Message.Id
+	tp.Collapsed[id] = !tp.Collapsed[id]
+	tp.buildMessagePanels()
+	tp.selectMessage(node.Message)
+}
+
+// Selecciona el mensaje al que responde el seleccionado
+func (tp *ThreadPanel) GoToParent() {
+	if !tp.TreeMode || len(tp.nodes) == 0 {
+		return
+	}
+	node := tp.nodes[tp.MessageSelected]
+	if node.Parent != nil {
+		tp.selectMessage(node.Parent.Message)
+	}
+}
+
+// Selecciona la primera respuesta del mensaje seleccionado, desplegándolo si
+// estaba plegado
+func (tp *ThreadPanel) GoToFirstChild() {
+	if !tp.TreeMode || len(tp.nodes) == 0 {
+		return
+	}
+	node := tp.nodes[tp.MessageSelected]
+	if len(node.Children) == 0 {
+		return
+	}
+	if tp.Collapsed[node.Message.Id] {
+		tp.Collapsed[node.Message.Id] = false
+		tp.buildMessagePanels()
+	}
+	tp.selectMessage(node.Children[0].Message)
+}
+
+// Selecciona el siguiente (delta=1) o anterior (delta=-1) mensaje que
+// responde al mismo mensaje que el seleccionado
+func (tp *ThreadPanel) GoToSibling(delta int) {
+	if !tp.TreeMode || len(tp.nodes) == 0 {
+		return
+	}
+	node := tp.nodes[tp.MessageSelected]
+	if node.Parent == nil {
+		return
+	}
+	i := siblingIndex(node) + delta
+	if i >= 0 && i < len(node.Parent.Children) {
+		tp.selectMessage(node.Parent.Children[i].Message)
+	}
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"gbb/client"
+	"gbb/srv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+
+	Configuración
+
+	Cada opción tiene un valor por defecto que se puede cambiar, en este
+	orden de prioridad creciente, desde:
+
+		- el fichero $GBBHOME/gbb.conf
+		- el fichero ~/.config/gbb/gbb.conf del usuario (solo el cliente)
+		- una variable de entorno GBB_SECCION_CLAVE
+		- una opción --seccion-clave de la línea de comandos
+
+	Los ficheros tienen el formato:
+
+		[seccion]
+		clave = valor   # comentario
+
+	Los comentarios empiezan con # o ; al principio de la línea o tras un
+	espacio, así que un valor puede contener esos caracteres.
+
+	Las secciones [profile.nombre] definen perfiles de conexión con opciones
+	de la sección client (normalmente server y login). El perfil elegido con
+	client.profile se aplica sobre los ficheros, pero no sobre las variables
+	de entorno ni las opciones de la línea de comandos.
+
+*/
+
+const CONFIG_FILE_NAME = "gbb.conf"
+
+type setting struct {
+	section string
+	key     string
+	value   interface{} // *string, *int, *time.Duration o *srv.RateLimit
+	help    string
+}
+
+func (s *setting) name() string {
+	return s.section + "." + s.key
+}
+
+func (s *setting) flagName() string {
+	return s.section + "-" + strings.ReplaceAll(s.key, "_", "-")
+}
+
+func (s *setting) envName() string {
+	return "GBB_" + strings.ToUpper(s.section+"_"+s.key)
+}
+
+// Las opciones en el orden en el que se muestran con --show-config
+var settings = []*setting{
+	{"server", "listen", &srv.ListenAddress, "dirección y puerto en los que escucha el servidor"},
+	{"server", "db", &srv.DatabasePath, "base de datos, relativa a $GBBHOME si no es absoluta"},
+	{"server", "session_lifetime", &srv.SessionLifetime, "duración de una sesión"},
+	{"server", "session_expiry", &srv.SessionExpiry, "sliding: caduca tras session_lifetime sin uso; absolute: tras crearse"},
+	{"server", "tls_cert", &srv.TLSCertFile, "certificado PEM para servir HTTPS, se recarga con SIGHUP"},
+	{"server", "tls_key", &srv.TLSKeyFile, "clave privada PEM del certificado"},
+	{"server", "socket", &srv.SocketPath, "socket Unix en el que también escucha, vacío para no usarlo"},
+	{"server", "socket_mode", &srv.SocketMode, "permisos del socket en octal"},
+	{"server", "socket_group", &srv.SocketGroup, "grupo al que se asigna el socket"},
+	{"server", "admin_listen", &srv.AdminListenAddress, "dirección de /healthz y /metrics, vacía para servirlas con la API"},
+	{"server", "shutdown_timeout", &srv.ShutdownTimeout, "espera máxima a las peticiones en curso al detener el servidor"},
+
+	{"log", "level", &srv.LogOptions.Level, "nivel mínimo del log: debug, info, warn o error"},
+	{"log", "format", &srv.LogOptions.Format, "formato del log: text o json"},
+	{"log", "sink", &srv.LogOptions.Sink, "salida del log: stderr, file o syslog"},
+	{"log", "file", &srv.LogOptions.File, "fichero de log para la salida file"},
+	{"log", "max_size", &srv.LogOptions.MaxSize, "tamaño en MB a partir del que se rota el fichero de log"},
+	{"log", "max_files", &srv.LogOptions.MaxFiles, "ficheros de log rotados que se conservan"},
+
+	{"limits", "threads", &srv.Limits.Threads, "hilos nuevos por usuario (peticiones/ventana)"},
+	{"limits", "messages", &srv.Limits.Messages, "mensajes nuevos por usuario"},
+	{"limits", "edits", &srv.Limits.Edits, "ediciones de mensajes por usuario"},
+	{"limits", "logins_by_user", &srv.Limits.LoginsByUser, "intentos de inicio de sesión por login"},
+	{"limits", "logins_by_addr", &srv.Limits.LoginsByAddr, "intentos de inicio de sesión por dirección"},
+	{"limits", "reports", &srv.Limits.Reports, "denuncias de mensajes por usuario"},
+
+	{"validation", "title_max", &srv.Validation.TitleMax, "caracteres de un título"},
+	{"validation", "title_pattern", &srv.Validation.TitlePattern, "expresión regular que deben cumplir los títulos, vacía para no exigir ninguna"},
+	{"validation", "message_max", &srv.Validation.MessageMax, "bytes del texto de un mensaje"},
+	{"validation", "login_max", &srv.Validation.LoginMax, "caracteres de un login nuevo"},
+	{"validation", "body_max", &srv.Validation.BodyMax, "bytes del cuerpo de una petición"},
+
+	{"roles", "admin_groups", &srv.AdminGroups, "grupos del sistema, separados por comas, cuyos miembros son administradores"},
+	{"roles", "moderator_groups", &srv.ModeratorGroups, "grupos del sistema cuyos miembros son moderadores"},
+
+	{"filter", "new_account_age", &srv.NewAccountAge, "antigüedad por debajo de la que una cuenta es nueva para las reglas links"},
+
+	{"lockout", "user_attempts", &srv.Lockout.UserAttempts, "fallos por login antes de bloquearlo, 0 para no bloquear"},
+	{"lockout", "addr_attempts", &srv.Lockout.AddrAttempts, "fallos por dirección antes de bloquearla, 0 para no bloquear"},
+	{"lockout", "delay", &srv.Lockout.Delay, "primer bloqueo, se duplica con cada nuevo fallo"},
+	{"lockout", "max_delay", &srv.Lockout.MaxDelay, "bloqueo máximo"},
+	{"lockout", "reset", &srv.Lockout.Reset, "tiempo sin fallos tras el que se olvidan"},
+
+	{"client", "profile", &profile, "perfil de conexión [profile.nombre] que se usa"},
+	{"client", "server", &srv.SERVER, "URL del servidor (http://, https:// o unix:///ruta/socket)"},
+	{"client", "login", &client.Login, "login en el servidor, por defecto el usuario del sistema"},
+	{"client", "ca_file", &client.CAFile, "fichero PEM con CA adicionales para verificar el servidor"},
+	{"client", "fingerprint", &client.ServerFingerprint, "huella SHA-256 del certificado del servidor a aceptar"},
+	{"client", "editor", &client.Editor, "editor con el que se escriben los mensajes"},
+	{"client", "date_format", &srv.DATE_FORMAT, "formato con el que se muestran las fechas (sintaxis de Go)"},
+}
+
+// Atajos de la línea de comandos para las opciones más usadas
+var flagAliases = map[string]string{
+	"url":     "client.server",
+	"login":   "client.login",
+	"profile": "client.profile",
+}
+
+// Ficheros de configuración leídos y opciones de cada perfil de conexión,
+// por nombre de perfil, para mostrarlos con --show-config
+var loadedConfigFiles []string
+var profiles = map[string]map[string]string{}
+
+var profile = ""
+
+// Configuración leída. Cada opción se lee sobre una copia de su valor, así
+// que las variables en uso no cambian hasta que se aplica con apply
+type config struct {
+	values   map[*setting]interface{}     // mismo tipo que setting.value
+	explicit map[*setting]bool            // fijadas por una variable de entorno o la línea de comandos
+	profiles map[string]map[string]string // opciones de cada perfil de conexión, por nombre de perfil
+	files    []string
+}
+
+func newValue(s *setting) interface{} {
+	switch s.value.(type) {
+	case *string:
+		return new(string)
+	case *int:
+		return new(int)
+	case *time.Duration:
+		return new(time.Duration)
+	case *srv.RateLimit:
+		return new(srv.RateLimit)
+	}
+	return nil
+}
+
+func copyValue(dst interface{}, src interface{}) {
+	switch v := dst.(type) {
+	case *string:
+		*v = *src.(*string)
+	case *int:
+		*v = *src.(*int)
+	case *time.Duration:
+		*v = *src.(*time.Duration)
+	case *srv.RateLimit:
+		*v = *src.(*srv.RateLimit)
+	}
+}
+
+// Configuración con los valores actuales de las opciones. Antes de leer la
+// configuración por primera vez son los valores por defecto
+func currentConfig() *config {
+	c := &config{
+		values:   make(map[*setting]interface{}, len(settings)),
+		explicit: map[*setting]bool{},
+		profiles: map[string]map[string]string{},
+	}
+	for _, s := range settings {
+		c.values[s] = newValue(s)
+		copyValue(c.values[s], s.value)
+	}
+	return c
+}
+
+// Copia de defaults sobre la que leer otra configuración
+func newConfig(defaults *config) *config {
+	c := currentConfig()
+	for _, s := range settings {
+		copyValue(c.values[s], defaults.values[s])
+	}
+	return c
+}
+
+func (c *config) set(s *setting, text string) error {
+	return parseValue(s, c.values[s], text)
+}
+
+func (c *config) str(name string) *string {
+	return c.values[findSetting(name)].(*string)
+}
+
+func (c *config) int(name string) int {
+	return *c.values[findSetting(name)].(*int)
+}
+
+// Copia la configuración sobre las variables en uso
+func (c *config) apply() {
+	for s, v := range c.values {
+		copyValue(s.value, v)
+	}
+	loadedConfigFiles = c.files
+	profiles = c.profiles
+}
+
+func findSetting(name string) *setting {
+	for _, s := range settings {
+		if s.name() == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Lee en dst, del mismo tipo que s.value, el texto de una opción
+func parseValue(s *setting, dst interface{}, text string) error {
+	text = strings.TrimSpace(text)
+	switch v := dst.(type) {
+	case *string:
+		*v = text
+	case *int:
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			return fmt.Errorf("%s: se esperaba un número: %s", s.name(), text)
+		}
+		*v = n
+	case *time.Duration:
+		d, err := time.ParseDuration(text)
+		if err != nil {
+			return fmt.Errorf("%s: se esperaba una duración (30m, 1h...): %s", s.name(), text)
+		}
+		*v = d
+	case *srv.RateLimit:
+		parts := strings.SplitN(text, "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%s: se esperaba peticiones/ventana (10/1m): %s", s.name(), text)
+		}
+		n, err1 := strconv.Atoi(parts[0])
+		d, err2 := time.ParseDuration(parts[1])
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("%s: se esperaba peticiones/ventana (10/1m): %s", s.name(), text)
+		}
+		*v = srv.RateLimit{Limit: n, Window: d}
+	}
+	return nil
+}
+
+func valueString(s *setting) string {
+	switch v := s.value.(type) {
+	case *string:
+		return *v
+	case *int:
+		return strconv.Itoa(*v)
+	case *time.Duration:
+		return v.String()
+	case *srv.RateLimit:
+		return fmt.Sprintf("%d/%s", v.Limit, v.Window)
+	}
+	return ""
+}
+
+// Lee un fichero de configuración. Si no existe no es un error
+func (c *config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = c.parse(f, path)
+	if err == nil {
+		c.files = append(c.files, path)
+	}
+	return err
+}
+
+// Quita el comentario de una línea. # y ; solo empiezan un comentario al
+// principio de la línea o tras un espacio, para que puedan aparecer en los
+// valores (expresiones regulares, rutas, comandos...)
+func stripComment(line string) string {
+	for i, c := range line {
+		if (c == '#' || c == ';') && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func (c *config) parse(r io.Reader, path string) error {
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for nline := 1; scanner.Scan(); nline++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%s:%d: se esperaba clave = valor", path, nline)
+		}
+		key := strings.TrimSpace(kv[0])
+		if strings.HasPrefix(section, "profile.") {
+			if findSetting("client."+key) == nil || key == "profile" {
+				return fmt.Errorf("%s:%d: opción desconocida %s en el perfil [%s]", path, nline, key, section)
+			}
+			name := strings.TrimPrefix(section, "profile.")
+			if c.profiles[name] == nil {
+				c.profiles[name] = make(map[string]string)
+			}
+			c.profiles[name][key] = strings.TrimSpace(kv[1])
+			continue
+		}
+		s := findSetting(section + "." + key)
+		if s == nil {
+			return fmt.Errorf("%s:%d: opción desconocida %s en la sección [%s]", path, nline, strings.TrimSpace(kv[0]), section)
+		}
+		if err := c.set(s, kv[1]); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, nline, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Aplica las variables de entorno GBB_SECCION_CLAVE que estén definidas
+func (c *config) loadEnv() error {
+	for _, s := range settings {
+		if text, ok := os.LookupEnv(s.envName()); ok {
+			if err := c.set(s, text); err != nil {
+				return fmt.Errorf("%s: %s", s.envName(), err)
+			}
+			c.explicit[s] = true
+		}
+	}
+	return nil
+}
+
+// Valor de una opción para el paquete flag. Los valores se aplican cuando
+// se ha terminado de leer el resto de la configuración
+type settingFlag struct {
+	s     *setting
+	value *string
+}
+
+func (sf settingFlag) String() string {
+	if sf.s == nil {
+		return ""
+	}
+	if *sf.value == "" {
+		return valueString(sf.s)
+	}
+	return *sf.value
+}
+
+func (sf settingFlag) Set(text string) error {
+	*sf.value = text
+	return nil
+}
+
+// Registra en flags una opción --seccion-clave por cada opción de
+// configuración y retorna una función que aplica las que se hayan usado
+func registerConfigFlags(flags *flag.FlagSet) func(c *config) error {
+	for _, s := range settings {
+		value := settingFlag{s, new(string)}
+		flags.Var(value, s.flagName(), s.help)
+		for alias, name := range flagAliases {
+			if name == s.name() {
+				flags.Var(value, alias, "igual que --"+s.flagName())
+			}
+		}
+	}
+	return func(c *config) error {
+		var err error
+		flags.Visit(func(f *flag.Flag) {
+			if sf, ok := f.Value.(settingFlag); ok && err == nil {
+				err = c.set(sf.s, *sf.value)
+				c.explicit[sf.s] = true
+			}
+		})
+		return err
+	}
+}
+
+// Lee la configuración completa en c y comprueba que es utilizable.
+// userConfig indica si se lee también el fichero del usuario
+func (c *config) load(exDir string, configPath string, userConfig bool, applyFlags func(c *config) error) error {
+	if configPath == "" {
+		configPath = filepath.Join(exDir, CONFIG_FILE_NAME)
+	}
+	err := c.loadFile(configPath)
+	if err != nil {
+		return err
+	}
+	if userConfig {
+		if dir, err := os.UserConfigDir(); err == nil {
+			err = c.loadFile(filepath.Join(dir, "gbb", CONFIG_FILE_NAME))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = c.loadEnv()
+	if err != nil {
+		return err
+	}
+	err = applyFlags(c)
+	if err != nil {
+		return err
+	}
+	err = c.applyProfile()
+	if err != nil {
+		return err
+	}
+	server := c.str("client.server")
+	*server = strings.TrimRight(*server, "/")
+
+	db := c.str("server.db")
+	if !filepath.IsAbs(*db) {
+		*db = filepath.Join(exDir, *db)
+	}
+	if expiry := *c.str("server.session_expiry"); expiry != "sliding" && expiry != "absolute" {
+		return fmt.Errorf("server.session_expiry: se esperaba sliding o absolute: %s", expiry)
+	}
+	return srv.CheckValidationConfig(srv.ValidationConfig{
+		TitleMax:     c.int("validation.title_max"),
+		MessageMax:   c.int("validation.message_max"),
+		LoginMax:     c.int("validation.login_max"),
+		BodyMax:      c.int("validation.body_max"),
+		TitlePattern: *c.str("validation.title_pattern"),
+	})
+}
+
+// Retorna una función que vuelve a leer la configuración partiendo de los
+// valores por defecto y, si es correcta, la aplica con srv.SwapConfig. Si
+// la lectura falla no cambia nada
+func configReloader(defaults *config, exDir string, configPath string, applyFlags func(c *config) error) func() error {
+	return func() error {
+		c := newConfig(defaults)
+		err := c.load(exDir, configPath, false, applyFlags)
+		if err != nil {
+			return err
+		}
+		srv.SwapConfig(c.apply)
+		return nil
+	}
+}
+
+// Aplica las opciones del perfil elegido que no se hayan fijado de forma
+// explícita
+func (c *config) applyProfile() error {
+	name := *c.str("client.profile")
+	if name == "" {
+		return nil
+	}
+	options, ok := c.profiles[name]
+	if !ok {
+		return fmt.Errorf("no existe el perfil %s", name)
+	}
+	for key, text := range options {
+		s := findSetting("client." + key)
+		if c.explicit[s] {
+			continue
+		}
+		if err := c.set(s, text); err != nil {
+			return fmt.Errorf("perfil %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Muestra la configuración efectiva en el formato del fichero
+func showConfig(w io.Writer) {
+	if len(loadedConfigFiles) == 0 {
+		fmt.Fprintln(w, "# Sin ficheros de configuración, valores por defecto")
+	}
+	for _, path := range loadedConfigFiles {
+		fmt.Fprintf(w, "# Leído %s\n", path)
+	}
+	section := ""
+	for _, s := range settings {
+		if s.section != section {
+			section = s.section
+			fmt.Fprintf(w, "\n[%s]\n", section)
+		}
+		fmt.Fprintf(w, "%-16s = %-24s # %s\n", s.key, valueString(s), s.help)
+	}
+
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "\n[profile.%s]\n", name)
+		keys := make([]string, 0, len(profiles[name]))
+		for key := range profiles[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%-16s = %s\n", key, profiles[name][key])
+		}
+	}
+}
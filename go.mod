@@ -2,15 +2,18 @@ module gbb
 
 go 1.17
 
-require github.com/gdamore/tcell v1.4.0
+require (
+	github.com/gdamore/tcell v1.4.0
+	github.com/gorilla/mux v1.8.0
+	github.com/mattn/go-sqlite3 v1.14.10
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
+	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211
+)
 
 require (
 	github.com/gdamore/encoding v1.0.0 // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/lucasb-eyer/go-colorful v1.0.3 // indirect
 	github.com/mattn/go-runewidth v0.0.7 // indirect
-	github.com/mattn/go-sqlite3 v1.14.10 // indirect
 	golang.org/x/sys v0.0.0-20220227234510-4e6760a101f9 // indirect
-	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211 // indirect
-	golang.org/x/text v0.3.0 // indirect
+	golang.org/x/text v0.3.6 // indirect
 )
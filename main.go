@@ -1,6 +1,8 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"gbb/client"
 	"gbb/srv"
 	"math/rand"
@@ -11,6 +13,17 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+const USAGE = `Uso:
+	gbb [opciones]                 Abre el tablón
+	gbb [opciones] --password      Cambia la contraseña del usuario
+	gbb [opciones] --reload        Pide al servidor que recargue los usuarios
+	gbb [opciones] --server        Arranca el servidor
+	gbb [opciones] admin ...       Comandos de administración (gbb admin para verlos)
+	gbb [opciones] --show-config   Muestra la configuración efectiva
+
+Opciones:
+`
+
 func GetInstallationDirectory() string {
 
 	dir := os.Getenv("GBBHOME")
@@ -31,16 +44,56 @@ func main() {
 
 	exDir := GetInstallationDirectory()
 
-	if len(os.Args) > 1 && os.Args[1] == "--server" {
+	flags := flag.NewFlagSet("gbb", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), USAGE)
+		flags.PrintDefaults()
+	}
+	server := flags.Bool("server", false, "arranca el servidor")
+	debug := flags.Bool("debug", false, "escribe el log de depuración del cliente")
+	password := flags.Bool("password", false, "cambia la contraseña del usuario")
+	reload := flags.Bool("reload", false, "pide al servidor que recargue los usuarios")
+	show := flags.Bool("show-config", false, "muestra la configuración efectiva y termina")
+	configPath := flags.String("config", "", "fichero de configuración en lugar de $GBBHOME/"+CONFIG_FILE_NAME)
+	applyFlags := registerConfigFlags(flags)
+	flags.Parse(os.Args[1:])
+	args := flags.Args()
+
+	defaults := currentConfig()
+	srv.ReloadConfig = configReloader(defaults, exDir, *configPath, applyFlags)
+	c := newConfig(defaults)
+	err := c.load(exDir, *configPath, !*server, applyFlags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error en la configuración: %s\n", err)
+		os.Exit(1)
+	}
+	c.apply()
+
+	if *show {
+		showConfig(os.Stdout)
+
+	} else if *server {
 		//Run server mode:
-		srv.ServerInit(exDir)
+		srv.ServerInit()
+
+	} else if len(args) > 0 && args[0] == "admin" {
+		//Run an admin command:
+		client.AdminInit(args[1:])
+
+	} else if len(args) > 0 {
+		flags.Usage()
+		os.Exit(1)
 
 	} else {
 		//Run in client mode:
-		if len(os.Args) > 1 {
-			client.ClientInit(os.Args[1], exDir)
-		} else {
-			client.ClientInit("", exDir)
+		cmd := ""
+		if *password {
+			cmd = "--password"
+		} else if *reload {
+			cmd = "--reload"
+		} else if *debug {
+			cmd = "--debug"
 		}
+		client.ClientInit(cmd, exDir)
 	}
 }
@@ -1,17 +1,17 @@
 package srv
 
 import (
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"math"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -24,6 +24,9 @@ type api struct {
 func (a *api) deleteMessage(w http.ResponseWriter, r *http.Request) {
 	user := GetUserFromSession(r)
 	if user != nil {
+		if !a.checkCanWrite(w, user) {
+			return
+		}
 		vars := mux.Vars(r)
 		id, err := strconv.Atoi(vars["MsgId"])
 		if err == nil {
@@ -33,24 +36,24 @@ func (a *api) deleteMessage(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			if m.Author != user.Login && !user.IsAdmin {
+			if !can(user, PERM_DELETE, m.Parent, m) {
 				a.jsonerror(w, "Bad msg id or bad msg author", 404)
 				return
 			}
 
-			if th := m.Parent; th != nil {
-				err = m.DeleteFromBD()
-				if err != nil {
-					logEvent(fmt.Sprintf("BD ERROR: Falló el borrado del mensaje [%d] del hilo %s por %s: %s", m.Id, th.Id, user.Login, err))
-				}
-				err = th.delMessage(m)
-				if err != nil {
-					logEvent(fmt.Sprintf("Falló el borrado del mensaje [%d] del hilo %s por %s: %s", m.Id, th.Id, user.Login, err))
-				} else {
-					logEvent(fmt.Sprintf("Se ha borrado el mensaje [%d]  del hilo %s por %s", m.Id, th.Id, user.Login))
-				}
-
+			th := m.Parent
+			if th == nil || th.messageIndex(m) <= 0 {
+				a.jsonerror(w, ErrNotAReply.Error(), 404)
+				return
+			}
+			err = th.deleteReply(m)
+			if err != nil {
+				logError("BD ERROR: Falló el borrado del mensaje", "msg", m.Id, "thread", th.Id, "user", user.Login, "error", err)
+				a.jsonerror(w, "Operation failed", 500)
+				return
 			}
+			logInfo("Se ha borrado el mensaje", "msg", m.Id, "thread", th.Id, "user", user.Login)
+			audit(r, user.Login, AUDIT_MESSAGE_DELETE, th.Id, m.Id, m.Text, "")
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(200)
 			json.NewEncoder(w).Encode(m)
@@ -67,23 +70,60 @@ func (a *api) deleteMessage(w http.ResponseWriter, r *http.Request) {
 func (a *api) updateMessageInThread(w http.ResponseWriter, r *http.Request) {
 	user := GetUserFromSession(r)
 	if user != nil {
+		if !a.checkCanWrite(w, user) {
+			return
+		}
+		if !a.checkRateLimit(w, editsLimiter, user.Login) {
+			return
+		}
 		vars := mux.Vars(r)
 		id, err := strconv.Atoi(vars["MsgId"])
 		if err == nil {
-			if storedMsg := board.getMessage(id); storedMsg != nil && storedMsg.Author == user.Login {
+			if storedMsg := board.getMessage(id); storedMsg != nil && can(user, PERM_EDIT, storedMsg.Parent, storedMsg) {
 				auxMsg := NewMessage("", "")
-				err := json.NewDecoder(r.Body).Decode(auxMsg)
+				err := decodeBody(r, auxMsg)
+				if err == nil {
+					err = validateMessage(auxMsg.Text)
+				}
+				var hold *FilterRule
 				if err == nil {
-					storedMsg.Text = auxMsg.Text
-					err=storedMsg.Save(true)
-                    if err!=nil{
-						logEvent(fmt.Sprintf("BD ERROR: Falló el actualizado del mensaje [%d]: %s", storedMsg.Id, err))
+					auxMsg.Text, hold, err = applyFilters("text", "El mensaje", auxMsg.Text, user)
+				}
+				if err == nil {
+					if !a.checkIfMatch(w, r, storedMsg) {
+						logInfo("Edición del mensaje rechazada por su versión", "msg", storedMsg.Id, "user", user.Login)
+						return
+					}
+					edited := *storedMsg
+					edited.Text = auxMsg.Text
+					err = edited.SaveIfVersion(storedMsg.Version)
+					if err == ErrEditConflict {
+						a.editConflict(w, storedMsg)
+						return
+					}
+					if err != nil {
+						logError("BD ERROR: Falló el actualizado del mensaje", "msg", storedMsg.Id, "error", err)
+						a.jsonerror(w, "Operation failed", 404)
+						return
+					}
+					oldText := storedMsg.Text
+					storedMsg.Text, storedMsg.Version = edited.Text, edited.Version
+					audit(r, user.Login, AUDIT_MESSAGE_EDIT, storedMsg.Parent.Id, storedMsg.Id, oldText, storedMsg.Text)
+					if hold != nil {
+						storedMsg.Held = true
+						err = storedMsg.SaveHeld()
+						if err == nil {
+							err = holdForModeration(hold, storedMsg.Parent, storedMsg)
+						}
+						if err != nil {
+							logError("BD ERROR: Falló retener el mensaje", "msg", storedMsg.Id, "error", err)
+						}
 					}
-					storedMsg.Text = auxMsg.Text
 					w.Header().Set("Content-Type", "application/json")
+					w.Header().Set("ETag", messageETag(storedMsg))
 					json.NewEncoder(w).Encode(storedMsg)
 				} else {
-					a.jsonerror(w, fmt.Sprintf("%s", err), 404)
+					a.invalidRequest(w, err, fmt.Sprintf("%s", err))
 				}
 			} else {
 				a.jsonerror(w, "Unknow msg id or bad author", 404)
@@ -100,30 +140,59 @@ func (a *api) updateMessageInThread(w http.ResponseWriter, r *http.Request) {
 func (a *api) addMessageToThread(w http.ResponseWriter, r *http.Request) {
 	user := GetUserFromSession(r)
 	if user != nil {
+		if !a.checkCanWrite(w, user) {
+			return
+		}
+		if !a.checkRateLimit(w, messagesLimiter, user.Login) {
+			return
+		}
 		vars := mux.Vars(r)
 		key := vars["ThreadKey"]
 		thread := board.getThread(key)
+		if thread == nil {
+			a.jsonerror(w, "Unknow thread key", 404)
+			return
+		}
 		if thread.IsClosed {
 			a.jsonerror(w, "Error: Thread is closed", 404)
 			return
 		}
 		m := NewMessage("", "")
-		err := json.NewDecoder(r.Body).Decode(m)
+		err := decodeBody(r, m)
+		if err == nil {
+			err = validateMessage(m.Text)
+		}
+		var hold *FilterRule
+		if err == nil {
+			m.Text, hold, err = applyFilters("text", "El mensaje", m.Text, user)
+		}
 		if err == nil && thread != nil && m != nil {
+			if m.ReplyTo != 0 && thread.getMessage(m.ReplyTo) == nil {
+				a.jsonerror(w, "Bad reply msg id", 404)
+				return
+			}
 			m.Parent = thread
 			m.Author = user.Login
+			m.Held = (hold != nil)
 			err = m.Save(false)
 			if err != nil {
-				logEvent(fmt.Sprintf("BD ERROR: Falló añadir el mensaje [%d] al hilo %s por %s: %s", m.Id, thread.Id, user.Login, err))
+				logError("BD ERROR: Falló añadir el mensaje", "msg", m.Id, "thread", thread.Id, "user", user.Login, "error", err)
 				a.jsonerror(w, "Operation failed", 404)
 				return
 			}
 			m.Parent.addMessage(m)
-			logEvent(fmt.Sprintf("%s ha añadido el mensaje [%d] al hilo %s", user.Login, m.Id, thread.Id))
+			logInfo("Mensaje añadido", "user", user.Login, "msg", m.Id, "thread", thread.Id)
+			audit(r, user.Login, AUDIT_MESSAGE_CREATE, thread.Id, m.Id, "", m.Text)
+			if hold != nil {
+				err = holdForModeration(hold, thread, m)
+				if err != nil {
+					logError("BD ERROR: Falló enviar a moderación el mensaje", "msg", m.Id, "error", err)
+				}
+			}
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(m)
 		} else {
-			a.jsonerror(w, "Bad request payload", 404)
+			a.invalidRequest(w, err, "Bad request payload")
 		}
 	} else {
 		a.jsonerror(w, "Usuario no autenticado. Token desconocido", 404)
@@ -137,6 +206,9 @@ func (a *api) fetchThread(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		key := vars["ThreadKey"]
 		thread := board.getThread(key)
+		if thread != nil {
+			thread = visibleThread(thread, user)
+		}
 		if thread != nil {
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(thread)
@@ -152,20 +224,24 @@ func (a *api) fetchThread(w http.ResponseWriter, r *http.Request) {
 func (a *api) deleteThread(w http.ResponseWriter, r *http.Request) {
 	user := GetUserFromSession(r)
 	if user != nil {
+		if !a.checkCanWrite(w, user) {
+			return
+		}
 		vars := mux.Vars(r)
 		key := vars["ThreadKey"]
 		thread := board.getThread(key)
-		if (thread.Author != user.Login) && (!user.IsAdmin) {
+		if thread != nil && !can(user, PERM_DELETE, thread, nil) {
 			a.jsonerror(w, "Operación no autorizada", 404)
 			return
 		}
 		if thread != nil {
-			err:=thread.Delete()
+			err := thread.Delete()
 			board.delThread(thread)
-			if err!=nil{
-				logEvent(fmt.Sprintf("BD ERROR: Fallo el borrado del hilo %s por parte de %s", thread.Id, user.Login))
-			}else{
-				logEvent(fmt.Sprintf("%s ha borrado el hilo %s", user.Login, thread.Id))
+			if err != nil {
+				logError("BD ERROR: Falló el borrado del hilo", "thread", thread.Id, "user", user.Login, "error", err)
+			} else {
+				logInfo("Hilo borrado", "user", user.Login, "thread", thread.Id)
+				audit(r, user.Login, AUDIT_THREAD_DELETE, thread.Id, 0, thread.Title, "")
 			}
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(thread)
@@ -182,21 +258,57 @@ func (a *api) deleteThread(w http.ResponseWriter, r *http.Request) {
 func (a *api) operateWithThread(w http.ResponseWriter, r *http.Request) {
 	user := GetUserFromSession(r)
 	if user != nil {
+		if !a.checkCanWrite(w, user) {
+			return
+		}
 		vars := mux.Vars(r)
 		key := vars["ThreadKey"]
 		command := vars["Cmd"]
 		thread := board.getThread(key)
-		if thread != nil && user.IsAdmin {
-			if command == "close" || command == "open" {
+		perm := ""
+		switch command {
+		case "close", "open":
+			perm = PERM_CLOSE
+		case "fixed", "free":
+			perm = PERM_FIX
+		default:
+			a.jsonerror(w, "Unknown command", 404)
+			return
+		}
+		if thread != nil && can(user, perm, thread, nil) {
+			status := command
+			switch command {
+			case "close", "open":
 				thread.IsClosed = (command == "close")
-			}
-
-			if command == "fixed" || command == "free" {
-				thread.IsFixed = (command == "fixed")
+			case "free":
+				thread.Unpin()
+			case "fixed":
+				// sin payload se fija sin caducidad ni orden
+				pin := PinRequest{}
+				if r.ContentLength != 0 {
+					err := decodeBody(r, &pin)
+					if err == nil {
+						err = validatePin(pin)
+					}
+					if err != nil {
+						a.invalidRequest(w, err, "Bad pin payload")
+						return
+					}
+				}
+				if pin.Announcement && !thread.Announcement {
+					err := clearAnnouncementAcks(thread.Id)
+					if err != nil {
+						logError("BD ERROR: Falló olvidar las confirmaciones del anuncio", "thread", thread.Id, "error", err)
+					}
+				}
+				thread.Pin(pin)
+				status = thread.pinStatus()
 			}
 			err := thread.Update()
-			if err!=nil{
-				logEvent(fmt.Sprintf("BD ERROR: Falló actualizar el modo del hilo hilo %s: %s", thread.Id,err))
+			if err != nil {
+				logError("BD ERROR: Falló actualizar el modo del hilo", "thread", thread.Id, "error", err)
+			} else {
+				audit(r, user.Login, AUDIT_THREAD_STATUS, thread.Id, 0, "", status)
 			}
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(thread)
@@ -208,13 +320,163 @@ func (a *api) operateWithThread(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Cambia el título de un hilo
+func (a *api) renameThread(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if user != nil {
+		if !a.checkCanWrite(w, user) {
+			return
+		}
+		vars := mux.Vars(r)
+		thread := board.getThread(vars["ThreadKey"])
+		if thread == nil || !can(user, PERM_RESTRUCTURE, thread, nil) {
+			a.jsonerror(w, "Bad thread key or bad user", 404)
+			return
+		}
+		var title string
+		err := decodeBody(r, &title)
+		if err == nil {
+			err = validateTitle(title)
+		}
+		if err != nil {
+			a.invalidRequest(w, err, "Bad request payload")
+			return
+		}
+		oldTitle := thread.Title
+		err = board.renameThread(thread, title)
+		if err != nil {
+			logError("BD ERROR: Falló renombrar el hilo", "thread", thread.Id, "user", user.Login, "error", err)
+			a.jsonerror(w, "Operation failed", 404)
+			return
+		}
+		logInfo("Hilo renombrado", "user", user.Login, "thread", thread.Id, "old", oldTitle, "new", title)
+		audit(r, user.Login, AUDIT_THREAD_RENAME, thread.Id, 0, oldTitle, title)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(thread)
+	} else {
+		a.jsonerror(w, "Usuario no autenticado. Token desconocido", 404)
+	}
+}
+
+// Fusiona el hilo SrcKey dentro del hilo ThreadKey
+func (a *api) mergeThreads(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if user != nil {
+		if !a.checkCanWrite(w, user) {
+			return
+		}
+		vars := mux.Vars(r)
+		dst := board.getThread(vars["ThreadKey"])
+		src := board.getThread(vars["SrcKey"])
+		if dst == nil || src == nil || !can(user, PERM_RESTRUCTURE, dst, nil) || !can(user, PERM_RESTRUCTURE, src, nil) {
+			a.jsonerror(w, "Bad thread key or bad user", 404)
+			return
+		}
+		err := board.mergeThreads(dst, src)
+		if err != nil {
+			logWarn("Falló fusionar los hilos", "src", src.Id, "dst", dst.Id, "user", user.Login, "error", err)
+			a.jsonerror(w, fmt.Sprintf("%s", err), 404)
+			return
+		}
+		logInfo("Hilos fusionados", "user", user.Login, "src", src.Id, "dst", dst.Id)
+		audit(r, user.Login, AUDIT_THREAD_MERGE, dst.Id, 0, src.Id, dst.Id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dst)
+	} else {
+		a.jsonerror(w, "Usuario no autenticado. Token desconocido", 404)
+	}
+}
+
+// Divide un hilo a partir del mensaje MsgId. El título del nuevo hilo viaja
+// en el payload
+func (a *api) splitThread(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if user != nil {
+		if !a.checkCanWrite(w, user) {
+			return
+		}
+		vars := mux.Vars(r)
+		thread := board.getThread(vars["ThreadKey"])
+		id, err := strconv.Atoi(vars["MsgId"])
+		if thread == nil || err != nil || !can(user, PERM_RESTRUCTURE, thread, nil) {
+			a.jsonerror(w, "Bad thread key or bad user", 404)
+			return
+		}
+		m := thread.getMessage(id)
+		if m == nil {
+			a.jsonerror(w, "Bad msg id", 404)
+			return
+		}
+		var title string
+		err = decodeBody(r, &title)
+		if err == nil {
+			err = validateTitle(title)
+		}
+		if err != nil {
+			a.invalidRequest(w, err, "Bad request payload")
+			return
+		}
+		nt, err := board.splitThread(thread, m, title)
+		if err != nil {
+			logWarn("Falló dividir el hilo", "thread", thread.Id, "msg", m.Id, "user", user.Login, "error", err)
+			a.jsonerror(w, fmt.Sprintf("%s", err), 404)
+			return
+		}
+		logInfo("Hilo dividido", "user", user.Login, "thread", thread.Id, "msg", m.Id, "new", nt.Id)
+		audit(r, user.Login, AUDIT_THREAD_SPLIT, thread.Id, m.Id, thread.Id, nt.Id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(nt)
+	} else {
+		a.jsonerror(w, "Usuario no autenticado. Token desconocido", 404)
+	}
+}
+
+// Mueve un mensaje a otro hilo
+func (a *api) moveMessage(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if user != nil {
+		if !a.checkCanWrite(w, user) {
+			return
+		}
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["MsgId"])
+		dst := board.getThread(vars["ThreadKey"])
+		if err != nil || dst == nil || !can(user, PERM_RESTRUCTURE, dst, nil) {
+			a.jsonerror(w, "Bad msg id or bad user", 404)
+			return
+		}
+		m := board.getMessage(id)
+		if m == nil {
+			a.jsonerror(w, "Bad msg id", 404)
+			return
+		}
+		if !can(user, PERM_RESTRUCTURE, m.Parent, nil) {
+			a.jsonerror(w, "Bad msg id or bad user", 404)
+			return
+		}
+		src := m.Parent
+		err = board.moveMessage(m, dst)
+		if err != nil {
+			logWarn("Falló mover el mensaje", "msg", m.Id, "dst", dst.Id, "user", user.Login, "error", err)
+			a.jsonerror(w, fmt.Sprintf("%s", err), 404)
+			return
+		}
+		logInfo("Mensaje movido", "user", user.Login, "msg", m.Id, "src", src.Id, "dst", dst.Id)
+		audit(r, user.Login, AUDIT_MESSAGE_MOVE, dst.Id, m.Id, src.Id, dst.Id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m)
+	} else {
+		a.jsonerror(w, "Usuario no autenticado. Token desconocido", 404)
+	}
+}
+
 // Recupera el tablón
 func (a *api) fetchBoard(w http.ResponseWriter, r *http.Request) {
 	user := GetUserFromSession(r)
 	if user != nil {
 		w.WriteHeader(200)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(board)
+		json.NewEncoder(w).Encode(&Board{Threads: visibleThreads(board.Threads, user)})
 	} else {
 		a.jsonerror(w, "Usuario no autenticado. Token desconocido", 404)
 	}
@@ -226,7 +488,7 @@ func (a *api) filterBoard(w http.ResponseWriter, r *http.Request) {
 	if user != nil {
 		vars := mux.Vars(r)
 		pattern := vars["Pattern"]
-		filteredThreads := board.filterThreads(pattern)
+		filteredThreads := visibleThreads(board.filterThreads(pattern), user)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(filteredThreads)
 	} else {
@@ -239,16 +501,42 @@ func (a *api) filterBoard(w http.ResponseWriter, r *http.Request) {
 func (a *api) addThreadToBoard(w http.ResponseWriter, r *http.Request) {
 	user := GetUserFromSession(r)
 	if user != nil {
+		if !a.checkCanWrite(w, user) {
+			return
+		}
+		if !a.checkRateLimit(w, threadsLimiter, user.Login) {
+			return
+		}
 		var title string
-		json.NewDecoder(r.Body).Decode(&title)
+		err := decodeBody(r, &title)
+		if err == nil {
+			err = validateTitle(title)
+		}
+		var hold *FilterRule
+		if err == nil {
+			title, hold, err = applyFilters("title", "El título", title, user)
+		}
+		if err != nil {
+			a.invalidRequest(w, err, "Bad request payload")
+			return
+		}
 		th := NewThread(title, nil)
 		th.Author = user.Login
+		th.Held = (hold != nil)
+		err = th.Save()
+		if err != nil {
+			logError("BD ERROR: Falló añadir el hilo", "thread", th.Id, "user", user.Login, "error", err)
+			a.jsonerror(w, "Operation failed", 500)
+			return
+		}
 		board.addThread(th)
-		err:=th.Save()
-		if err!=nil{
-			logEvent(fmt.Sprintf("BD ERROR: Fallo añdir hilo %s por parte del usuario %s", th.Id, user.Login))
-		}else{
-			logEvent(fmt.Sprintf("%s ha añadido el hilo %s", user.Login, th.Id))
+		logInfo("Hilo añadido", "user", user.Login, "thread", th.Id)
+		audit(r, user.Login, AUDIT_THREAD_CREATE, th.Id, 0, "", th.Title)
+		if hold != nil {
+			err = holdForModeration(hold, th, nil)
+			if err != nil {
+				logError("BD ERROR: Falló enviar a moderación el hilo", "thread", th.Id, "error", err)
+			}
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(th)
@@ -257,10 +545,16 @@ func (a *api) addThreadToBoard(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Retorna la info de un usuario
+// Retorna la info de un usuario. Cada usuario puede consultar la suya y
+// quien gestiona los usuarios la de cualquiera
 func (a *api) getUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	login := vars["Login"]
+	user := GetUserFromSession(r)
+	if user == nil || (user.Login != login && !can(user, PERM_MANAGE_USERS, nil, nil)) {
+		a.jsonerror(w, "Usuario no autenticado o no autorizado", 404)
+		return
+	}
 	var u *User
 	if u = board.GetUser(login); u == nil {
 		a.jsonerror(w, "User not exists in the database", 404)
@@ -271,48 +565,97 @@ func (a *api) getUser(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(u)
 }
 
+// Retorna la versión del servidor y de su API. No necesita sesión para que
+// el cliente pueda comprobar la compatibilidad antes de autenticarse
+func (a *api) version(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(VersionInfo{Version: VERSION, Api: API_VERSION})
+}
+
 // Verifica las credenciales de un usuario
 func (a *api) verifyUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	login := vars["Login"]
-	var u *User
-	if u = board.GetUser(login); u == nil {
-		logEvent(fmt.Sprintf("Se intenta acceder con usuario desconocido: %s", login))
-		a.jsonerror(w, "User not exists in the database", 404)
+	addr := remoteAddress(r)
+	if !a.checkRateLimit(w, loginsByAddrLimiter, addr) || !a.checkRateLimit(w, loginsByUserLimiter, login) {
+		logWarn("Demasiados intentos de inicio de sesión", "user", login, "remote", addr)
+		audit(r, login, AUDIT_LOGIN_FAILED, "", 0, "", "rate limit")
 		return
 	}
 	pass_s := ""
-	err := json.NewDecoder(r.Body).Decode(&pass_s)
+	err := decodeBody(r, &pass_s)
 	if err != nil {
-		logEvent(fmt.Sprintf("Se recibe mensaje con credenciales corrupto"))
-		a.jsonerror(w, "Bad createUser payload", 404)
+		logWarn("Se recibe mensaje con credenciales corrupto")
+		a.invalidRequest(w, err, "Bad createUser payload")
+		return
+	}
+	if !a.checkLoginLockout(w, login, addr) {
+		logWarn("Inicio de sesión bloqueado por intentos fallidos", "user", login, "remote", addr)
+		audit(r, login, AUDIT_LOGIN_FAILED, "", 0, "", "locked out")
 		return
 	}
 
-	if strings.Compare(fmt.Sprintf("%s", pass_s), fmt.Sprintf("%s", u.Password)) == 0 {
-		// Auth OK. Create session and send response with token
-		s := CreateSession(login)
-		w.Header().Set("Content-Type", "application/json")
-		logEvent(fmt.Sprintf("%s ha iniciado sesión", login))
-		w.WriteHeader(200)
-		json.NewEncoder(w).Encode(s.Id)
-	} else {
-		a.jsonerror(w, "Bad password", 404)
+	u := board.GetUser(login)
+	if u == nil || !u.CheckPassword(pass_s) {
+		if u == nil {
+			compareDummyPassword(pass_s)
+			logWarn("Se intenta acceder con usuario desconocido", "user", login)
+			audit(r, login, AUDIT_LOGIN_FAILED, "", 0, "", "unknown user")
+		} else {
+			logWarn("Inicio de sesión con una contraseña incorrecta", "user", login)
+			audit(r, login, AUDIT_LOGIN_FAILED, "", 0, "", "bad password")
+		}
+		loginFailed(login, addr)
+		a.jsonerror(w, LOGIN_FAILED_MESSAGE, http.StatusUnauthorized)
+		return
 	}
+	err = clearLoginFailures(LOCKOUT_USER, login)
+	if err != nil {
+		logError("BD ERROR: Falló borrar los intentos fallidos", "user", login, "error", err)
+	}
+
+	if !u.CanRead() {
+		logWarn("Inicio de sesión de un usuario bloqueado", "user", login)
+		audit(r, login, AUDIT_LOGIN_FAILED, "", 0, "", "banned")
+		a.jsonerror(w, u.BanMessage(), 403)
+		return
+	}
+	// Auth OK. Create session and send response with token
+	u.applyGroups()
+	s, err := CreateSession(r, login)
+	if err != nil {
+		logError("BD ERROR: Falló crear la sesión", "user", login, "error", err)
+		a.jsonerror(w, "No se pudo crear la sesión", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	logInfo("Sesión iniciada", "user", login)
+	audit(r, login, AUDIT_LOGIN, "", 0, "", "")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(s.Token)
 }
 
 func (a *api) changePassword(w http.ResponseWriter, r *http.Request) {
 	user := GetUserFromSession(r)
 	if user != nil {
 		newpass_s := ""
-		err := json.NewDecoder(r.Body).Decode(&newpass_s)
+		err := decodeBody(r, &newpass_s)
+		if err != nil {
+			a.invalidRequest(w, err, "Bad createUser payload")
+			return
+		}
+		if newpass_s == "" {
+			a.jsonerror(w, "La contraseña no puede estar vacía", 400)
+			return
+		}
+		err = user.SetPassword(newpass_s)
 		if err != nil {
-			a.jsonerror(w, "Bad createUser payload", 404)
+			logError("No se pudo guardar la contraseña", "user", user.Login, "error", err)
+			a.jsonerror(w, "No se pudo guardar la contraseña", 500)
 			return
 		}
-		user.Password = []byte(newpass_s)
-		user.Save(true)
-		logEvent(fmt.Sprintf("%s ha actualizado su contraseña", user.Login))
+		logInfo("Contraseña actualizada", "user", user.Login)
+		audit(r, user.Login, AUDIT_PASSWORD, "", 0, "", "")
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(user)
 	} else {
@@ -320,12 +663,85 @@ func (a *api) changePassword(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Cierra la sesión de la petición
+func (a *api) logout(w http.ResponseWriter, r *http.Request) {
+	session := requestSession(r)
+	if session == nil {
+		a.jsonerror(w, "Usuario no autenticado. Token desconocido", 404)
+		return
+	}
+	err := sessions.Delete(session.Id)
+	if err != nil {
+		logError("BD ERROR: Falló cerrar la sesión", "user", session.User, "error", err)
+		a.jsonerror(w, "Operation failed", 500)
+		return
+	}
+	logInfo("Sesión cerrada", "user", session.User)
+	audit(r, session.User, AUDIT_LOGOUT, "", 0, "", "")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode("")
+}
+
+// Lista las sesiones abiertas del usuario, marcando la de la petición
+func (a *api) listSessions(w http.ResponseWriter, r *http.Request) {
+	session := requestSession(r)
+	user := GetUserFromSession(r)
+	if session == nil || user == nil {
+		a.jsonerror(w, "Usuario no autenticado. Token desconocido", 404)
+		return
+	}
+	list, err := sessions.List(user.Login)
+	if err != nil {
+		logError("BD ERROR: Falló leer las sesiones", "user", user.Login, "error", err)
+		a.jsonerror(w, "Operation failed", 500)
+		return
+	}
+	now := time.Now()
+	active := make([]*Session, 0, len(list))
+	for _, s := range list {
+		if !s.Expired(now) {
+			s.Current = (s.Id == session.Id)
+			active = append(active, s)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(active)
+}
+
+// Revoca una de las sesiones del usuario
+func (a *api) revokeSession(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if user == nil {
+		a.jsonerror(w, "Usuario no autenticado. Token desconocido", 404)
+		return
+	}
+	id := mux.Vars(r)["SessionId"]
+	s, err := sessions.Get(id)
+	if err == nil && (s == nil || s.User != user.Login) {
+		a.jsonerror(w, "La sesión no existe", 404)
+		return
+	}
+	if err == nil {
+		err = sessions.Delete(id)
+	}
+	if err != nil {
+		logError("BD ERROR: Falló revocar la sesión", "user", user.Login, "error", err)
+		a.jsonerror(w, "Operation failed", 500)
+		return
+	}
+	logInfo("Sesión revocada", "user", user.Login, "remote", s.Remote)
+	audit(r, user.Login, AUDIT_SESSION_REVOKE, "", 0, s.Remote+" "+s.Created.Format(time.RFC3339), "")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode("")
+}
+
 // Recarga toda la tabla de usuarios
 func (a *api) reloadUsers(w http.ResponseWriter, r *http.Request) {
 	user := GetUserFromSession(r)
-	if user != nil && user.IsAdmin {
+	if can(user, PERM_MANAGE_USERS, nil, nil) {
 		board.LoadUsers()
-		logEvent("Se carga tabla de usuarios en el servidor")
+		logInfo("Se carga tabla de usuarios en el servidor")
+		audit(r, user.Login, AUDIT_USERS_RELOAD, "", 0, "", "")
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(200)
 		json.NewEncoder(w).Encode("")
@@ -334,6 +750,209 @@ func (a *api) reloadUsers(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Lista todos los usuarios. Solo para administradores
+func (a *api) listUsers(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if can(user, PERM_MANAGE_USERS, nil, nil) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(board.Users)
+	} else {
+		a.jsonerror(w, "Usuario no autenticado o no autorizado", 404)
+	}
+}
+
+// Crea un usuario nuevo con una contraseña aleatoria que se retorna en la
+// respuesta. Solo para administradores
+func (a *api) createUser(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if can(user, PERM_MANAGE_USERS, nil, nil) {
+		if !a.checkCanWrite(w, user) {
+			return
+		}
+		login := ""
+		err := decodeBody(r, &login)
+		if err == nil {
+			err = validateLogin(login)
+		}
+		if err != nil {
+			a.invalidRequest(w, err, "Bad createUser payload")
+			return
+		}
+		cred, err := board.createUser(login)
+		if err != nil {
+			logWarn("Falló crear el usuario", "login", login, "user", user.Login, "error", err)
+			a.jsonerror(w, fmt.Sprintf("%s", err), 404)
+			return
+		}
+		logInfo("Usuario creado", "user", user.Login, "login", login)
+		audit(r, user.Login, AUDIT_USER_CREATE, "", 0, "", login)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cred)
+	} else {
+		a.jsonerror(w, "Usuario no autenticado o no autorizado", 404)
+	}
+}
+
+// Payload opcional de la operación ban. Sin payload el bloqueo es total y
+// no caduca
+type BanRequest struct {
+	Level   int       `json:"level"`
+	Reason  string    `json:"reason"`
+	Expires time.Time `json:"expires"`
+}
+
+// Ejecuta una operación de administración sobre un usuario. El valor de Cmd
+// puede ser: ban|unban|promote|demote|resetpassword|revoke|unlock. Solo
+// para administradores
+func (a *api) operateWithUser(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	vars := mux.Vars(r)
+	command := vars["Cmd"]
+	perm := PERM_MANAGE_USERS
+	if command == "ban" || command == "unban" {
+		perm = PERM_BAN
+	}
+	if can(user, perm, nil, nil) {
+		if !a.checkCanWrite(w, user) {
+			return
+		}
+		u := board.GetUser(vars["Login"])
+		if u == nil {
+			a.jsonerror(w, "User not exists in the database", 404)
+			return
+		}
+		if u == user && (command == "ban" || command == "demote") {
+			a.jsonerror(w, "Un administrador no puede bloquearse o degradarse a sí mismo", 404)
+			return
+		}
+
+		var err error
+		var response interface{} = u
+		oldStatus := userStatus(u)
+		switch command {
+		case "ban":
+			ban := BanRequest{Level: BAN_FULL}
+			if r.ContentLength != 0 {
+				err = decodeBody(r, &ban)
+			}
+			if err == nil {
+				err = validateReason(ban.Reason)
+			}
+			if err != nil || (ban.Level != BAN_READONLY && ban.Level != BAN_FULL) {
+				a.invalidRequest(w, err, "Bad ban payload")
+				return
+			}
+			u.Ban(ban.Level, ban.Reason, user.Login, ban.Expires)
+			err = u.Save(true)
+			if err == nil && ban.Level == BAN_FULL {
+				err = DeleteUserSessions(u.Login)
+			}
+		case "revoke":
+			err = DeleteUserSessions(u.Login)
+		case "unlock":
+			err = clearLoginFailures(LOCKOUT_USER, u.Login)
+		case "unban":
+			u.Unban()
+			err = u.Save(true)
+		case "promote", "demote":
+			err = u.setAdmin(command == "promote")
+			if err != nil {
+				a.jsonerror(w, err.Error(), 404)
+				return
+			}
+			err = u.Save(true)
+		case "resetpassword":
+			response, err = board.resetPassword(u)
+		default:
+			a.jsonerror(w, "Unknown command", 404)
+			return
+		}
+		if err != nil {
+			logError("BD ERROR: Falló la operación sobre el usuario", "command", command, "login", u.Login, "user", user.Login, "error", err)
+			a.jsonerror(w, "Operation failed", 404)
+			return
+		}
+		logInfo("Operación sobre el usuario", "user", user.Login, "command", command, "login", u.Login)
+		audit(r, user.Login, AUDIT_USER_PREFIX+command, "", 0, u.Login+" "+oldStatus, u.Login+" "+userStatus(u))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	} else {
+		a.jsonerror(w, "Usuario no autenticado o no autorizado", 404)
+	}
+}
+
+// Consulta el registro de auditoría. Admite los parámetros actor, action,
+// from y to (fechas AAAA-MM-DD, to incluido) y limit. Solo para administradores
+func (a *api) queryAudit(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if can(user, PERM_AUDIT, nil, nil) {
+		q := r.URL.Query()
+		filter := AuditFilter{Actor: q.Get("actor"), Action: q.Get("action")}
+		var err error
+		if from := q.Get("from"); from != "" {
+			filter.From, err = time.ParseInLocation("2006-01-02", from, time.Local)
+		}
+		if to := q.Get("to"); to != "" && err == nil {
+			filter.To, err = time.ParseInLocation("2006-01-02", to, time.Local)
+			filter.To = filter.To.AddDate(0, 0, 1)
+		}
+		if limit := q.Get("limit"); limit != "" && err == nil {
+			filter.Limit, err = strconv.Atoi(limit)
+		}
+		if err != nil {
+			a.jsonerror(w, "Bad audit filter", 404)
+			return
+		}
+		records, err := QueryAudit(filter)
+		if err != nil {
+			logError("BD ERROR: Falló consultar el registro de auditoría", "error", err)
+			a.jsonerror(w, "Operation failed", 404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(records)
+	} else {
+		a.jsonerror(w, "Usuario no autenticado o no autorizado", 404)
+	}
+}
+
+// Resumen del estado de un usuario para el registro de auditoría
+func userStatus(u *User) string {
+	status := fmt.Sprintf("admin=%t ban=%d", u.storedAdmin, u.BanLevel)
+	if len(u.Roles) > 0 {
+		status += fmt.Sprintf(" roles=%q", grantsString(u.Roles))
+	}
+	if u.BanReason != "" {
+		status += fmt.Sprintf(" reason=%q", u.BanReason)
+	}
+	return status
+}
+
+// Comprueba que el usuario no esté bloqueado para escribir. Si lo está
+// responde con el motivo del bloqueo y retorna false
+func (a *api) checkCanWrite(w http.ResponseWriter, user *User) bool {
+	if user.CanWrite() {
+		return true
+	}
+	a.jsonerror(w, user.BanMessage(), 403)
+	return false
+}
+
+// Comprueba que la petición no supere el límite del limitador para esa clave.
+// Si lo supera responde con un 429 indicando cuándo volver a intentarlo y
+// retorna false
+func (a *api) checkRateLimit(w http.ResponseWriter, rl *RateLimiter, key string) bool {
+	ok, retry := rl.Allow(key)
+	if ok {
+		return true
+	}
+	metrics.rateLimitRejected(rl.Name)
+	seconds := int(math.Ceil(retry.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	a.jsonerror(w, fmt.Sprintf("Demasiadas peticiones. Inténtelo de nuevo en %d segundos", seconds), http.StatusTooManyRequests)
+	return false
+}
+
 // Genera respuesta de error
 func (a *api) jsonerror(w http.ResponseWriter, err interface{}, code int) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -344,6 +963,7 @@ func (a *api) jsonerror(w http.ResponseWriter, err interface{}, code int) {
 
 type Server interface {
 	Router() http.Handler
+	AdminRouter() http.Handler
 }
 
 func NewServer() Server {
@@ -351,6 +971,9 @@ func NewServer() Server {
 
 	r := mux.NewRouter()
 
+	r.HandleFunc("/version", a.version).Methods(http.MethodGet)
+	r.HandleFunc("/local/session", a.localAuth).Methods(http.MethodPost)
+
 	// board:
 	r.HandleFunc("/board", a.fetchBoard).Methods(http.MethodGet)
 	r.HandleFunc("/board", a.addThreadToBoard).Methods(http.MethodPost)
@@ -360,18 +983,59 @@ func NewServer() Server {
 	// threads:
 	r.HandleFunc("/threads/{ThreadKey:[a-zA-Z0-9_]+}", a.fetchThread).Methods(http.MethodGet)
 	r.HandleFunc("/threads/{ThreadKey:[a-zA-Z0-9_]+}", a.addMessageToThread).Methods(http.MethodPut)
+	r.HandleFunc("/threads/{ThreadKey:[a-zA-Z0-9_]+}/rename", a.renameThread).Methods(http.MethodPut)
+	r.HandleFunc("/threads/{ThreadKey:[a-zA-Z0-9_]+}/merge/{SrcKey:[a-zA-Z0-9_]+}", a.mergeThreads).Methods(http.MethodPut)
+	r.HandleFunc("/threads/{ThreadKey:[a-zA-Z0-9_]+}/split/{MsgId:[0-9]+}", a.splitThread).Methods(http.MethodPut)
+	r.HandleFunc("/threads/{ThreadKey:[a-zA-Z0-9_]+}/category", a.setThreadCategory).Methods(http.MethodPut)
 	r.HandleFunc("/threads/{ThreadKey:[a-zA-Z0-9_]+}/{Cmd:[a-z]+}", a.operateWithThread).Methods(http.MethodPut)
 	r.HandleFunc("/threads/{ThreadKey:[a-zA-Z0-9_]+}", a.deleteThread).Methods(http.MethodDelete)
 
 	// messages:
 	r.HandleFunc("/messages/{MsgId:[0-9]+}", a.deleteMessage).Methods(http.MethodDelete)
 	r.HandleFunc("/messages/{MsgId:[0-9]+}", a.updateMessageInThread).Methods(http.MethodPut)
+	r.HandleFunc("/messages/{MsgId:[0-9]+}/move/{ThreadKey:[a-zA-Z0-9_]+}", a.moveMessage).Methods(http.MethodPut)
+	r.HandleFunc("/messages/{MsgId:[0-9]+}/report", a.reportMessage).Methods(http.MethodPost)
+
+	// reports:
+	r.HandleFunc("/reports", a.listOwnReports).Methods(http.MethodGet)
+	r.HandleFunc("/reports/notified", a.ackReports).Methods(http.MethodPut)
+	r.HandleFunc("/announcements", a.listAnnouncements).Methods(http.MethodGet)
+	r.HandleFunc("/announcements/{ThreadKey:[a-zA-Z0-9_]+}/ack", a.ackAnnouncement).Methods(http.MethodPut)
 
 	// users:
 	r.HandleFunc("/users/{Login:[a-zA-Z0-9_]+}", a.verifyUser).Methods(http.MethodPost)
 	r.HandleFunc("/users/{Login:[a-zA-Z0-9_]+}", a.getUser).Methods(http.MethodGet)
 	r.HandleFunc("/users/{Login:[a-zA-Z0-9_]+}/changePassword", a.changePassword).Methods(http.MethodPut)
 
+	// sessions
+	r.HandleFunc("/logout", a.logout).Methods(http.MethodPost)
+	r.HandleFunc("/sessions", a.listSessions).Methods(http.MethodGet)
+	r.HandleFunc("/sessions/{SessionId:[a-f0-9]+}", a.revokeSession).Methods(http.MethodDelete)
+
+	// admin:
+	r.HandleFunc("/admin/users", a.listUsers).Methods(http.MethodGet)
+	r.HandleFunc("/admin/users", a.createUser).Methods(http.MethodPost)
+	r.HandleFunc("/admin/users/{Login:[a-zA-Z0-9_]+}/roles", a.setUserRoles).Methods(http.MethodPut)
+	r.HandleFunc("/admin/users/{Login:[a-zA-Z0-9_]+}/{Cmd:[a-z]+}", a.operateWithUser).Methods(http.MethodPut)
+	r.HandleFunc("/admin/lockouts/{Addr:[0-9a-fA-F.:]+}", a.unlockAddress).Methods(http.MethodPut)
+	r.HandleFunc("/admin/audit", a.queryAudit).Methods(http.MethodGet)
+	r.HandleFunc("/admin/reports", a.listReports).Methods(http.MethodGet)
+	r.HandleFunc("/admin/reports/{ReportId:[0-9]+}/{Cmd:[a-z]+}", a.moderateReport).Methods(http.MethodPut)
+	r.HandleFunc("/admin/filters", a.listFilters).Methods(http.MethodGet)
+	r.HandleFunc("/admin/filters", a.saveFilter).Methods(http.MethodPost)
+	r.HandleFunc("/admin/filters/{RuleId:[0-9]+}", a.saveFilter).Methods(http.MethodPut)
+	r.HandleFunc("/admin/filters/{RuleId:[0-9]+}", a.deleteFilter).Methods(http.MethodDelete)
+
+	// salud y métricas, aquí si no tienen una dirección propia
+	if AdminListenAddress == "" {
+		a.addAdminRoutes(r)
+	}
+
+	r.Use(a.lockConfig)
+	r.Use(a.applyPins)
+	r.Use(a.logRequests)
+	r.Use(a.limitBody)
+
 	a.router = r
 	return a
 }
@@ -380,14 +1044,32 @@ func (a *api) Router() http.Handler {
 	return a.router
 }
 
+// Router del servidor de administración con las rutas de salud y métricas
+func (a *api) AdminRouter() http.Handler {
+	r := mux.NewRouter()
+	a.addAdminRoutes(r)
+	return r
+}
+
 var board *Board
 var mutex sync.Mutex
 
 
+// Se activa al cerrar la base de datos para detener el servidor
+var databaseClosed bool
+
+var ErrDatabaseClosed = errors.New("La base de datos está cerrada")
+
+// Abre la conexión tomando el mutex. Si falla lo suelta y retorna el error;
+// CloseConnection con la conexión nil no hace nada
 func GetConnection() (*sql.DB,error) {
 	
 	mutex.Lock()
-	db, err := sql.Open("sqlite3", dbPathFile)
+	if databaseClosed {
+		mutex.Unlock()
+		return nil, ErrDatabaseClosed
+	}
+	db, err := sql.Open(DB_DRIVER, DatabasePath)
 	if err != nil {
 		mutex.Unlock()
 		return nil, err
@@ -396,56 +1078,135 @@ func GetConnection() (*sql.DB,error) {
 }
 
 func CloseConnection(db *sql.DB){
-
+	if db == nil {
+		return
+	}
 	mutex.Unlock();
 	db.Close()
 }
 
-const PORT = 8080
-
-var dbPathFile = "../data/gbb.db"
-var logFile *os.File
-var logFileName = "gbb.log"
-var logDirectory = "/var/log/gbb"
-var SERVER = "http://localhost:" + fmt.Sprintf("%d", PORT)
+// Ejecuta f dentro de una transacción. Si f retorna un error se deshacen
+// todos los cambios
+func WithTransaction(f func(tx *sql.Tx) error) error {
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		return err
+	}
 
-func InitLog(enable bool) {
-	if enable {
-		err := os.MkdirAll(logDirectory, os.ModePerm)
-		if err != nil {
-			return
-		}
-		logFile, err := os.OpenFile(filepath.Join(logDirectory, logFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
-		if err != nil {
-			panic(err)
-		}
-		log.SetOutput(logFile)
-	} else {
-		log.SetOutput(ioutil.Discard)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = f(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
+	return tx.Commit()
 }
 
-func logEvent(text string) {
-	log.Printf("%s\n", text)
+const VERSION = "1.2"
+
+// Versión de la API. Cambia cuando un cliente y un servidor con distinto
+// valor dejan de entenderse
+const API_VERSION = 2
+
+type VersionInfo struct {
+	Version string `json:"version"`
+	Api     int    `json:"api"`
 }
 
-func ServerInit(dir string) {
+// Dirección en la que escucha el servidor
+var ListenAddress = ":8080"
+
+// Ruta de la base de datos. La configuración la hace absoluta
+var DatabasePath = "../data/gbb.db"
+
+// URL del servidor para el cliente
+var SERVER = "http://localhost:8080"
+
+func ServerInit() {
 
-	dbPathFile = filepath.Join(dir, dbPathFile)
 	board = CreateBoard()
 
-	InitLog(true)
+	err := InitLog(LogOptions)
+	if err != nil {
+		logError("No se pudo configurar el log, se usa stderr", "error", err)
+	}
 
-	logEvent("GBB Loading database from " + dbPathFile + " ...")
-	err := board.Load()
+	logInfo("GBB Loading database", "path", DatabasePath)
+	err = MigrateDatabase()
 	if err != nil {
-		logEvent("Error: Database not found. You must execute initdb to create the database file")
+		logError("Database schema can't be updated", "error", err)
 		os.Exit(-1)
 	}
-	logEvent("GBB Server running ...")
+	err = board.Load()
+	if err != nil {
+		logError("Database not found. You must execute initdb to create the database file", "error", err)
+		os.Exit(-1)
+	}
+	err = LoadFilterRules()
+	if err != nil {
+		logError("No se pudieron cargar las reglas de filtro", "error", err)
+		os.Exit(-1)
+	}
+	InitSessions()
+	InitRateLimiters()
+	InitPins()
 
-	InitSessionCache()
+	if ListenAddress == "" && SocketPath == "" {
+		logError("No hay dirección ni socket en los que escuchar")
+		os.Exit(-1)
+	}
 
 	s := NewServer()
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", PORT), s.Router()))
+	errc := make(chan error, 3)
+	servers := []*http.Server{}
+
+	// El socket local tiene su propio servidor y el certificado se carga antes
+	// de arrancar ninguno, así que nadie cambia un servidor que ya atiende
+	useTLS := (ListenAddress != "" && (TLSCertFile != "" || TLSKeyFile != ""))
+	var tlsConfig *tls.Config
+	if useTLS {
+		tlsConfig, err = serverTLSConfig()
+		if err != nil {
+			logError("No se pudo cargar el certificado TLS", "cert", TLSCertFile, "key", TLSKeyFile, "error", err)
+			os.Exit(-1)
+		}
+	}
+
+	if SocketPath != "" {
+		l, err := listenUnix(SocketPath)
+		if err != nil {
+			logError("No se pudo crear el socket local", "socket", SocketPath, "error", err)
+			os.Exit(-1)
+		}
+		local := &http.Server{Addr: SocketPath, Handler: s.Router(), ConnContext: peerContext}
+		servers = append(servers, local)
+		logInfo("GBB Server running", "socket", SocketPath, "version", VERSION)
+		go func() { errc <- local.Serve(l) }()
+	}
+
+	if ListenAddress != "" {
+		server := &http.Server{Addr: ListenAddress, Handler: s.Router(), ConnContext: peerContext, TLSConfig: tlsConfig}
+		servers = append(servers, server)
+		logInfo("GBB Server running", "listen", ListenAddress, "version", VERSION, "tls", useTLS)
+		go func() {
+			if useTLS {
+				errc <- server.ListenAndServeTLS("", "")
+			} else {
+				errc <- server.ListenAndServe()
+			}
+		}()
+	}
+
+	if AdminListenAddress != "" {
+		admin := &http.Server{Addr: AdminListenAddress, Handler: s.AdminRouter()}
+		logInfo("GBB Admin server running", "listen", AdminListenAddress)
+		go func() { errc <- admin.ListenAndServe() }()
+		servers = append(servers, admin)
+	}
+
+	serveSignals(errc, servers...)
 }
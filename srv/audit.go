@@ -0,0 +1,172 @@
+package srv
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+
+	Registro de auditoría
+
+	Cada operación que modifica el tablón o los usuarios, y cada inicio de
+	sesión, deja un registro en la tabla audit de la base de datos con quién
+	lo hizo, qué hizo, sobre qué hilo o mensaje, los valores anterior y
+	nuevo y desde qué dirección. Los administradores pueden consultarlo desde
+	la API con filtros.
+
+*/
+
+const (
+	AUDIT_LOGIN           = "login"
+	AUDIT_LOGIN_FAILED    = "login_failed"
+	AUDIT_LOGOUT          = "logout"
+	AUDIT_SESSION_REVOKE  = "session_revoke"
+	AUDIT_PASSWORD        = "password_change"
+	AUDIT_THREAD_CREATE   = "thread_create"
+	AUDIT_THREAD_DELETE   = "thread_delete"
+	AUDIT_THREAD_STATUS   = "thread_status"
+	AUDIT_THREAD_RENAME   = "thread_rename"
+	AUDIT_THREAD_MERGE    = "thread_merge"
+	AUDIT_THREAD_SPLIT    = "thread_split"
+	AUDIT_THREAD_CATEGORY = "thread_category"
+	AUDIT_MESSAGE_CREATE  = "message_create"
+	AUDIT_MESSAGE_EDIT    = "message_edit"
+	AUDIT_MESSAGE_DELETE  = "message_delete"
+	AUDIT_MESSAGE_MOVE    = "message_move"
+	AUDIT_USER_CREATE     = "user_create"
+	AUDIT_USER_PREFIX     = "user_" // seguido del comando de administración: ban, unban, revoke...
+	AUDIT_USERS_RELOAD    = "users_reload"
+	AUDIT_ADDR_UNLOCK     = "addr_unlock"
+	AUDIT_REPORT_CREATE   = "report_create"
+	AUDIT_REPORT_RESOLVE  = "report_resolve"
+	AUDIT_FILTER_CREATE   = "filter_create"
+	AUDIT_FILTER_UPDATE   = "filter_update"
+	AUDIT_FILTER_DELETE   = "filter_delete"
+)
+
+// Número máximo de registros que retorna una consulta
+const AUDIT_MAX_RECORDS = 500
+
+type AuditRecord struct {
+	Id       int       `json:"id"`
+	Stamp    time.Time `json:"stamp"`
+	Actor    string    `json:"actor"`
+	Action   string    `json:"action"`
+	Thread   string    `json:"thread"`
+	Message  int       `json:"message"`
+	OldValue string    `json:"old"`
+	NewValue string    `json:"new"`
+	Remote   string    `json:"remote"`
+}
+
+type AuditFilter struct {
+	Actor  string
+	Action string
+	From   time.Time // fecha cero para no limitar
+	To     time.Time // fecha cero para no limitar
+	Limit  int
+}
+
+// Guarda un registro de auditoría de la petición r. Un fallo al guardarlo no
+// interrumpe la operación auditada, solo queda en el log
+func audit(r *http.Request, actor string, action string, thread string, message int, oldValue string, newValue string) {
+	rec := &AuditRecord{
+		Stamp:    time.Now(),
+		Actor:    actor,
+		Action:   action,
+		Thread:   thread,
+		Message:  message,
+		OldValue: oldValue,
+		NewValue: newValue,
+		Remote:   remoteAddress(r),
+	}
+	if action == AUDIT_LOGIN_FAILED {
+		metrics.loginFailed(newValue)
+	}
+	err := rec.Save()
+	if err != nil {
+		logError("BD ERROR: Falló guardar el registro de auditoría", "action", action, "user", actor, "error", err)
+	}
+}
+
+func (rec *AuditRecord) Save() error {
+	q := `INSERT INTO audit (stamp, actor, action, thread, message, oldValue, newValue, remote)
+		VALUES (?,?,?,?,?,?,?,?);`
+
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		return err
+	}
+
+	statement, err := db.Prepare(q)
+	if err != nil {
+		return err
+	}
+	res, err := statement.Exec(rec.Stamp.UTC().Format(time.RFC3339), rec.Actor, rec.Action, rec.Thread, rec.Message, rec.OldValue, rec.NewValue, rec.Remote)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	rec.Id = int(id)
+	return err
+}
+
+// Retorna los registros que cumplen el filtro, del más reciente al más antiguo
+func QueryAudit(f AuditFilter) ([]*AuditRecord, error) {
+	conds := make([]string, 0)
+	args := make([]interface{}, 0)
+	if f.Actor != "" {
+		conds = append(conds, "actor=?")
+		args = append(args, f.Actor)
+	}
+	if f.Action != "" {
+		conds = append(conds, "action=?")
+		args = append(args, f.Action)
+	}
+	if !f.From.IsZero() {
+		conds = append(conds, "stamp>=?")
+		args = append(args, f.From.UTC().Format(time.RFC3339))
+	}
+	if !f.To.IsZero() {
+		conds = append(conds, "stamp<?")
+		args = append(args, f.To.UTC().Format(time.RFC3339))
+	}
+	if f.Limit <= 0 || f.Limit > AUDIT_MAX_RECORDS {
+		f.Limit = AUDIT_MAX_RECORDS
+	}
+
+	q := "SELECT id, stamp, actor, action, thread, message, oldValue, newValue, remote FROM audit"
+	if len(conds) > 0 {
+		q += " WHERE " + strings.Join(conds, " AND ")
+	}
+	q += " ORDER BY id DESC LIMIT ?;"
+	args = append(args, f.Limit)
+
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]*AuditRecord, 0)
+	for rows.Next() {
+		rec := new(AuditRecord)
+		stamp := ""
+		err = rows.Scan(&rec.Id, &stamp, &rec.Actor, &rec.Action, &rec.Thread, &rec.Message, &rec.OldValue, &rec.NewValue, &rec.Remote)
+		if err != nil {
+			return nil, err
+		}
+		rec.Stamp, _ = time.Parse(time.RFC3339, stamp)
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
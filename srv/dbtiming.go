@@ -0,0 +1,135 @@
+package srv
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+/*
+
+	Latencia de las consultas
+
+	GetConnection abre la base de datos con el driver gbb_sqlite3, que
+	envuelve al de sqlite3 para medir cada sentencia. Un Exec se mide hasta
+	que termina y un Query hasta que se cierran sus filas, así que incluye
+	leerlas. El tiempo esperando la conexión no cuenta.
+
+*/
+
+const DB_DRIVER = "gbb_sqlite3"
+
+func init() {
+	sql.Register(DB_DRIVER, timedDriver{&sqlite3.SQLiteDriver{}})
+}
+
+type timedDriver struct {
+	driver.Driver
+}
+
+func (d timedDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{c}, nil
+}
+
+// Conexión que prepara todas las sentencias, también las de Exec y Query,
+// para medirlas en timedStmt
+type timedConn struct {
+	driver.Conn
+}
+
+func (c *timedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var s driver.Stmt
+	var err error
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		s, err = p.PrepareContext(ctx, query)
+	} else {
+		s, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &timedStmt{s}, nil
+}
+
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+type timedStmt struct {
+	driver.Stmt
+}
+
+func (s *timedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	defer func() { metrics.observeDBQuery(time.Since(start)) }()
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return e.ExecContext(ctx, args)
+	}
+	return s.Stmt.Exec(namedValues(args))
+}
+
+func (s *timedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = q.QueryContext(ctx, args)
+	} else {
+		rows, err = s.Stmt.Query(namedValues(args))
+	}
+	if err != nil {
+		metrics.observeDBQuery(time.Since(start))
+		return nil, err
+	}
+	return &timedRows{Rows: rows, start: start}, nil
+}
+
+func namedValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, a := range args {
+		values[i] = a.Value
+	}
+	return values
+}
+
+// Filas de un Query. La consulta se anota al llegar al final o al cerrarlas
+type timedRows struct {
+	driver.Rows
+	start time.Time
+	done  bool
+}
+
+func (r *timedRows) observe() {
+	if !r.done {
+		r.done = true
+		metrics.observeDBQuery(time.Since(r.start))
+	}
+}
+
+func (r *timedRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err == io.EOF {
+		r.observe()
+	}
+	return err
+}
+
+func (r *timedRows) Close() error {
+	r.observe()
+	return r.Rows.Close()
+}
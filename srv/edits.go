@@ -0,0 +1,66 @@
+package srv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+
+	Ediciones concurrentes
+
+	Cada mensaje tiene una versión que aumenta con cada edición y que se
+	envía como ETag. Al editar, el cliente manda en If-Match la versión que
+	leyó. Si mientras tanto otro usuario lo ha cambiado, la edición se
+	rechaza con 409 y la versión actual del mensaje, para que el cliente
+	pueda mostrarla, mezclar los cambios o sobrescribirla enviando de nuevo
+	el texto con la versión recibida. Una edición sin If-Match se rechaza
+	con 428; con * se aplica sobre la versión que haya.
+
+*/
+
+// Respuesta a una edición sobre una versión antigua del mensaje
+type EditConflict struct {
+	Message string   `json:"error"`
+	Current *Message `json:"current"`
+}
+
+func (c *EditConflict) Error() string {
+	return c.Message
+}
+
+func messageETag(m *Message) string {
+	return fmt.Sprintf(`"%d"`, m.Version)
+}
+
+// Comprueba que la edición se hizo sobre la versión actual del mensaje. Si
+// no trae If-Match o no es así responde con el error y retorna false
+func (a *api) checkIfMatch(w http.ResponseWriter, r *http.Request, m *Message) bool {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		w.Header().Set("ETag", messageETag(m))
+		a.jsonerror(w, "Falta la cabecera If-Match con la versión del mensaje", http.StatusPreconditionRequired)
+		return false
+	}
+	if header == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == messageETag(m) {
+			return true
+		}
+	}
+	a.editConflict(w, m)
+	return false
+}
+
+func (a *api) editConflict(w http.ResponseWriter, m *Message) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", messageETag(m))
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(EditConflict{Message: ErrEditConflict.Error(), Current: m})
+}
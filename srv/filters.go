@@ -0,0 +1,485 @@
+package srv
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+
+	Filtros de contenido
+
+	Los administradores definen reglas que se aplican a los títulos de los
+	hilos nuevos y al texto de los mensajes nuevos o editados. Hay tres
+	tipos de regla:
+
+		word   una palabra o frase prohibida, sin distinguir mayúsculas
+		regex  una expresión regular
+		links  más de MaxLinks enlaces en un texto de una cuenta nueva, es
+		       decir, creada hace menos de NewAccountAge
+
+	Cada regla tiene una acción: reject rechaza el texto con un error de
+	validación, hold lo publica retenido, de forma que solo lo ven su autor
+	y los administradores hasta que se revisa en la cola de moderación, y
+	mask sustituye por asteriscos lo que coincide con la regla.
+
+	Una regla en modo de prueba (dryrun) no actúa: solo deja en el log lo
+	que habría hecho, para comprobar una regla nueva antes de activarla.
+
+	Las reglas se guardan en la tabla filter_rules y se mantienen en memoria.
+
+*/
+
+const (
+	FILTER_WORD  = "word"
+	FILTER_REGEX = "regex"
+	FILTER_LINKS = "links"
+
+	FILTER_REJECT = "reject"
+	FILTER_HOLD   = "hold"
+	FILTER_MASK   = "mask"
+)
+
+// Antigüedad por debajo de la cual una cuenta se considera nueva en las
+// reglas links
+var NewAccountAge = 7 * 24 * time.Hour
+
+type FilterRule struct {
+	Id        int       `json:"id"`
+	Kind      string    `json:"kind"`
+	Pattern   string    `json:"pattern"`  // palabra o expresión regular. Vacío en las reglas links
+	MaxLinks  int       `json:"maxlinks"` // enlaces permitidos en las reglas links
+	Action    string    `json:"action"`
+	DryRun    bool      `json:"dryrun"`
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"createdby"`
+
+	re *regexp.Regexp
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+// Reglas en memoria, ordenadas por id
+var filterRules struct {
+	list  []*FilterRule
+	mutex sync.RWMutex
+}
+
+// Comprueba la regla y compila su expresión
+func (f *FilterRule) compile() error {
+	switch f.Kind {
+	case FILTER_WORD:
+		f.Pattern = strings.TrimSpace(f.Pattern)
+		if f.Pattern == "" {
+			return invalid("pattern", "Debe indicar la palabra prohibida")
+		}
+		f.re = regexp.MustCompile("(?i)" + regexp.QuoteMeta(f.Pattern))
+	case FILTER_REGEX:
+		if f.Pattern == "" {
+			return invalid("pattern", "Debe indicar la expresión regular")
+		}
+		re, err := regexp.Compile(f.Pattern)
+		if err != nil {
+			return invalid("pattern", "Expresión regular no válida: %s", err)
+		}
+		f.re = re
+	case FILTER_LINKS:
+		if f.MaxLinks < 0 {
+			return invalid("maxlinks", "El número de enlaces permitidos no puede ser negativo")
+		}
+		f.Pattern = ""
+		f.re = linkPattern
+	default:
+		return invalid("kind", "Tipo de regla desconocido: %s. Debe ser word, regex o links", f.Kind)
+	}
+	if f.Action != FILTER_REJECT && f.Action != FILTER_HOLD && f.Action != FILTER_MASK {
+		return invalid("action", "Acción desconocida: %s. Debe ser reject, hold o mask", f.Action)
+	}
+	if err := checkCharacters("pattern", "El patrón", f.Pattern, false); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (f *FilterRule) String() string {
+	switch f.Kind {
+	case FILTER_WORD:
+		return fmt.Sprintf("regla %d: palabra «%s» (%s)", f.Id, f.Pattern, f.Action)
+	case FILTER_REGEX:
+		return fmt.Sprintf("regla %d: expresión «%s» (%s)", f.Id, f.Pattern, f.Action)
+	}
+	return fmt.Sprintf("regla %d: más de %d enlaces de una cuenta nueva (%s)", f.Id, f.MaxLinks, f.Action)
+}
+
+// Retorna true si la cuenta se creó hace menos de NewAccountAge
+func isNewAccount(u *User) bool {
+	return !u.Created.IsZero() && time.Since(u.Created) < NewAccountAge
+}
+
+// Retorna las posiciones del texto a las que se aplica la regla o nil si no
+// se aplica
+func (f *FilterRule) matches(text string, author *User) [][]int {
+	found := make([][]int, 0)
+	for _, loc := range f.re.FindAllStringIndex(text, -1) {
+		if loc[0] == loc[1] {
+			continue
+		}
+		if f.Kind == FILTER_WORD && !isWholeWord(text, loc) {
+			continue
+		}
+		found = append(found, loc)
+	}
+	if f.Kind == FILTER_LINKS {
+		if !isNewAccount(author) || len(found) <= f.MaxLinks {
+			return nil
+		}
+		// solo sobran los enlaces que pasan del límite
+		found = found[f.MaxLinks:]
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	return found
+}
+
+// Retorna true si lo que hay en loc no es parte de una palabra más larga
+func isWholeWord(text string, loc []int) bool {
+	isWordRune := func(c rune) bool {
+		return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_'
+	}
+	before, _ := utf8.DecodeLastRuneInString(text[:loc[0]])
+	after, _ := utf8.DecodeRuneInString(text[loc[1]:])
+	return !isWordRune(before) && !isWordRune(after)
+}
+
+// Sustituye cada carácter de las posiciones por un asterisco
+func maskText(text string, found [][]int) string {
+	// desde el final para que las posiciones anteriores sigan siendo válidas
+	for i := len(found) - 1; i >= 0; i-- {
+		loc := found[i]
+		stars := strings.Repeat("*", utf8.RuneCountInString(text[loc[0]:loc[1]]))
+		text = text[:loc[0]] + stars + text[loc[1]:]
+	}
+	return text
+}
+
+// Aplica las reglas al texto de un campo. Retorna el texto con las
+// coincidencias de las reglas mask enmascaradas y la regla que lo retiene,
+// o nil si no queda retenido. Si una regla lo rechaza retorna el error de
+// validación del campo
+func applyFilters(field string, name string, text string, author *User) (string, *FilterRule, error) {
+	filterRules.mutex.RLock()
+	defer filterRules.mutex.RUnlock()
+
+	var reject, hold *FilterRule
+	for _, f := range filterRules.list {
+		found := f.matches(text, author)
+		if found == nil {
+			continue
+		}
+		match := text[found[0][0]:found[0][1]]
+		if f.DryRun {
+			logInfo("Regla de filtro en modo de prueba", "rule", f.Id, "action", f.Action, "field", field,
+				"user", author.Login, "match", match)
+			continue
+		}
+		logInfo("Regla de filtro aplicada", "rule", f.Id, "action", f.Action, "field", field,
+			"user", author.Login, "match", match)
+		switch f.Action {
+		case FILTER_REJECT:
+			if reject == nil {
+				reject = f
+			}
+		case FILTER_HOLD:
+			if hold == nil {
+				hold = f
+			}
+		case FILTER_MASK:
+			text = maskText(text, found)
+		}
+	}
+	if reject != nil {
+		if reject.Kind == FILTER_LINKS {
+			return "", nil, invalid(field, "%s tiene demasiados enlaces para una cuenta nueva. El máximo es %d",
+				name, reject.MaxLinks)
+		}
+		return "", nil, invalid(field, "%s contiene texto no permitido", name)
+	}
+	return text, hold, nil
+}
+
+// Envía a la cola de moderación el mensaje o, si m es nil, el título del
+// hilo que ha retenido la regla
+func holdForModeration(f *FilterRule, th *Thread, m *Message) error {
+	rep := &Report{Stamp: time.Now(), Rule: f.Id, Thread: th.Id, Author: th.Author, Text: th.Title,
+		Reason: "Retenido por la " + f.String(), Status: REPORT_OPEN}
+	if m != nil {
+		open, err := hasOpenReport("", m.Id)
+		if err != nil || open {
+			return err
+		}
+		rep.MessageId, rep.Author, rep.Text = m.Id, m.Author, m.Text
+	}
+	return rep.Save()
+}
+
+// Retorna el hilo tal y como lo ve el usuario, sin los mensajes retenidos
+// de otros usuarios, o nil si no puede verlo
+func visibleThread(th *Thread, user *User) *Thread {
+	if can(user, PERM_MODERATE, th, nil) {
+		return th
+	}
+	author := th.Author
+	if len(th.Messages) > 0 {
+		author = th.Messages[0].Author
+	}
+	if (th.Held || (len(th.Messages) > 0 && th.Messages[0].Held)) && author != user.Login {
+		return nil
+	}
+	hidden := false
+	for _, m := range th.Messages {
+		if m.Held && m.Author != user.Login {
+			hidden = true
+			break
+		}
+	}
+	if !hidden {
+		return th
+	}
+	visible := *th
+	visible.Messages = make([]*Message, 0, len(th.Messages))
+	for _, m := range th.Messages {
+		if !m.Held || m.Author == user.Login {
+			visible.Messages = append(visible.Messages, m)
+		}
+	}
+	visible.Len = len(visible.Messages)
+	return &visible
+}
+
+func visibleThreads(list []*Thread, user *User) []*Thread {
+	visible := make([]*Thread, 0, len(list))
+	for _, th := range list {
+		if v := visibleThread(th, user); v != nil {
+			visible = append(visible, v)
+		}
+	}
+	return visible
+}
+
+// Publica el mensaje o el hilo que retenía la denuncia de un filtro
+func releaseHeld(rep *Report) error {
+	if rep.MessageId != 0 {
+		m := board.getMessage(rep.MessageId)
+		if m == nil || !m.Held {
+			return nil
+		}
+		m.Held = false
+		return m.SaveHeld()
+	}
+	th := board.getThread(rep.Thread)
+	if th == nil || !th.Held {
+		return nil
+	}
+	th.Held = false
+	return th.Update()
+}
+
+/*
+	Reglas en la base de datos
+*/
+
+// Carga en memoria las reglas de la base de datos
+func LoadFilterRules() error {
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query("SELECT id, kind, pattern, maxLinks, action, dryRun, created, createdBy FROM filter_rules ORDER BY id;")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	list := make([]*FilterRule, 0)
+	for rows.Next() {
+		f := new(FilterRule)
+		dryRun, created := 0, ""
+		err := rows.Scan(&f.Id, &f.Kind, &f.Pattern, &f.MaxLinks, &f.Action, &dryRun, &created, &f.CreatedBy)
+		if err != nil {
+			return err
+		}
+		f.DryRun = (dryRun == 1)
+		f.Created, _ = time.Parse(time.RFC3339, created)
+		if err := f.compile(); err != nil {
+			logWarn("Se ignora una regla de filtro no válida", "rule", f.Id, "error", err)
+			continue
+		}
+		list = append(list, f)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	filterRules.mutex.Lock()
+	filterRules.list = list
+	filterRules.mutex.Unlock()
+	return nil
+}
+
+// Inserta una regla nueva o actualiza una ya guardada
+func (f *FilterRule) Save(update bool) error {
+	dryRun := 0
+	if f.DryRun {
+		dryRun = 1
+	}
+	return WithTransaction(func(tx *sql.Tx) error {
+		if update {
+			_, err := tx.Exec("UPDATE filter_rules SET kind=?, pattern=?, maxLinks=?, action=?, dryRun=? WHERE id=?;",
+				f.Kind, f.Pattern, f.MaxLinks, f.Action, dryRun, f.Id)
+			return err
+		}
+		res, err := tx.Exec("INSERT INTO filter_rules (kind, pattern, maxLinks, action, dryRun, created, createdBy) VALUES (?,?,?,?,?,?,?);",
+			f.Kind, f.Pattern, f.MaxLinks, f.Action, dryRun, f.Created.UTC().Format(time.RFC3339), f.CreatedBy)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		f.Id = int(id)
+		return err
+	})
+}
+
+func (f *FilterRule) Delete() error {
+	return WithTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM filter_rules WHERE id=?;", f.Id)
+		return err
+	})
+}
+
+func getFilterRule(id int) *FilterRule {
+	filterRules.mutex.RLock()
+	defer filterRules.mutex.RUnlock()
+	for _, f := range filterRules.list {
+		if f.Id == id {
+			return f
+		}
+	}
+	return nil
+}
+
+/*
+	Administración de las reglas
+*/
+
+// Retorna las reglas. Solo para administradores
+func (a *api) listFilters(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if !can(user, PERM_FILTERS, nil, nil) {
+		a.jsonerror(w, "Usuario no autenticado o no autorizado", 404)
+		return
+	}
+	filterRules.mutex.RLock()
+	list := filterRules.list
+	filterRules.mutex.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Crea una regla nueva o, si la petición lleva RuleId, sustituye la regla
+// con ese id. Solo para administradores
+func (a *api) saveFilter(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if !can(user, PERM_FILTERS, nil, nil) {
+		a.jsonerror(w, "Usuario no autenticado o no autorizado", 404)
+		return
+	}
+	if !a.checkCanWrite(w, user) {
+		return
+	}
+	var old *FilterRule
+	if key, ok := mux.Vars(r)["RuleId"]; ok {
+		id, _ := strconv.Atoi(key)
+		if old = getFilterRule(id); old == nil {
+			a.jsonerror(w, "La regla no existe", 404)
+			return
+		}
+	}
+	f := new(FilterRule)
+	err := decodeBody(r, f)
+	if err == nil {
+		err = f.compile()
+	}
+	if err != nil {
+		a.invalidRequest(w, err, "Bad filter payload")
+		return
+	}
+
+	oldValue, action := "", AUDIT_FILTER_CREATE
+	if old != nil {
+		f.Id, f.Created, f.CreatedBy = old.Id, old.Created, old.CreatedBy
+		oldValue, action = old.String(), AUDIT_FILTER_UPDATE
+	} else {
+		f.Created, f.CreatedBy = time.Now(), user.Login
+	}
+	err = f.Save(old != nil)
+	if err == nil {
+		err = LoadFilterRules()
+	}
+	if err != nil {
+		logError("BD ERROR: Falló guardar la regla de filtro", "user", user.Login, "error", err)
+		a.jsonerror(w, "Operation failed", 404)
+		return
+	}
+	newValue := f.String()
+	if f.DryRun {
+		newValue += " en modo de prueba"
+	}
+	logInfo("Regla de filtro guardada", "user", user.Login, "rule", newValue)
+	audit(r, user.Login, action, "", 0, oldValue, newValue)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
+
+// Borra una regla. Solo para administradores
+func (a *api) deleteFilter(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if !can(user, PERM_FILTERS, nil, nil) {
+		a.jsonerror(w, "Usuario no autenticado o no autorizado", 404)
+		return
+	}
+	if !a.checkCanWrite(w, user) {
+		return
+	}
+	id, _ := strconv.Atoi(mux.Vars(r)["RuleId"])
+	f := getFilterRule(id)
+	if f == nil {
+		a.jsonerror(w, "La regla no existe", 404)
+		return
+	}
+	err := f.Delete()
+	if err == nil {
+		err = LoadFilterRules()
+	}
+	if err != nil {
+		logError("BD ERROR: Falló borrar la regla de filtro", "rule", f.Id, "user", user.Login, "error", err)
+		a.jsonerror(w, "Operation failed", 404)
+		return
+	}
+	logInfo("Regla de filtro borrada", "user", user.Login, "rule", f.String())
+	audit(r, user.Login, AUDIT_FILTER_DELETE, "", 0, f.String(), "")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
@@ -0,0 +1,225 @@
+package srv
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Sustituye las reglas en memoria durante la prueba
+func setFilterRules(t *testing.T, rules ...*FilterRule) {
+	t.Helper()
+	filterRules.mutex.Lock()
+	old := filterRules.list
+	filterRules.list = rules
+	filterRules.mutex.Unlock()
+	t.Cleanup(func() {
+		filterRules.mutex.Lock()
+		filterRules.list = old
+		filterRules.mutex.Unlock()
+	})
+	for i, f := range rules {
+		f.Id = i + 1
+		if err := f.compile(); err != nil {
+			t.Fatalf("regla %d: %v", f.Id, err)
+		}
+	}
+}
+
+func TestApplyFilters(t *testing.T) {
+	veteran := &User{Login: "bob", Created: time.Now().Add(-30 * 24 * time.Hour)}
+	newcomer := &User{Login: "eva", Created: time.Now().Add(-time.Hour)}
+	unknownAge := &User{Login: "ana"}
+
+	tests := []struct {
+		name   string
+		rules  []*FilterRule
+		author *User
+		text   string
+		want   string // texto resultante
+		hold   int    // id de la regla que lo retiene, 0 si ninguna
+		reject bool
+	}{
+		{"palabra rechazada", []*FilterRule{{Kind: FILTER_WORD, Pattern: "spam", Action: FILTER_REJECT}},
+			veteran, "esto es SPAM!", "", 0, true},
+		{"palabra dentro de otra", []*FilterRule{{Kind: FILTER_WORD, Pattern: "spam", Action: FILTER_REJECT}},
+			veteran, "los spammers y el anti_spam", "los spammers y el anti_spam", 0, false},
+		{"palabra enmascarada", []*FilterRule{{Kind: FILTER_WORD, Pattern: "tonto", Action: FILTER_MASK}},
+			veteran, "tonto y más TONTO.", "***** y más *****.", 0, false},
+		{"frase enmascarada", []*FilterRule{{Kind: FILTER_WORD, Pattern: "qué rollo", Action: FILTER_MASK}},
+			veteran, "¡qué rollo!", "¡*********!", 0, false},
+		{"palabra retenida", []*FilterRule{{Kind: FILTER_WORD, Pattern: "oferta", Action: FILTER_HOLD}},
+			veteran, "gran oferta", "gran oferta", 1, false},
+		{"expresión rechazada", []*FilterRule{{Kind: FILTER_REGEX, Pattern: `(?i)casin[o0]`, Action: FILTER_REJECT}},
+			veteran, "visita el CASIN0", "", 0, true},
+		{"expresión retenida", []*FilterRule{{Kind: FILTER_REGEX, Pattern: `\b\d{9}\b`, Action: FILTER_HOLD}},
+			veteran, "llama al 600123123", "llama al 600123123", 1, false},
+		{"expresión enmascarada", []*FilterRule{{Kind: FILTER_REGEX, Pattern: `\b\d{9}\b`, Action: FILTER_MASK}},
+			veteran, "llama al 600123123", "llama al *********", 0, false},
+		{"expresión que no coincide", []*FilterRule{{Kind: FILTER_REGEX, Pattern: `\b\d{9}\b`, Action: FILTER_REJECT}},
+			veteran, "llama al 600 12", "llama al 600 12", 0, false},
+		{"enlaces de una cuenta nueva", []*FilterRule{{Kind: FILTER_LINKS, MaxLinks: 1, Action: FILTER_REJECT}},
+			newcomer, "https://a.es y www.b.es", "", 0, true},
+		{"enlaces dentro del límite", []*FilterRule{{Kind: FILTER_LINKS, MaxLinks: 1, Action: FILTER_REJECT}},
+			newcomer, "mira https://a.es", "mira https://a.es", 0, false},
+		{"enlaces de una cuenta antigua", []*FilterRule{{Kind: FILTER_LINKS, MaxLinks: 1, Action: FILTER_REJECT}},
+			veteran, "https://a.es y www.b.es", "https://a.es y www.b.es", 0, false},
+		{"enlaces de una cuenta sin fecha", []*FilterRule{{Kind: FILTER_LINKS, MaxLinks: 0, Action: FILTER_REJECT}},
+			unknownAge, "https://a.es", "https://a.es", 0, false},
+		{"enlaces que sobran enmascarados", []*FilterRule{{Kind: FILTER_LINKS, MaxLinks: 1, Action: FILTER_MASK}},
+			newcomer, "http://a.es www.b.es", "http://a.es ********", 0, false},
+		{"enlaces retenidos", []*FilterRule{{Kind: FILTER_LINKS, MaxLinks: 0, Action: FILTER_HOLD}},
+			newcomer, "ver http://a.es", "ver http://a.es", 1, false},
+		{"rechazo en modo de prueba", []*FilterRule{{Kind: FILTER_WORD, Pattern: "spam", Action: FILTER_REJECT, DryRun: true}},
+			veteran, "spam", "spam", 0, false},
+		{"máscara en modo de prueba", []*FilterRule{{Kind: FILTER_WORD, Pattern: "tonto", Action: FILTER_MASK, DryRun: true}},
+			veteran, "tonto", "tonto", 0, false},
+		{"retención en modo de prueba", []*FilterRule{{Kind: FILTER_WORD, Pattern: "oferta", Action: FILTER_HOLD, DryRun: true}},
+			veteran, "oferta", "oferta", 0, false},
+		{"máscara y retención", []*FilterRule{
+			{Kind: FILTER_WORD, Pattern: "tonto", Action: FILTER_MASK},
+			{Kind: FILTER_WORD, Pattern: "oferta", Action: FILTER_HOLD}},
+			veteran, "oferta para tontos y un tonto", "oferta para tontos y un *****", 2, false},
+		{"el rechazo gana a la retención", []*FilterRule{
+			{Kind: FILTER_WORD, Pattern: "oferta", Action: FILTER_HOLD},
+			{Kind: FILTER_WORD, Pattern: "spam", Action: FILTER_REJECT}},
+			veteran, "oferta de spam", "", 0, true},
+		{"la regla de prueba no impide las demás", []*FilterRule{
+			{Kind: FILTER_WORD, Pattern: "spam", Action: FILTER_REJECT, DryRun: true},
+			{Kind: FILTER_WORD, Pattern: "spam", Action: FILTER_MASK}},
+			veteran, "spam", "****", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFilterRules(t, tt.rules...)
+			text, hold, err := applyFilters("text", "El mensaje", tt.text, tt.author)
+			if tt.reject {
+				verr, ok := err.(*ValidationError)
+				if !ok || verr.Field != "text" {
+					t.Fatalf("se esperaba un error de validación de text y se obtuvo %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rechazado: %v", err)
+			}
+			if text != tt.want {
+				t.Errorf("texto %q, se esperaba %q", text, tt.want)
+			}
+			holdId := 0
+			if hold != nil {
+				holdId = hold.Id
+			}
+			if holdId != tt.hold {
+				t.Errorf("retenido por la regla %d, se esperaba %d", holdId, tt.hold)
+			}
+		})
+	}
+}
+
+func TestVisibleThread(t *testing.T) {
+	admin := &User{Login: "admin", IsAdmin: true}
+	moderator := &User{Login: "mod", Roles: []RoleGrant{{Role: ROLE_MODERATOR, Category: "soporte"}}}
+	otherModerator := &User{Login: "mod2", Roles: []RoleGrant{{Role: ROLE_MODERATOR, Category: "juegos"}}}
+	bob := &User{Login: "bob"}
+	eva := &User{Login: "eva"}
+
+	th := &Thread{Author: "bob", Category: "soporte"}
+	th.Messages = []*Message{
+		{Id: 1, Author: "bob", Text: "pregunta"},
+		{Id: 2, Author: "eva", Text: "gran oferta", Held: true},
+		{Id: 3, Author: "admin", Text: "respuesta"},
+	}
+	th.Len = 3
+
+	for _, tt := range []struct {
+		user *User
+		ids  []int
+	}{
+		{admin, []int{1, 2, 3}},
+		{moderator, []int{1, 2, 3}},
+		{eva, []int{1, 2, 3}},
+		{bob, []int{1, 3}},
+		{otherModerator, []int{1, 3}},
+	} {
+		v := visibleThread(th, tt.user)
+		if v == nil {
+			t.Fatalf("%s no ve el hilo", tt.user.Login)
+		}
+		ids := make([]int, 0)
+		for _, m := range v.Messages {
+			ids = append(ids, m.Id)
+		}
+		if len(ids) != len(tt.ids) || v.Len != len(tt.ids) {
+			t.Fatalf("%s ve los mensajes %v (len %d), se esperaba %v", tt.user.Login, ids, v.Len, tt.ids)
+		}
+		for i := range ids {
+			if ids[i] != tt.ids[i] {
+				t.Fatalf("%s ve los mensajes %v, se esperaba %v", tt.user.Login, ids, tt.ids)
+			}
+		}
+	}
+	if len(th.Messages) != 3 || th.Len != 3 {
+		t.Fatal("visibleThread ha modificado el hilo del tablón")
+	}
+
+	// un hilo retenido, por su título o por su primer mensaje, solo lo ven
+	// su autor y quien modera
+	for _, hold := range []func(){
+		func() { th.Held = true },
+		func() { th.Messages[0].Held = true },
+	} {
+		th.Held, th.Messages[0].Held = false, false
+		hold()
+		for user, visible := range map[*User]bool{admin: true, moderator: true, bob: true, eva: false, otherModerator: false} {
+			if (visibleThread(th, user) != nil) != visible {
+				t.Errorf("%s ve el hilo retenido: %v, se esperaba %v", user.Login, !visible, visible)
+			}
+		}
+	}
+}
+
+func TestHeldMessageHidden(t *testing.T) {
+	h := newTestDatabase(t)
+	setFilterRules(t, &FilterRule{Kind: FILTER_WORD, Pattern: "oferta", Action: FILTER_HOLD})
+	admin, bob, eva := testLogin(t, h, "admin"), testLogin(t, h, "bob"), testLogin(t, h, "eva")
+
+	w := testRequest(h, bob, http.MethodPost, "/board", `"Dudas"`)
+	var th Thread
+	if err := json.NewDecoder(w.Body).Decode(&th); err != nil {
+		t.Fatalf("no se pudo crear el hilo: %d %s", w.Code, w.Body)
+	}
+	for _, post := range []struct {
+		session *http.Cookie
+		text    string
+	}{{bob, "pregunta"}, {eva, "gran oferta"}} {
+		if w := testRequest(h, post.session, http.MethodPut, "/threads/"+th.Id, `{"text":"`+post.text+`"}`); w.Code != http.StatusOK {
+			t.Fatalf("no se pudo publicar %q: %d %s", post.text, w.Code, w.Body)
+		}
+	}
+
+	for name, tt := range map[string]struct {
+		session *http.Cookie
+		n       int
+	}{"admin": {admin, 2}, "eva": {eva, 2}, "bob": {bob, 1}} {
+		w := testRequest(h, tt.session, http.MethodGet, "/threads/"+th.Id, "")
+		var got Thread
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatalf("%s: %d %s", name, w.Code, w.Body)
+		}
+		if len(got.Messages) != tt.n {
+			t.Errorf("%s ve %d mensajes, se esperaban %d", name, len(got.Messages), tt.n)
+		}
+	}
+
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	if err := db.QueryRow("SELECT COUNT(*) FROM reports WHERE rule=1 AND status=?;", REPORT_OPEN).Scan(&n); err != nil || n != 1 {
+		t.Fatalf("hay %d denuncias abiertas de la regla (%v), se esperaba 1", n, err)
+	}
+}
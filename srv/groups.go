@@ -0,0 +1,119 @@
+package srv
+
+import (
+	"errors"
+	"os/user"
+	"strings"
+)
+
+/*
+
+	Roles por grupos del sistema
+
+	Con roles.admin_groups y roles.moderator_groups los usuarios que
+	pertenecen a alguno de esos grupos Unix son administradores o
+	moderadores de todo el tablón sin necesidad de promote ni de roles. Los
+	grupos se resuelven al iniciar sesión y al recargar la tabla de usuarios
+	(gbb --reload o SIGHUP), así que quien deja el grupo pierde el rol en la
+	siguiente resolución.
+
+	El rol de los grupos no se guarda en la base de datos. isAdmin guarda
+	solo lo que se cambia con promote y demote, y IsAdmin es cierto si lo
+	es cualquiera de los dos.
+
+*/
+
+// Grupos del sistema separados por comas
+var AdminGroups = ""
+var ModeratorGroups = ""
+
+// Retorna los nombres de los grupos del sistema a los que pertenece un
+// login. Se puede sustituir para no depender de los usuarios del sistema
+var GroupResolver = systemGroups
+
+func systemGroups(login string) ([]string, error) {
+	u, err := user.Lookup(login)
+	if err != nil {
+		var unknown user.UnknownUserError
+		if errors.As(err, &unknown) {
+			// usuario del tablón sin cuenta en el sistema
+			return nil, nil
+		}
+		return nil, err
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(ids))
+	for _, id := range ids {
+		g, err := user.LookupGroupId(id)
+		if err != nil {
+			continue
+		}
+		groups = append(groups, g.Name)
+	}
+	return groups, nil
+}
+
+func splitGroups(list string) []string {
+	groups := make([]string, 0)
+	for _, g := range strings.Split(list, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+func memberOf(groups []string, configured []string) bool {
+	for _, g := range groups {
+		for _, c := range configured {
+			if g == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Rol que dan al login sus grupos del sistema: admin, moderator o vacío
+func groupRole(login string) string {
+	admins, moderators := splitGroups(AdminGroups), splitGroups(ModeratorGroups)
+	if len(admins) == 0 && len(moderators) == 0 {
+		return ""
+	}
+	groups, err := GroupResolver(login)
+	if err != nil {
+		logWarn("No se pudieron resolver los grupos del sistema", "user", login, "error", err)
+		return ""
+	}
+	if memberOf(groups, admins) {
+		return ROLE_ADMIN
+	}
+	if memberOf(groups, moderators) {
+		return ROLE_MODERATOR
+	}
+	return ""
+}
+
+// Vuelve a resolver el rol que dan al usuario sus grupos del sistema
+func (u *User) applyGroups() {
+	role := groupRole(u.Login)
+	if role != u.GroupRole {
+		logDebug("Cambia el rol por grupos del sistema", "user", u.Login, "old", u.GroupRole, "new", role)
+	}
+	u.GroupRole = role
+	u.IsAdmin = u.storedAdmin || role == ROLE_ADMIN
+}
+
+// Cambia el administrador global que se guarda en la base de datos. No se
+// puede degradar a quien es administrador por sus grupos del sistema
+func (u *User) setAdmin(admin bool) error {
+	if !admin && u.GroupRole == ROLE_ADMIN {
+		return errors.New("El usuario es administrador por sus grupos del sistema")
+	}
+	u.storedAdmin = admin
+	u.IsAdmin = admin || u.GroupRole == ROLE_ADMIN
+	return nil
+}
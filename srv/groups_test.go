@@ -0,0 +1,138 @@
+package srv
+
+import (
+	"errors"
+	"testing"
+)
+
+// Sustituye la resolución de grupos por la tabla memberships durante la
+// prueba. Se puede cambiar la tabla para simular altas y bajas en grupos
+func stubGroups(t *testing.T, admins string, moderators string, memberships map[string][]string) {
+	t.Helper()
+	resolver, adminGroups, moderatorGroups := GroupResolver, AdminGroups, ModeratorGroups
+	t.Cleanup(func() {
+		GroupResolver, AdminGroups, ModeratorGroups = resolver, adminGroups, moderatorGroups
+	})
+	AdminGroups, ModeratorGroups = admins, moderators
+	GroupResolver = func(login string) ([]string, error) {
+		if login == "roto" {
+			return nil, errors.New("fallo de NSS")
+		}
+		return memberships[login], nil
+	}
+}
+
+func TestApplyGroupsRoles(t *testing.T) {
+	memberships := map[string][]string{
+		"ana":  {"users", "wheel"},
+		"luis": {"users", "gbbmods"},
+		"eva":  {"users"},
+	}
+	stubGroups(t, "wheel, staff", "gbbmods", memberships)
+
+	ana := NewUser("ana", nil)
+	ana.applyGroups()
+	if ana.GroupRole != ROLE_ADMIN || !ana.IsAdmin || !ana.Can(PERM_BAN, "") {
+		t.Fatalf("ana debería ser administradora por wheel: %+v", ana)
+	}
+
+	luis := NewUser("luis", nil)
+	luis.applyGroups()
+	if luis.GroupRole != ROLE_MODERATOR || luis.IsAdmin {
+		t.Fatalf("luis debería ser solo moderador por gbbmods: %+v", luis)
+	}
+	if !luis.Can(PERM_MODERATE, "") || !luis.Can(PERM_CLOSE, "dev") || luis.Can(PERM_BAN, "") {
+		t.Fatal("los permisos de luis no son los de un moderador global")
+	}
+
+	eva := NewUser("eva", nil)
+	eva.applyGroups()
+	if eva.GroupRole != "" || eva.IsAdmin || eva.Can(PERM_MODERATE, "") {
+		t.Fatalf("eva no debería tener ningún rol: %+v", eva)
+	}
+
+	// un fallo al resolver los grupos no da ningún rol
+	roto := NewUser("roto", nil)
+	roto.applyGroups()
+	if roto.GroupRole != "" || roto.IsAdmin {
+		t.Fatalf("roto no debería tener ningún rol: %+v", roto)
+	}
+}
+
+func TestApplyGroupsLosesRole(t *testing.T) {
+	memberships := map[string][]string{"ana": {"wheel"}, "luis": {"gbbmods"}}
+	stubGroups(t, "wheel", "gbbmods", memberships)
+
+	ana, luis := NewUser("ana", nil), NewUser("luis", nil)
+	ana.applyGroups()
+	luis.applyGroups()
+
+	// dejan los grupos y se vuelven a resolver, como en el login o la recarga
+	memberships["ana"] = nil
+	memberships["luis"] = []string{"users"}
+	ana.applyGroups()
+	luis.applyGroups()
+	if ana.GroupRole != "" || ana.IsAdmin || ana.Can(PERM_BAN, "") {
+		t.Fatalf("ana sigue siendo administradora tras dejar wheel: %+v", ana)
+	}
+	if luis.GroupRole != "" || luis.Can(PERM_MODERATE, "") {
+		t.Fatalf("luis sigue siendo moderador tras dejar gbbmods: %+v", luis)
+	}
+}
+
+func TestApplyGroupsWithoutConfig(t *testing.T) {
+	stubGroups(t, "", "", nil)
+	GroupResolver = func(login string) ([]string, error) {
+		t.Fatal("no se deberían resolver grupos sin grupos configurados")
+		return nil, nil
+	}
+	u := NewUser("ana", nil)
+	u.storedAdmin = true
+	u.applyGroups()
+	if !u.IsAdmin || u.GroupRole != "" {
+		t.Fatalf("sin grupos configurados solo cuenta isAdmin: %+v", u)
+	}
+}
+
+func TestPromoteDemoteWithGroups(t *testing.T) {
+	memberships := map[string][]string{"ana": {"wheel"}}
+	stubGroups(t, "wheel", "gbbmods", memberships)
+
+	u := NewUser("ana", nil)
+	u.applyGroups()
+	if err := u.setAdmin(false); err == nil {
+		t.Fatal("se ha degradado a una administradora por grupo")
+	}
+	if !u.IsAdmin || u.storedAdmin {
+		t.Fatalf("el demote rechazado ha cambiado el usuario: %+v", u)
+	}
+
+	// promote guarda isAdmin, que se conserva al dejar el grupo
+	if err := u.setAdmin(true); err != nil {
+		t.Fatal(err)
+	}
+	memberships["ana"] = nil
+	u.applyGroups()
+	if !u.IsAdmin || !u.storedAdmin || u.GroupRole != "" {
+		t.Fatalf("ana debería seguir siendo administradora por promote: %+v", u)
+	}
+
+	// sin el grupo ya se puede degradar
+	if err := u.setAdmin(false); err != nil {
+		t.Fatal(err)
+	}
+	if u.IsAdmin || u.storedAdmin {
+		t.Fatalf("ana sigue siendo administradora tras demote: %+v", u)
+	}
+
+	// un moderador por grupo puede ser promovido y degradado
+	memberships["luis"] = []string{"gbbmods"}
+	luis := NewUser("luis", nil)
+	luis.applyGroups()
+	if err := luis.setAdmin(true); err != nil || !luis.IsAdmin {
+		t.Fatalf("no se ha podido promover a luis: %v", err)
+	}
+	if err := luis.setAdmin(false); err != nil || luis.IsAdmin || !luis.Can(PERM_MODERATE, "") {
+		t.Fatalf("luis debería volver a ser solo moderador: %v %+v", err, luis)
+	}
+}
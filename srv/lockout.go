@@ -0,0 +1,253 @@
+package srv
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+
+	Bloqueo por intentos fallidos
+
+	Cada inicio de sesión fallido se anota en la tabla login_failures para el
+	login y para la dirección remota. Superado el número de intentos
+	permitidos la clave queda bloqueada durante Delay, y cada nuevo fallo
+	duplica el bloqueo hasta MaxDelay. Los fallos se olvidan tras Reset sin
+	nuevos fallos o al iniciar sesión con éxito; sus filas se borran al
+	anotar el siguiente fallo de cualquier clave. Como se guardan en la base
+	de datos, los bloqueos se mantienen aunque se reinicie el servidor. Un
+	administrador puede levantar el bloqueo de un login con el comando
+	unlock del usuario y el de una dirección con PUT /admin/lockouts/{addr}.
+
+*/
+
+const (
+	LOCKOUT_USER = "user"
+	LOCKOUT_ADDR = "addr"
+)
+
+type LockoutConfig struct {
+	UserAttempts int           // fallos por login antes de bloquear, 0 para no bloquear
+	AddrAttempts int           // fallos por dirección antes de bloquear, 0 para no bloquear
+	Delay        time.Duration // primer bloqueo
+	MaxDelay     time.Duration // bloqueo máximo
+	Reset        time.Duration // tiempo sin fallos tras el que se olvidan
+}
+
+var Lockout = LockoutConfig{
+	UserAttempts: 3,
+	AddrAttempts: 10,
+	Delay:        30 * time.Second,
+	MaxDelay:     time.Hour,
+	Reset:        24 * time.Hour,
+}
+
+type LoginFailure struct {
+	Kind        string    `json:"kind"` // LOCKOUT_USER o LOCKOUT_ADDR
+	Key         string    `json:"key"`  // login o dirección
+	Failures    int       `json:"failures"`
+	Last        time.Time `json:"last"`
+	LockedUntil time.Time `json:"lockeduntil"`
+}
+
+// Hash con el que se compara la contraseña de un login que no existe, para
+// que tarde lo mismo que la de uno que sí
+var dummyHash []byte
+var dummyHashOnce sync.Once
+
+func compareDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("gbb"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+func lockoutAttempts(kind string) int {
+	if kind == LOCKOUT_USER {
+		return Lockout.UserAttempts
+	}
+	return Lockout.AddrAttempts
+}
+
+// Lee los fallos de una clave. Si no tiene ninguno retorna un registro vacío
+func loadLoginFailure(kind string, key string) (*LoginFailure, error) {
+	f := &LoginFailure{Kind: kind, Key: key}
+	q := "SELECT failures, last, lockedUntil FROM login_failures WHERE kind=? AND key=?;"
+
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		return nil, err
+	}
+	last, locked := "", ""
+	err = db.QueryRow(q, kind, key).Scan(&f.Failures, &last, &locked)
+	if err == sql.ErrNoRows {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.Last, _ = time.Parse(time.RFC3339, last)
+	f.LockedUntil, _ = time.Parse(time.RFC3339, locked)
+	return f, nil
+}
+
+// Retorna el tiempo que le queda bloqueada a la clave o 0 si no lo está
+func loginLockedFor(kind string, key string) (time.Duration, error) {
+	if lockoutAttempts(kind) <= 0 {
+		return 0, nil
+	}
+	f, err := loadLoginFailure(kind, key)
+	if err != nil {
+		return 0, err
+	}
+	remaining := time.Until(f.LockedUntil)
+	if remaining < 0 {
+		return 0, nil
+	}
+	return remaining, nil
+}
+
+// Anota un fallo de la clave y, si supera los intentos permitidos, la bloquea.
+// En la misma transacción se borran los fallos de cualquier clave que llevan
+// Reset sin repetirse y ya no la bloquean
+func recordLoginFailure(kind string, key string) (*LoginFailure, error) {
+	attempts := lockoutAttempts(kind)
+	if attempts <= 0 {
+		return nil, nil
+	}
+	now := time.Now()
+	stamp := now.UTC().Format(time.RFC3339)
+	f := &LoginFailure{Kind: kind, Key: key, Last: now}
+	err := WithTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM login_failures WHERE last<? AND lockedUntil<?;",
+			now.Add(-Lockout.Reset).UTC().Format(time.RFC3339), stamp)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO login_failures (kind, key, failures, last, lockedUntil) VALUES (?,?,1,?,?)
+			ON CONFLICT(kind, key) DO UPDATE SET failures=failures+1, last=excluded.last;`,
+			kind, key, stamp, time.Time{}.Format(time.RFC3339))
+		if err != nil {
+			return err
+		}
+		locked := ""
+		err = tx.QueryRow("SELECT failures, lockedUntil FROM login_failures WHERE kind=? AND key=?;", kind, key).Scan(&f.Failures, &locked)
+		if err != nil {
+			return err
+		}
+		f.LockedUntil, _ = time.Parse(time.RFC3339, locked)
+		if f.Failures < attempts {
+			return nil
+		}
+		delay := Lockout.Delay
+		for i := attempts; i < f.Failures && delay < Lockout.MaxDelay; i++ {
+			delay *= 2
+		}
+		if delay > Lockout.MaxDelay {
+			delay = Lockout.MaxDelay
+		}
+		f.LockedUntil = now.Add(delay)
+		_, err = tx.Exec("UPDATE login_failures SET lockedUntil=? WHERE kind=? AND key=?;",
+			f.LockedUntil.UTC().Format(time.RFC3339), kind, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Olvida los fallos de una clave
+func clearLoginFailures(kind string, key string) error {
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM login_failures WHERE kind=? AND key=?;", kind, key)
+	return err
+}
+
+// Mensaje igual para un login desconocido y una contraseña incorrecta, para
+// no revelar qué logins existen
+const LOGIN_FAILED_MESSAGE = "Usuario o contraseña incorrectos"
+
+// Comprueba que ni el login ni la dirección estén bloqueados. Si alguno lo
+// está responde indicando cuándo se puede volver a intentar y retorna false
+func (a *api) checkLoginLockout(w http.ResponseWriter, login string, addr string) bool {
+	wait := time.Duration(0)
+	for kind, key := range map[string]string{LOCKOUT_USER: login, LOCKOUT_ADDR: addr} {
+		remaining, err := loginLockedFor(kind, key)
+		if err != nil {
+			logError("BD ERROR: Falló leer los intentos fallidos", kind, key, "error", err)
+		}
+		if remaining > wait {
+			wait = remaining
+		}
+	}
+	if wait == 0 {
+		return true
+	}
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	a.jsonerror(w, fmt.Sprintf("Demasiados intentos fallidos. Inténtelo de nuevo en %d segundos", seconds), http.StatusTooManyRequests)
+	return false
+}
+
+// Anota un inicio de sesión fallido para el login y la dirección
+func loginFailed(login string, addr string) {
+	for kind, key := range map[string]string{LOCKOUT_USER: login, LOCKOUT_ADDR: addr} {
+		f, err := recordLoginFailure(kind, key)
+		if err != nil {
+			logError("BD ERROR: Falló anotar el intento fallido", kind, key, "error", err)
+		} else if f != nil && !f.LockedUntil.IsZero() && f.Failures >= lockoutAttempts(kind) {
+			logWarn("Bloqueado por intentos fallidos", kind, key, "failures", f.Failures, "until", f.LockedUntil.Format(time.RFC3339))
+		}
+	}
+}
+
+// Olvida los intentos fallidos de una dirección remota
+func (a *api) unlockAddress(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if !can(user, PERM_MANAGE_USERS, nil, nil) {
+		a.jsonerror(w, "Usuario no autenticado o no autorizado", 404)
+		return
+	}
+	if !a.checkCanWrite(w, user) {
+		return
+	}
+	ip := net.ParseIP(mux.Vars(r)["Addr"])
+	if ip == nil {
+		a.invalidRequest(w, invalid("addr", "La dirección no es válida"), "Bad address")
+		return
+	}
+	addr := ip.String()
+	f, err := loadLoginFailure(LOCKOUT_ADDR, addr)
+	if err == nil && f.Failures == 0 {
+		a.jsonerror(w, "La dirección no tiene intentos fallidos", 404)
+		return
+	}
+	if err == nil {
+		err = clearLoginFailures(LOCKOUT_ADDR, addr)
+	}
+	if err != nil {
+		logError("BD ERROR: Falló desbloquear la dirección", "addr", addr, "user", user.Login, "error", err)
+		a.jsonerror(w, "Operation failed", 500)
+		return
+	}
+	logInfo("Dirección desbloqueada", "user", user.Login, "addr", addr)
+	audit(r, user.Login, AUDIT_ADDR_UNLOCK, "", 0, fmt.Sprintf("%s failures=%d", addr, f.Failures), addr+" failures=0")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode("")
+}
@@ -0,0 +1,157 @@
+package srv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Configuración de bloqueo para la prueba, que se restaura al terminar
+func setLockout(t *testing.T, l LockoutConfig) {
+	t.Helper()
+	old := Lockout
+	t.Cleanup(func() { Lockout = old })
+	Lockout = l
+}
+
+// Cambia en la base de datos los tiempos de los fallos de una clave
+func setLoginFailureTimes(t *testing.T, kind string, key string, last time.Time, lockedUntil time.Time) {
+	t.Helper()
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("UPDATE login_failures SET last=?, lockedUntil=? WHERE kind=? AND key=?;",
+		last.UTC().Format(time.RFC3339), lockedUntil.UTC().Format(time.RFC3339), kind, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockoutDoublesDelay(t *testing.T) {
+	newTestDatabase(t)
+	setLockout(t, LockoutConfig{UserAttempts: 3, AddrAttempts: 3, Delay: 30 * time.Second, MaxDelay: 2 * time.Minute, Reset: time.Hour})
+
+	want := []time.Duration{0, 0, 30 * time.Second, time.Minute, 2 * time.Minute, 2 * time.Minute}
+	for i, delay := range want {
+		f, err := recordLoginFailure(LOCKOUT_USER, "bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Failures != i+1 {
+			t.Fatalf("fallo %d: se han anotado %d", i+1, f.Failures)
+		}
+		if delay == 0 {
+			if !f.LockedUntil.IsZero() {
+				t.Fatalf("fallo %d: bloqueado hasta %v antes de agotar los intentos", i+1, f.LockedUntil)
+			}
+			continue
+		}
+		if got := f.LockedUntil.Sub(f.Last); got != delay {
+			t.Fatalf("fallo %d: bloqueado %v, se esperaba %v", i+1, got, delay)
+		}
+		if remaining, err := loginLockedFor(LOCKOUT_USER, "bob"); err != nil || remaining <= delay-2*time.Second || remaining > delay {
+			t.Fatalf("fallo %d: quedan %v (%v), se esperaba %v", i+1, remaining, err, delay)
+		}
+	}
+
+	// las demás claves no se ven afectadas
+	if remaining, _ := loginLockedFor(LOCKOUT_USER, "eva"); remaining != 0 {
+		t.Fatalf("eva está bloqueada %v", remaining)
+	}
+	if remaining, _ := loginLockedFor(LOCKOUT_ADDR, "bob"); remaining != 0 {
+		t.Fatalf("la dirección bob está bloqueada %v", remaining)
+	}
+}
+
+func TestLockoutExpires(t *testing.T) {
+	h := newTestDatabase(t)
+	setLockout(t, LockoutConfig{UserAttempts: 3, AddrAttempts: 100, Delay: time.Minute, MaxDelay: time.Hour, Reset: time.Hour})
+
+	for i := 0; i < 3; i++ {
+		w := testRequest(h, nil, http.MethodPost, "/users/bob", `"mala"`)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("intento %d: código %d", i+1, w.Code)
+		}
+	}
+	w := testRequest(h, nil, http.MethodPost, "/users/bob", `"`+testPassword+`"`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("con el login bloqueado: código %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// pasado el bloqueo se puede iniciar sesión y se olvidan los fallos
+	now := time.Now()
+	setLoginFailureTimes(t, LOCKOUT_USER, "bob", now.Add(-2*time.Minute), now.Add(-time.Minute))
+	if remaining, _ := loginLockedFor(LOCKOUT_USER, "bob"); remaining != 0 {
+		t.Fatalf("el bloqueo no ha caducado: %v", remaining)
+	}
+	testLogin(t, h, "bob")
+	if f, err := loadLoginFailure(LOCKOUT_USER, "bob"); err != nil || f.Failures != 0 {
+		t.Fatalf("quedan %d fallos tras iniciar sesión (%v)", f.Failures, err)
+	}
+
+	// los fallos sin repetir durante Reset se borran al anotar otro
+	if _, err := recordLoginFailure(LOCKOUT_USER, "eva"); err != nil {
+		t.Fatal(err)
+	}
+	setLoginFailureTimes(t, LOCKOUT_USER, "eva", now.Add(-2*time.Hour), time.Time{})
+	if _, err := recordLoginFailure(LOCKOUT_USER, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := loadLoginFailure(LOCKOUT_USER, "eva"); err != nil || f.Failures != 0 {
+		t.Fatalf("no se han olvidado los fallos antiguos: %d (%v)", f.Failures, err)
+	}
+}
+
+func TestLoginFailedSameResponse(t *testing.T) {
+	h := newTestDatabase(t)
+	setLockout(t, LockoutConfig{UserAttempts: 3, AddrAttempts: 10, Delay: time.Minute, MaxDelay: time.Hour, Reset: time.Hour})
+
+	unknown := testRequest(h, nil, http.MethodPost, "/users/nadie", `"`+testPassword+`"`)
+	bad := testRequest(h, nil, http.MethodPost, "/users/bob", `"mala"`)
+	if unknown.Code != http.StatusUnauthorized || bad.Code != http.StatusUnauthorized {
+		t.Fatalf("códigos %d y %d, se esperaba %d", unknown.Code, bad.Code, http.StatusUnauthorized)
+	}
+	if unknown.Body.String() != bad.Body.String() {
+		t.Fatalf("las respuestas son distintas: %q y %q", unknown.Body, bad.Body)
+	}
+
+	// ambos cuentan como fallos del login y de la dirección
+	for _, login := range []string{"nadie", "bob"} {
+		if f, _ := loadLoginFailure(LOCKOUT_USER, login); f.Failures != 1 {
+			t.Errorf("%s tiene %d fallos, se esperaba 1", login, f.Failures)
+		}
+	}
+	addr := remoteAddress(httptest.NewRequest(http.MethodGet, "/", nil))
+	if f, _ := loadLoginFailure(LOCKOUT_ADDR, addr); f.Failures != 2 {
+		t.Errorf("la dirección %s tiene %d fallos, se esperaban 2", addr, f.Failures)
+	}
+}
+
+func TestUnlockAddress(t *testing.T) {
+	h := newTestDatabase(t)
+	setLockout(t, LockoutConfig{UserAttempts: 100, AddrAttempts: 1, Delay: time.Minute, MaxDelay: time.Hour, Reset: time.Hour})
+	admin := testLogin(t, h, "admin")
+	bob := testLogin(t, h, "bob")
+	addr := remoteAddress(httptest.NewRequest(http.MethodGet, "/", nil))
+
+	testRequest(h, nil, http.MethodPost, "/users/eva", `"mala"`)
+	if w := testRequest(h, nil, http.MethodPost, "/users/eva", `"`+testPassword+`"`); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("la dirección no está bloqueada: código %d", w.Code)
+	}
+	if w := testRequest(h, bob, http.MethodPut, "/admin/lockouts/"+addr, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("un usuario sin permiso desbloquea la dirección: código %d", w.Code)
+	}
+	if w := testRequest(h, admin, http.MethodPut, "/admin/lockouts/"+addr, ""); w.Code != http.StatusOK {
+		t.Fatalf("no se pudo desbloquear la dirección: %d %s", w.Code, w.Body)
+	}
+	if w := testRequest(h, admin, http.MethodPut, "/admin/lockouts/"+addr, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("se desbloquea una dirección sin fallos: código %d", w.Code)
+	}
+	if w := testRequest(h, admin, http.MethodPut, "/admin/lockouts/1.2.3", ""); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("se acepta una dirección no válida: código %d", w.Code)
+	}
+	testLogin(t, h, "eva")
+}
@@ -0,0 +1,358 @@
+package srv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+
+	Log del servidor
+
+	Cada evento tiene un nivel (debug, info, warn o error), un mensaje y
+	opcionalmente una lista de pares clave/valor. Se escribe en texto o en
+	JSON a una de las salidas disponibles: stderr, un fichero que se rota al
+	alcanzar un tamaño máximo o syslog. Los eventos por debajo del nivel
+	configurado se descartan.
+
+*/
+
+const (
+	LOG_DEBUG = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+type LogConfig struct {
+	Level    string // debug|info|warn|error
+	Format   string // text|json
+	Sink     string // stderr|file|syslog
+	File     string // ruta del fichero para la salida file
+	MaxSize  int    // tamaño en MB a partir del que se rota el fichero
+	MaxFiles int    // ficheros rotados que se conservan
+}
+
+var LogOptions = LogConfig{
+	Level:    "info",
+	Format:   "text",
+	Sink:     "file",
+	File:     "/var/log/gbb/gbb.log",
+	MaxSize:  10,
+	MaxFiles: 5,
+}
+
+// Salida del log. Las salidas que tienen sus propios niveles, como syslog,
+// reciben el nivel de cada línea
+type logSink interface {
+	WriteLevel(level int, line []byte) error
+	Close() error
+}
+
+type Logger struct {
+	level     int
+	json      bool
+	timestamp bool
+	sink      logSink
+	mutex     sync.Mutex
+}
+
+// Hasta que se llama a InitLog los eventos se escriben en stderr
+var logger = &Logger{level: LOG_INFO, timestamp: true, sink: &writerSink{os.Stderr}}
+
+// Configura el log del servidor. Si la salida no se puede abrir el log se
+// queda en stderr y se retorna el error
+func InitLog(config LogConfig) error {
+	level, err := parseLogLevel(config.Level)
+	if err != nil {
+		return err
+	}
+	if config.Format != "text" && config.Format != "json" {
+		return fmt.Errorf("formato de log desconocido: %s", config.Format)
+	}
+
+	var sink logSink
+	timestamp := true
+	switch config.Sink {
+	case "stderr":
+		sink = &writerSink{os.Stderr}
+	case "file":
+		sink, err = openRotatingFile(config.File, int64(config.MaxSize)*1024*1024, config.MaxFiles)
+	case "syslog":
+		// syslog pone su propia marca de tiempo
+		sink, err = openSyslog()
+		timestamp = false
+	default:
+		err = fmt.Errorf("salida de log desconocida: %s", config.Sink)
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	logger.sink.Close()
+	logger.sink = sink
+	logger.level = level
+	logger.json = (config.Format == "json")
+	logger.timestamp = timestamp
+	return nil
+}
+
+// Cierra la salida del log. Los eventos posteriores van a stderr
+func CloseLog() {
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	logger.sink.Close()
+	logger.sink = &writerSink{os.Stderr}
+}
+
+func parseLogLevel(name string) (int, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(n, name) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("nivel de log desconocido: %s", name)
+}
+
+// Escribe un evento. kv es una lista de pares clave/valor
+func (l *Logger) Log(level int, msg string, kv ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if level < l.level {
+		return
+	}
+	now := time.Now()
+	var line []byte
+	if l.json {
+		line = l.formatJSON(now, level, msg, kv)
+	} else {
+		line = l.formatText(now, level, msg, kv)
+	}
+
+	err := l.sink.WriteLevel(level, line)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error escribiendo el log: %s\n%s", err, line)
+	}
+}
+
+func (l *Logger) formatText(now time.Time, level int, msg string, kv []interface{}) []byte {
+	var b strings.Builder
+	if l.timestamp {
+		b.WriteString(now.Format(time.RFC3339))
+		b.WriteString(" ")
+	}
+	fmt.Fprintf(&b, "%-5s %s", strings.ToUpper(logLevelNames[level]), msg)
+	for i := 0; i < len(kv); i += 2 {
+		value := "<nil>"
+		if i+1 < len(kv) {
+			value = fmt.Sprint(kv[i+1])
+		}
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&b, " %v=%s", kv[i], value)
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+func (l *Logger) formatJSON(now time.Time, level int, msg string, kv []interface{}) []byte {
+	event := map[string]interface{}{
+		"level": logLevelNames[level],
+		"msg":   msg,
+	}
+	if l.timestamp {
+		event["time"] = now.Format(time.RFC3339Nano)
+	}
+	for i := 0; i < len(kv); i += 2 {
+		var value interface{}
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case time.Duration:
+			value = v.String()
+		}
+		event[fmt.Sprint(kv[i])] = value
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"level": logLevelNames[level], "msg": msg})
+	}
+	return append(line, '\n')
+}
+
+func logDebug(msg string, kv ...interface{}) {
+	logger.Log(LOG_DEBUG, msg, kv...)
+}
+
+func logInfo(msg string, kv ...interface{}) {
+	logger.Log(LOG_INFO, msg, kv...)
+}
+
+func logWarn(msg string, kv ...interface{}) {
+	logger.Log(LOG_WARN, msg, kv...)
+}
+
+func logError(msg string, kv ...interface{}) {
+	logger.Log(LOG_ERROR, msg, kv...)
+}
+
+/*
+	Salidas del log
+*/
+
+type writerSink struct {
+	w io.Writer
+}
+
+func (ws *writerSink) WriteLevel(level int, line []byte) error {
+	_, err := ws.w.Write(line)
+	return err
+}
+
+func (ws *writerSink) Close() error {
+	return nil
+}
+
+// Fichero de log que al superar maxSize bytes se renombra a path.1 (y los
+// anteriores a path.2, path.3...) conservando como mucho maxFiles ficheros
+// antiguos. Con maxSize igual a 0 no se rota nunca
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return rf, rf.open()
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.file = f
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) rotate() error {
+	rf.file.Close()
+	rf.file = nil
+	for i := rf.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	var err error
+	if rf.maxFiles > 0 {
+		err = os.Rename(rf.path, rf.path+".1")
+	} else {
+		err = os.Remove(rf.path)
+	}
+	if err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) WriteLevel(level int, line []byte) error {
+	if rf.file == nil {
+		// falló la última rotación, lo volvemos a intentar
+		if err := rf.open(); err != nil {
+			return err
+		}
+	}
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(line)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := rf.file.Write(line)
+	rf.size += int64(n)
+	return err
+}
+
+func (rf *rotatingFile) Close() error {
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+/*
+	Log de peticiones
+*/
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// Middleware que registra cada petición con su método, ruta, código de
+// respuesta, latencia y usuario
+func (a *api) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r, login := withRequestUser(r)
+		next.ServeHTTP(rec, r)
+
+		route := r.URL.Path
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tpl, err := cr.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		user := *login
+		if user == "" {
+			user = "-"
+		}
+
+		latency := time.Since(start)
+		metrics.observeRequest(r.Method, route, rec.status, latency)
+
+		level := LOG_INFO
+		if rec.status >= 500 {
+			level = LOG_ERROR
+		} else if rec.status >= 400 {
+			level = LOG_WARN
+		}
+		logger.Log(level, "Petición", "method", r.Method, "route", route, "status", rec.status,
+			"latency", latency.Round(time.Microsecond), "user", user, "remote", remoteAddress(r))
+	})
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package srv
+
+import (
+	"errors"
+)
+
+func openSyslog() (logSink, error) {
+	return nil, errors.New("syslog no está disponible en este sistema")
+}
@@ -0,0 +1,38 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package srv
+
+import (
+	"log/syslog"
+)
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func openSyslog() (logSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "gbb")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w}, nil
+}
+
+func (ss *syslogSink) WriteLevel(level int, line []byte) error {
+	msg := string(line)
+	switch level {
+	case LOG_DEBUG:
+		return ss.w.Debug(msg)
+	case LOG_INFO:
+		return ss.w.Info(msg)
+	case LOG_WARN:
+		return ss.w.Warning(msg)
+	default:
+		return ss.w.Err(msg)
+	}
+}
+
+func (ss *syslogSink) Close() error {
+	return ss.w.Close()
+}
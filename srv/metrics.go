@@ -0,0 +1,291 @@
+package srv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+
+	Salud y métricas
+
+	/healthz comprueba que se puede acceder a la base de datos y /metrics
+	retorna las métricas del servidor en el formato de texto de Prometheus.
+	Si se configura AdminListenAddress ambas se sirven solo en esa
+	dirección, aparte de la API, y si no junto a la API. /healthz no cuenta
+	el motivo de un fallo, que queda en el log.
+
+	gbb_db_query_duration_seconds mide cada sentencia con la base de datos,
+	ver dbtiming.go.
+
+	Los inicios de sesión fallidos se cuentan al auditarlos, así que cada
+	motivo de fallo del registro de auditoría es una serie distinta.
+
+*/
+
+// Dirección en la que se sirven /healthz y /metrics. Vacía para servirlas
+// junto a la API
+var AdminListenAddress = ""
+
+// Límites superiores en segundos de los intervalos de los histogramas
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type histogram struct {
+	counts []uint64 // observaciones de cada intervalo, sin acumular
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Escribe las series del histograma. labels va sin llaves, por ejemplo
+// `route="/board"`, y puede estar vacío
+func (h *histogram) write(w io.Writer, name string, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	cumulative := uint64(0)
+	for i, le := range latencyBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+type requestKey struct {
+	method string
+	route  string
+	status int
+}
+
+type routeKey struct {
+	method string
+	route  string
+}
+
+type serverMetrics struct {
+	requests      map[requestKey]uint64
+	latency       map[routeKey]*histogram
+	dbQuery       *histogram
+	loginFailures map[string]uint64
+	rateLimited   map[string]uint64
+	mutex         sync.Mutex
+}
+
+var metrics = &serverMetrics{
+	requests:      make(map[requestKey]uint64),
+	latency:       make(map[routeKey]*histogram),
+	dbQuery:       newHistogram(),
+	loginFailures: make(map[string]uint64),
+	rateLimited:   make(map[string]uint64),
+}
+
+func (m *serverMetrics) observeRequest(method string, route string, status int, latency time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.requests[requestKey{method, route, status}]++
+	h := m.latency[routeKey{method, route}]
+	if h == nil {
+		h = newHistogram()
+		m.latency[routeKey{method, route}] = h
+	}
+	h.observe(latency)
+}
+
+func (m *serverMetrics) observeDBQuery(latency time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.dbQuery.observe(latency)
+}
+
+func (m *serverMetrics) loginFailed(reason string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.loginFailures[reason]++
+}
+
+func (m *serverMetrics) rateLimitRejected(limiter string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rateLimited[limiter]++
+}
+
+// Escapa un valor de etiqueta
+func labelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func (m *serverMetrics) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintln(w, "# HELP gbb_http_requests_total Peticiones atendidas por método, ruta y código de respuesta.")
+	fmt.Fprintln(w, "# TYPE gbb_http_requests_total counter")
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "gbb_http_requests_total{method=\"%s\",route=\"%s\",status=\"%d\"} %d\n",
+			k.method, labelValue(k.route), k.status, m.requests[k])
+	}
+
+	fmt.Fprintln(w, "# HELP gbb_http_request_duration_seconds Latencia de las peticiones por método y ruta.")
+	fmt.Fprintln(w, "# TYPE gbb_http_request_duration_seconds histogram")
+	routes := make([]routeKey, 0, len(m.latency))
+	for k := range m.latency {
+		routes = append(routes, k)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].route != routes[j].route {
+			return routes[i].route < routes[j].route
+		}
+		return routes[i].method < routes[j].method
+	})
+	for _, k := range routes {
+		labels := fmt.Sprintf("method=\"%s\",route=\"%s\"", k.method, labelValue(k.route))
+		m.latency[k].write(w, "gbb_http_request_duration_seconds", labels)
+	}
+
+	fmt.Fprintln(w, "# HELP gbb_db_query_duration_seconds Latencia de las sentencias con la base de datos.")
+	fmt.Fprintln(w, "# TYPE gbb_db_query_duration_seconds histogram")
+	m.dbQuery.write(w, "gbb_db_query_duration_seconds", "")
+
+	writeCounterMap(w, "gbb_login_failures_total", "Inicios de sesión fallidos por motivo.", "reason", m.loginFailures)
+	writeCounterMap(w, "gbb_rate_limit_rejections_total", "Peticiones rechazadas por superar un límite.", "limiter", m.rateLimited)
+}
+
+func writeCounterMap(w io.Writer, name string, help string, label string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, labelValue(k), values[k])
+	}
+}
+
+// Escribe las métricas que se leen de la base de datos en cada consulta
+func writeBoardMetrics(w io.Writer) error {
+	threads, messages, users := 0, 0, 0
+	err := func() error {
+		db, err := GetConnection()
+		defer CloseConnection(db)
+		if err != nil {
+			return err
+		}
+		return db.QueryRow(`SELECT (SELECT COUNT(*) FROM threads), (SELECT COUNT(*) FROM messages),
+			(SELECT COUNT(*) FROM users);`).Scan(&threads, &messages, &users)
+	}()
+	if err != nil {
+		return err
+	}
+	list, err := sessions.List("")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	active := 0
+	for _, s := range list {
+		if !s.Expired(now) {
+			active++
+		}
+	}
+
+	for _, g := range []struct {
+		name  string
+		help  string
+		value int
+	}{
+		{"gbb_sessions_active", "Sesiones abiertas sin caducar.", active},
+		{"gbb_threads", "Hilos del tablón.", threads},
+		{"gbb_messages", "Mensajes del tablón.", messages},
+		{"gbb_users", "Usuarios registrados.", users},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.value)
+	}
+	return nil
+}
+
+func (a *api) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintf(w, "# HELP gbb_build_info Versión del servidor.\n# TYPE gbb_build_info gauge\n")
+	fmt.Fprintf(w, "gbb_build_info{version=\"%s\",api=\"%d\"} 1\n", VERSION, API_VERSION)
+	err := writeBoardMetrics(w)
+	if err != nil {
+		logError("BD ERROR: Falló leer las métricas del tablón", "error", err)
+	}
+	metrics.write(w)
+}
+
+type HealthStatus struct {
+	Status   string `json:"status"`
+	Database string `json:"database"`
+}
+
+// Comprueba que la base de datos responde. Retorna 503 si no lo hace
+func (a *api) healthz(w http.ResponseWriter, r *http.Request) {
+	status := HealthStatus{Status: "ok", Database: "ok"}
+	err := func() error {
+		db, err := GetConnection()
+		defer CloseConnection(db)
+		if err != nil {
+			return err
+		}
+		n := 0
+		return db.QueryRow("SELECT COUNT(*) FROM users;").Scan(&n)
+	}()
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		logError("BD ERROR: Falló la comprobación de salud", "error", err)
+		status = HealthStatus{Status: "error", Database: "error"}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// Rutas de salud y métricas
+func (a *api) addAdminRoutes(r *mux.Router) {
+	r.HandleFunc("/healthz", a.healthz).Methods(http.MethodGet)
+	r.HandleFunc("/metrics", a.serveMetrics).Methods(http.MethodGet)
+}
@@ -175,7 +175,7 @@ func createMockBoardSQL() {
 		nmessages := rand.Intn(MAX_MESSAGES_PER_THREAD-MIN_MESSAGES_PER_THREAD) + MIN_MESSAGES_PER_THREAD
 		for i := 0; i < nmessages; i++ {
 			m := RandomMessage()
-			date := m.DateString()
+			date := m.Stamp.Format(DB_DATE_FORMAT)
 			fmt.Printf("INSERT INTO messages (thread, author,stamp,content) VALUES ('%s','%s','%s','%s');\n", th.Id, m.Author, date, m.Text)
 		}
 	}
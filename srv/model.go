@@ -1,14 +1,27 @@
 package srv
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
 	"errors"
 	"fmt"
+	"math/big"
+	"regexp"
 	"strings"
 	"time"
 	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
-var DATE_FORMAT = "02/01/06"
+// Formato con el que se guardan las fechas de los mensajes en la base de
+// datos. No puede cambiar sin convertir las filas ya guardadas
+const DB_DATE_FORMAT = "02/01/06"
+
+// Formato con el que se muestran las fechas, client.date_format
+var DATE_FORMAT = DB_DATE_FORMAT
 
 /*
 
@@ -17,11 +30,14 @@ var DATE_FORMAT = "02/01/06"
 */
 
 type Message struct {
-	Id     int       `json:"id"`
-	Parent *Thread   `json:"-"`
-	Author string    `json:"author"`
-	Stamp  time.Time `json:"stamp"`
-	Text   string    `json:"text"`
+	Id      int       `json:"id"`
+	Parent  *Thread   `json:"-"`
+	Author  string    `json:"author"`
+	Stamp   time.Time `json:"stamp"`
+	Text    string    `json:"text"`
+	ReplyTo int       `json:"replyto"` // Id del mensaje al que responde. 0 si responde al hilo
+	Version int       `json:"version"` // empieza en 1 y aumenta con cada edición
+	Held    bool      `json:"held"`    // retenido por un filtro hasta que lo revise un moderador
 }
 
 func NewMessage(author string, text string) *Message {
@@ -80,31 +96,38 @@ func (m *Message) SplitInLines(nchars int) []string {
 	return msg
 }
 
-// Imprime la fecha en el formato establecido
+// Imprime la fecha en el formato de client.date_format
 func (m *Message) DateString() string {
 	return m.Stamp.Format(DATE_FORMAT)
 }
 
-// Fija una fecha nueva a un mensaje
+// Fija a un mensaje la fecha guardada en la base de datos
 func (m *Message) SetDate(datestr string) {
-	t, err := time.Parse(DATE_FORMAT, datestr)
-	if err == nil {
-		m.Stamp = t
+	t, err := time.Parse(DB_DATE_FORMAT, datestr)
+	if err != nil {
+		logWarn("Fecha de mensaje no válida en la base de datos", "message", m.Id, "date", datestr)
+		return
 	}
+	m.Stamp = t
 }
 
 // Inserta un mensaje nuevo o actualiza un mensaje ya guardado en la base de datos.
 // El parámetro update decide esto. En el caso de ser actualizado, solo podemos
 // cambiar el contenido del mensaje
 func (m *Message) Save(update bool) error {
-	date := m.DateString()
+	date := m.Stamp.Format(DB_DATE_FORMAT)
 
 	escapeText:=strings.Replace(m.Text,"'","''",-1)
 	q := ""
 	if update {
-		q = fmt.Sprintf("UPDATE messages SET content='%s' WHERE id='%d';", escapeText, m.Id)
+		q = fmt.Sprintf("UPDATE messages SET content='%s', version='%d' WHERE id='%d';", escapeText, m.Version, m.Id)
 	} else {
-		q = fmt.Sprintf("INSERT INTO messages (thread, author,stamp,content) VALUES ('%s','%s','%s','%s');", m.Parent.Id, m.Author, date, escapeText)
+		m.Version = 1
+		held := 0
+		if m.Held {
+			held = 1
+		}
+		q = fmt.Sprintf("INSERT INTO messages (thread, author,stamp,content,replyTo,version,held) VALUES ('%s','%s','%s','%s','%d','%d','%d');", m.Parent.Id, m.Author, date, escapeText, m.ReplyTo, m.Version, held)
 	}
 
 	db,err:=GetConnection()
@@ -130,6 +153,48 @@ func (m *Message) Save(update bool) error {
 	return nil
 }
 
+// Error al editar un mensaje que ha cambiado desde que se leyó
+var ErrEditConflict = errors.New("El mensaje ha sido modificado por otro usuario")
+
+// Guarda el texto del mensaje con la versión siguiente a expected, solo si
+// en la base de datos sigue estando en esa versión. Si no lo está retorna
+// ErrEditConflict
+func (m *Message) SaveIfVersion(expected int) error {
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec("UPDATE messages SET content=?, version=? WHERE id=? AND version=?;", m.Text, expected+1, m.Id, expected)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrEditConflict
+	}
+	m.Version = expected + 1
+	return nil
+}
+
+// Guarda si el mensaje está retenido
+func (m *Message) SaveHeld() error {
+	held := 0
+	if m.Held {
+		held = 1
+	}
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE messages SET held=? WHERE id=?;", held, m.Id)
+	return err
+}
+
 // Borra un mensaje de la base de datos
 func (m *Message) DeleteFromBD() error {
 	q := fmt.Sprintf("DELETE FROM messages WHERE id=%d;", m.Id)
@@ -157,16 +222,21 @@ func (m *Message) String() string {
 */
 
 type Thread struct {
-	Messages    []*Message
-	Id          string    `json:"id"`
-	Len         int       `json:"len"`
-	Author      string    `json:"author"`
-	UpdateStamp time.Time `json:"ustamp"`
-	CreateStamp time.Time `json:"cstamp"`
-	Title       string    `json:"title"`
-	IsClosed    bool      `json:"isclosed"`
-	IsFixed     bool      `json:"isfixed"`
-	Hide        bool
+	Messages     []*Message
+	Id           string    `json:"id"`
+	Len          int       `json:"len"`
+	Author       string    `json:"author"`
+	UpdateStamp  time.Time `json:"ustamp"`
+	CreateStamp  time.Time `json:"cstamp"`
+	Title        string    `json:"title"`
+	IsClosed     bool      `json:"isclosed"`
+	IsFixed      bool      `json:"isfixed"`
+	PinExpires   time.Time `json:"pinexpires"`   // fecha cero si la fijación no caduca
+	PinOrder     int       `json:"pinorder"`     // orden entre los hilos fijados, de menor a mayor
+	Announcement bool      `json:"announcement"` // se muestra al arrancar el cliente hasta que se confirma
+	Held         bool      `json:"held"`         // retenido por un filtro hasta que lo revise un moderador
+	Category     string    `json:"category"`     // vacía si el hilo no tiene categoría
+	Hide         bool
 }
 
 func NewThread(title string, first *Message) *Thread {
@@ -194,22 +264,23 @@ func (t *Thread) Save() error {
 	if t.IsFixed {
 		fixed = 1
 	}
-	q := fmt.Sprintf("INSERT INTO threads (id,title,IsClosed,IsFixed) VALUES ('%s','%s','%d','%d');\n", t.Id, t.Title, closed, fixed)
+	held := 0
+	if t.Held {
+		held = 1
+	}
+	q := "INSERT INTO threads (id,title,IsClosed,IsFixed,held,category) VALUES (?,?,?,?,?,?);"
 
-	db,err:=GetConnection()
+	db, err := GetConnection()
 	defer CloseConnection(db)
-	if err!=nil{return err}
-
-	statement, err := db.Prepare(q)
 	if err != nil {
 		return err
 	}
-	_, err = statement.Exec()
+	_, err = db.Exec(q, t.Id, t.Title, closed, fixed, held, t.Category)
 	return err
-	
 }
 
-// Actualiza un hilo de la base de datos. Solo pueden ser actualizados los campos de fixed o closed.
+// Actualiza un hilo de la base de datos. Solo pueden ser actualizados los campos de fixed, closed, held y
+// las opciones de la fijación.
 func (t *Thread) Update() error{
 	closed := 0
 	if t.IsClosed {
@@ -219,8 +290,22 @@ func (t *Thread) Update() error{
 	if t.IsFixed {
 		fixed = 1
 	}
+	held := 0
+	if t.Held {
+		held = 1
+	}
 
-	q := fmt.Sprintf("UPDATE threads SET IsClosed='%d', IsFixed='%d' WHERE id='%s';\n", closed, fixed, t.Id)
+	announcement := 0
+	if t.Announcement {
+		announcement = 1
+	}
+	pinExpires := ""
+	if !t.PinExpires.IsZero() {
+		pinExpires = t.PinExpires.UTC().Format(time.RFC3339)
+	}
+
+	q := fmt.Sprintf("UPDATE threads SET IsClosed='%d', IsFixed='%d', held='%d', pinExpires='%s', pinOrder='%d', announcement='%d' WHERE id='%s';\n",
+		closed, fixed, held, pinExpires, t.PinOrder, announcement, t.Id)
 
 	db,err:=GetConnection()
 	defer CloseConnection(db)
@@ -295,6 +380,55 @@ func (t *Thread) delMessage(m *Message) error {
 	return nil
 }
 
+// Retorna el mensaje del hilo con ese id o nil si no pertenece al hilo
+func (t *Thread) getMessage(id int) *Message {
+	for _, m := range t.Messages {
+		if m.Id == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// Error al borrar un mensaje que no es una respuesta del hilo
+var ErrNotAReply = errors.New("El primer mensaje del hilo no se puede borrar, solo las respuestas")
+
+// Posición del mensaje en el hilo o -1 si no pertenece a él
+func (t *Thread) messageIndex(m *Message) int {
+	for i, m2 := range t.Messages {
+		if m2.Id == m.Id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Borra una respuesta del hilo. Las respuestas al mensaje pasan a responder
+// al mismo mensaje al que respondía este, así no quedan respuestas huérfanas
+// en el árbol del hilo. El primer mensaje no se puede borrar
+func (t *Thread) deleteReply(m *Message) error {
+	if t.messageIndex(m) <= 0 {
+		return ErrNotAReply
+	}
+	err := WithTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE messages SET replyTo=? WHERE replyTo=?;", m.ReplyTo, m.Id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM messages WHERE id=?;", m.Id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, m2 := range t.Messages {
+		if m2.ReplyTo == m.Id {
+			m2.ReplyTo = m.ReplyTo
+		}
+	}
+	return t.delMessage(m)
+}
+
 // Retorna la fecha de creación del hilo (la del primer mensaje)
 func (t *Thread) GetCreateStamp() time.Time {
 	if (t.Messages == nil) || len(t.Messages) == 0 {
@@ -324,13 +458,23 @@ func (t *Thread) GetAuthor() string {
 }
 
 func (t *Thread) String() string {
+	title := t.Title
+	if t.Category != "" {
+		title = "[" + t.Category + "] " + title
+	}
+	if t.Announcement {
+		title = "[anuncio] " + title
+	}
+	if t.IsFixed && !t.PinExpires.IsZero() {
+		title += " (fijado hasta el " + t.PinExpires.Local().Format(DATE_FORMAT) + ")"
+	}
 	if t.IsClosed {
-		return fmt.Sprintf(" %s|%-20s !! %s ", t.UpdateStamp.Format(DATE_FORMAT), t.Author, t.Title)
+		return fmt.Sprintf(" %s|%-20s !! %s ", t.UpdateStamp.Format(DATE_FORMAT), t.Author, title)
 	}
 	if (t.Len) > 1 {
-		return fmt.Sprintf(" %s|%-20s %-2d %s ", t.UpdateStamp.Format(DATE_FORMAT), t.Author, t.Len-1, t.Title)
+		return fmt.Sprintf(" %s|%-20s %-2d %s ", t.UpdateStamp.Format(DATE_FORMAT), t.Author, t.Len-1, title)
 	} else {
-		return fmt.Sprintf(" %s|%-20s    %s ", t.UpdateStamp.Format(DATE_FORMAT), t.Author, t.Title)
+		return fmt.Sprintf(" %s|%-20s    %s ", t.UpdateStamp.Format(DATE_FORMAT), t.Author, title)
 	}
 }
 
@@ -356,7 +500,7 @@ func CreateBoard() *Board {
 
 // Carga de la base de datos solo la tabla de usuarios
 func (b *Board) LoadUsers() error {
-	q := `SELECT login, password, isAdmin, isBanned FROM users`
+	q := `SELECT login, password, isAdmin, banLevel, banReason, bannedBy, banExpires, created FROM users`
 
 	db,err:=GetConnection()
 	defer CloseConnection(db)
@@ -368,25 +512,37 @@ func (b *Board) LoadUsers() error {
 	}
 	defer rows.Close()
 
+	// la tabla se vuelve a cargar entera en cada recarga
+	b.Users = make([]*User, 0)
 	for rows.Next() {
 		login := ""
 		pass := make([]byte, 100)
-		isBanned := 0
 		isAdmin := 0
+		banExpires := ""
+		created := ""
+		u := NewUser("", nil)
 		rows.Scan(
 			&login,
 			&pass,
 			&isAdmin,
-			&isBanned,
+			&u.BanLevel,
+			&u.BanReason,
+			&u.BannedBy,
+			&banExpires,
+			&created,
 		)
 
-		u := NewUser(login, pass)
-		u.IsAdmin = (isAdmin == 1)
-		u.IsBanned = (isBanned == 1)
+		u.Login = login
+		u.Password = pass
+		u.storedAdmin = (isAdmin == 1)
+		u.applyGroups()
+		u.IsBanned = (u.BanLevel != BAN_NONE)
+		u.BanExpires, _ = time.Parse(time.RFC3339, banExpires)
+		u.Created, _ = time.Parse(time.RFC3339, created)
 		b.AddUser(u)
 	}
 
-	return nil
+	return b.loadRoles(db)
 }
 
 // Carga toda la base de datos
@@ -400,7 +556,7 @@ func (b *Board) Load() error {
 
 	// Recuperamos los threads
 	q := `SELECT
-            id, title, IsClosed, IsFixed
+            id, title, IsClosed, IsFixed, held, category, pinExpires, pinOrder, announcement
             FROM threads`
 
 	rows, err := db.Query(q)
@@ -412,22 +568,31 @@ func (b *Board) Load() error {
 
 	for rows.Next() {
 		var th Thread
-		var closedVal, fixedVal int
+		var closedVal, fixedVal, heldVal, announcementVal int
+		pinExpires := ""
 		rows.Scan(
 			&th.Id,
 			&th.Title,
 			&closedVal,
 			&fixedVal,
+			&heldVal,
+			&th.Category,
+			&pinExpires,
+			&th.PinOrder,
+			&announcementVal,
 		)
 		th.IsClosed = (closedVal == 1)
 		th.IsFixed = (fixedVal == 1)
+		th.Held = (heldVal == 1)
+		th.PinExpires, _ = time.Parse(time.RFC3339, pinExpires)
+		th.Announcement = (announcementVal == 1)
 		th.Hide = false
 		b.Threads = append(b.Threads, &th)
 	}
 
 	// Recuperamos todos los mensajes y los metemos en sus threads
 	q = `SELECT
-		id, thread, author, stamp, content
+		id, thread, author, stamp, content, replyTo, version, held
 		FROM messages`
 
 	rows, err = db.Query(q)
@@ -441,13 +606,18 @@ func (b *Board) Load() error {
 		m := NewMessage("", "")
 		threadKey := ""
 		dateString := ""
+		held := 0
 		rows.Scan(
 			&m.Id,
 			&threadKey,
 			&m.Author,
 			&dateString,
 			&m.Text,
+			&m.ReplyTo,
+			&m.Version,
+			&held,
 		)
+		m.Held = (held == 1)
 		th := b.getThread(threadKey)
 		if th != nil {
 			m.SetDate(dateString)
@@ -466,6 +636,9 @@ func (b *Board) Len() int      { return len(b.Threads) }
 func (b *Board) Swap(i, j int) { b.Threads[i], b.Threads[j] = b.Threads[j], b.Threads[i] }
 func (b *Board) Less(i, j int) bool {
 	if b.Threads[i].IsFixed == b.Threads[j].IsFixed {
+		if b.Threads[i].IsFixed && b.Threads[i].PinOrder != b.Threads[j].PinOrder {
+			return b.Threads[i].PinOrder < b.Threads[j].PinOrder
+		}
 		return b.Threads[i].UpdateStamp.After(b.Threads[j].UpdateStamp)
 	} else {
 		if b.Threads[i].IsFixed {
@@ -559,11 +732,27 @@ func (b *Board) GetUser(login string) *User {
 
 */
 
+// Niveles de bloqueo de un usuario. Con BAN_READONLY puede entrar y leer
+// pero no escribir. Con BAN_FULL no puede ni iniciar sesión
+const (
+	BAN_NONE     = 0
+	BAN_READONLY = 1
+	BAN_FULL     = 2
+)
+
 type User struct {
-	Login    string `json:"login"`
-	Password []byte `json:"-"`
-	IsAdmin  bool   `json:"isadmin"`
-	IsBanned bool   `json:"isbanned"`
+	Login       string      `json:"login"`
+	Password    []byte      `json:"-"`
+	IsAdmin     bool        `json:"isadmin"` // por promote o por los grupos del sistema
+	IsBanned    bool        `json:"isbanned"`
+	BanLevel    int         `json:"banlevel"`
+	BanReason   string      `json:"banreason"`
+	BannedBy    string      `json:"bannedby"`
+	BanExpires  time.Time   `json:"banexpires"` // fecha cero si el bloqueo no caduca
+	Created     time.Time   `json:"created"`    // fecha cero en las cuentas anteriores a guardarla
+	Roles       []RoleGrant `json:"roles"`      // roles además de user, sin contar el de administrador global
+	GroupRole   string      `json:"grouprole"`  // rol que le dan los grupos del sistema, no se guarda
+	storedAdmin bool        // isAdmin de la base de datos
 }
 
 func NewUser(login string, pass []byte) *User {
@@ -572,25 +761,91 @@ func NewUser(login string, pass []byte) *User {
 	u.Password = pass
 	u.IsAdmin = false
 	u.IsBanned = false
+	u.BanLevel = BAN_NONE
 	return u
 }
 
+// Bloquea al usuario. Si expires es la fecha cero el bloqueo no caduca
+func (u *User) Ban(level int, reason string, by string, expires time.Time) {
+	u.BanLevel = level
+	u.BanReason = reason
+	u.BannedBy = by
+	u.BanExpires = expires
+	u.IsBanned = (level != BAN_NONE)
+}
+
+func (u *User) Unban() {
+	u.Ban(BAN_NONE, "", "", time.Time{})
+}
+
+// Levanta el bloqueo si ya ha caducado. Retorna el nivel de bloqueo vigente
+func (u *User) ActiveBanLevel() int {
+	if u.BanLevel != BAN_NONE && !u.BanExpires.IsZero() && time.Now().After(u.BanExpires) {
+		u.Unban()
+		err := u.Save(true)
+		if err != nil {
+			logError("BD ERROR: Falló levantar el bloqueo caducado", "user", u.Login, "error", err)
+		} else {
+			logInfo("Ha caducado el bloqueo", "user", u.Login)
+		}
+	}
+	return u.BanLevel
+}
+
+// El usuario puede iniciar sesión y leer el tablón
+func (u *User) CanRead() bool {
+	return u.ActiveBanLevel() != BAN_FULL
+}
+
+// El usuario puede crear, modificar o borrar contenido
+func (u *User) CanWrite() bool {
+	return u.ActiveBanLevel() == BAN_NONE
+}
+
+// Texto que se muestra al usuario bloqueado
+func (u *User) BanMessage() string {
+	if u.BanLevel == BAN_NONE {
+		return ""
+	}
+	text := "Cuenta bloqueada"
+	if u.BanLevel == BAN_READONLY {
+		text = "Cuenta en modo solo lectura"
+	}
+	if u.BannedBy != "" {
+		text += " por " + u.BannedBy
+	}
+	if u.BanReason != "" {
+		text += ": " + u.BanReason
+	}
+	if !u.BanExpires.IsZero() {
+		text += " (hasta el " + u.BanExpires.Format(DATE_FORMAT) + ")"
+	}
+	return text
+}
+
 // Save or update an user in the database
 func (u *User) Save(update bool) error{
 	q := ""
 	isadmin := 0
-	if u.IsAdmin {
+	if u.storedAdmin {
 		isadmin = 1
 	}
 	isbanned := 0
 	if u.IsBanned {
 		isbanned = 1
 	}
+	banExpires := ""
+	if !u.BanExpires.IsZero() {
+		banExpires = u.BanExpires.Format(time.RFC3339)
+	}
 	password := string(u.Password[:])
 	if update {
-		q = fmt.Sprintf("UPDATE users SET password='%s',isAdmin='%d', isBanned='%d' WHERE login='%s';", password, isadmin, isbanned, u.Login)
+		q = "UPDATE users SET password=?, isAdmin=?, isBanned=?, banLevel=?, banReason=?, bannedBy=?, banExpires=? WHERE login=?;"
 	} else {
-		q = fmt.Sprintf("INSERT INTO users (login,password,isAdmin,isBanned) VALUES ('%s','%s','0','0');", u.Login, password)
+		if u.Created.IsZero() {
+			u.Created = time.Now()
+		}
+		q = "INSERT INTO users (password,isAdmin,isBanned,banLevel,banReason,bannedBy,banExpires,login,created) VALUES (?,?,?,?,?,?,?,?,?);"
 	}
 
 	db,err:=GetConnection()
@@ -601,6 +856,119 @@ func (u *User) Save(update bool) error{
 	if err != nil {
 		return err
 	}
-	_, err = statement.Exec()
+	args := []interface{}{password, isadmin, isbanned, u.BanLevel, u.BanReason, u.BannedBy, banExpires, u.Login}
+	if !update {
+		args = append(args, u.Created.UTC().Format(time.RFC3339))
+	}
+	_, err = statement.Exec(args...)
 	return err
 }
+
+// Credenciales generadas por el servidor para un usuario nuevo o tras
+// resetear su contraseña
+type UserCredentials struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+const GENERATED_PASSWORD_LEN = 10
+
+var validLogin = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// Retorna la contraseña tal y como se guarda en la tabla de usuarios: un
+// hash bcrypt, que lleva su propia sal
+func hashPassword(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// Las contraseñas de versiones anteriores se guardaban como el SHA-256 en
+// hexadecimal, sin sal. Se reconocen porque no empiezan por "$"
+func isLegacyHash(hash []byte) bool {
+	return len(hash) > 0 && hash[0] != '$'
+}
+
+// Comprueba la contraseña del usuario. Si coincide con un hash antiguo lo
+// sustituye por uno bcrypt
+func (u *User) CheckPassword(password string) bool {
+	if !isLegacyHash(u.Password) {
+		return bcrypt.CompareHashAndPassword(u.Password, []byte(password)) == nil
+	}
+	sum := sha256.Sum256([]byte(password))
+	if subtle.ConstantTimeCompare([]byte(fmt.Sprintf("%x", sum)), u.Password) != 1 {
+		return false
+	}
+	err := u.SetPassword(password)
+	if err != nil {
+		logError("No se pudo actualizar el hash de la contraseña", "user", u.Login, "error", err)
+	} else {
+		logInfo("Actualizado el hash de la contraseña a bcrypt", "user", u.Login)
+	}
+	return true
+}
+
+// Cambia la contraseña del usuario y la guarda en la base de datos
+func (u *User) SetPassword(password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	old := u.Password
+	u.Password = hash
+	err = u.Save(true)
+	if err != nil {
+		u.Password = old
+	}
+	return err
+}
+
+// Genera con crypto/rand una contraseña aleatoria de letras minúsculas
+func randomPassword() (string, error) {
+	letters := "abcdefghijklmnopqrstuvwxyz"
+	b := make([]byte, GENERATED_PASSWORD_LEN)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(letters))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = letters[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// Crea un usuario nuevo con una contraseña aleatoria. Retorna sus credenciales
+func (b *Board) createUser(login string) (*UserCredentials, error) {
+	if !validLogin.MatchString(login) {
+		return nil, errors.New("Login no válido")
+	}
+	if b.GetUser(login) != nil {
+		return nil, errors.New("El usuario ya existe")
+	}
+	password, err := randomPassword()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	u := NewUser(login, hash)
+	err = u.Save(false)
+	if err != nil {
+		return nil, err
+	}
+	b.AddUser(u)
+	return &UserCredentials{login, password}, nil
+}
+
+// Asigna una contraseña aleatoria nueva a un usuario. Retorna sus credenciales
+func (b *Board) resetPassword(u *User) (*UserCredentials, error) {
+	password, err := randomPassword()
+	if err != nil {
+		return nil, err
+	}
+	err = u.SetPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	return &UserCredentials{u.Login, password}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package srv
+
+import (
+	"errors"
+	"net"
+)
+
+// SO_PEERCRED solo existe en Linux
+func peerUID(c *net.UnixConn) (uint32, error) {
+	return 0, errors.New("la identificación por socket local solo está disponible en Linux")
+}
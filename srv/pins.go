@@ -0,0 +1,250 @@
+package srv
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+
+	Hilos fijados y anuncios
+
+	Un hilo fijado aparece en la cabecera del tablón. Al fijarlo se puede
+	indicar una fecha de caducidad, tras la que lo suelta una rutina del
+	servidor, y un orden: los hilos fijados se ordenan por ese número de
+	menor a mayor y, a igualdad, por su última actividad.
+
+	Un hilo fijado puede ser además un anuncio. El cliente muestra al
+	arrancar los anuncios que el usuario no ha confirmado todavía, y las
+	confirmaciones se guardan en la tabla announcement_acks. Al soltar el
+	hilo deja de ser un anuncio, y al volver a anunciarlo se olvidan las
+	confirmaciones para que todos lo vean de nuevo.
+
+*/
+
+// Opciones con las que se fija un hilo en PUT /threads/{id}/fixed
+type PinRequest struct {
+	Expires      time.Time `json:"expires"` // fecha cero para que no se suelte solo
+	Order        int       `json:"order"`
+	Announcement bool      `json:"announcement"`
+}
+
+func validatePin(p PinRequest) error {
+	if !p.Expires.IsZero() && p.Expires.Before(time.Now()) {
+		return invalid("expires", "La fecha de caducidad ya ha pasado")
+	}
+	return nil
+}
+
+func (t *Thread) Pin(p PinRequest) {
+	t.IsFixed = true
+	t.PinExpires = p.Expires
+	t.PinOrder = p.Order
+	t.Announcement = p.Announcement
+}
+
+func (t *Thread) Unpin() {
+	t.Pin(PinRequest{})
+	t.IsFixed = false
+}
+
+// Texto con el que se registra en la auditoría cómo está fijado el hilo
+func (t *Thread) pinStatus() string {
+	if !t.IsFixed {
+		return "free"
+	}
+	status := []string{"fixed"}
+	if t.PinOrder != 0 {
+		status = append(status, fmt.Sprintf("order=%d", t.PinOrder))
+	}
+	if !t.PinExpires.IsZero() {
+		status = append(status, "expires="+t.PinExpires.UTC().Format(time.RFC3339))
+	}
+	if t.Announcement {
+		status = append(status, "announcement")
+	}
+	return strings.Join(status, " ")
+}
+
+func InitPins() {
+	go pinRoutine()
+}
+
+// Única rutina que suelta los hilos cuya fijación ha caducado
+func pinRoutine() {
+	for runBackground(releaseExpiredPins) {
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// Hilos soltados en la base de datos que el tablón todavía no ha soltado
+var expiredPins struct {
+	sync.Mutex
+	ids []string
+}
+
+// Suelta en la base de datos los hilos cuya fijación ha caducado. La rutina
+// no toca el tablón, que solo modifican las peticiones: deja los hilos en
+// expiredPins para que los suelte la siguiente
+func releaseExpiredPins() {
+	now := time.Now().UTC().Format(time.RFC3339)
+	var ids []string
+	err := WithTransaction(func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT id FROM threads WHERE IsFixed=1 AND pinExpires<>'' AND pinExpires<=?;", now)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			_, err := tx.Exec("UPDATE threads SET IsFixed=0, pinExpires='', pinOrder=0, announcement=0 WHERE id=?;", id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logError("BD ERROR: Falló soltar los hilos al caducar su fijación", "error", err)
+		return
+	}
+	if len(ids) == 0 {
+		return
+	}
+	expiredPins.Lock()
+	expiredPins.ids = append(expiredPins.ids, ids...)
+	expiredPins.Unlock()
+}
+
+// Suelta en el tablón los hilos que ya soltó releaseExpiredPins. Cada hilo lo
+// suelta una sola petición; si entretanto se ha vuelto a fijar, se respeta
+func (b *Board) applyExpiredPins() {
+	expiredPins.Lock()
+	ids := expiredPins.ids
+	expiredPins.ids = nil
+	expiredPins.Unlock()
+
+	now := time.Now()
+	for _, id := range ids {
+		th := b.getThread(id)
+		if th == nil || !th.IsFixed || th.PinExpires.IsZero() || now.Before(th.PinExpires) {
+			continue
+		}
+		th.Unpin()
+		logInfo("Ha caducado la fijación del hilo", "thread", th.Id)
+	}
+}
+
+// Antes de cada petición suelta los hilos cuya fijación ya caducó en la base
+// de datos
+func (a *api) applyPins(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		board.applyExpiredPins()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Anuncios vigentes que el usuario todavía no ha confirmado
+func (b *Board) pendingAnnouncements(user *User) ([]*Thread, error) {
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT thread FROM announcement_acks WHERE login=?;", user.Login)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	acked := make(map[string]bool)
+	for rows.Next() {
+		id := ""
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		acked[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	list := make([]*Thread, 0)
+	for _, th := range visibleThreads(b.Threads, user) {
+		if th.IsFixed && th.Announcement && !acked[th.Id] {
+			list = append(list, th)
+		}
+	}
+	return list, nil
+}
+
+func ackAnnouncement(login string, thread string) error {
+	return WithTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT OR REPLACE INTO announcement_acks (login, thread, stamp) VALUES (?,?,?);",
+			login, thread, time.Now().UTC().Format(time.RFC3339))
+		return err
+	})
+}
+
+func clearAnnouncementAcks(thread string) error {
+	return WithTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM announcement_acks WHERE thread=?;", thread)
+		return err
+	})
+}
+
+// Lista los anuncios que el usuario de la sesión no ha confirmado
+func (a *api) listAnnouncements(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if user == nil {
+		a.jsonerror(w, "Usuario no autenticado. Token desconocido", 404)
+		return
+	}
+	list, err := board.pendingAnnouncements(user)
+	if err != nil {
+		logError("BD ERROR: Falló consultar los anuncios", "user", user.Login, "error", err)
+		a.jsonerror(w, "Operation failed", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Marca un anuncio como confirmado por el usuario de la sesión
+func (a *api) ackAnnouncement(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if user == nil {
+		a.jsonerror(w, "Usuario no autenticado. Token desconocido", 404)
+		return
+	}
+	thread := board.getThread(mux.Vars(r)["ThreadKey"])
+	if thread == nil || !thread.IsFixed || !thread.Announcement || visibleThread(thread, user) == nil {
+		a.jsonerror(w, "Bad thread key", 404)
+		return
+	}
+	err := ackAnnouncement(user.Login, thread.Id)
+	if err != nil {
+		logError("BD ERROR: Falló confirmar el anuncio", "user", user.Login, "thread", thread.Id, "error", err)
+		a.jsonerror(w, "Operation failed", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode("")
+}
@@ -0,0 +1,164 @@
+package srv
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+
+	Límites de peticiones
+
+	Cada RateLimiter permite como mucho Limit peticiones por clave (un login o
+	una dirección remota) dentro de una ventana de tiempo deslizante. Un
+	límite igual a 0 desactiva el control.
+
+	Las claves sin peticiones dentro de la ventana se olvidan. Como muchas
+	no vuelven a aparecer, una rutina las barre cada minuto.
+
+*/
+
+type RateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+type RateLimitsConfig struct {
+	Threads      RateLimit // hilos nuevos por usuario
+	Messages     RateLimit // mensajes nuevos por usuario
+	Edits        RateLimit // ediciones de mensajes por usuario
+	LoginsByUser RateLimit // intentos de inicio de sesión por login
+	LoginsByAddr RateLimit // intentos de inicio de sesión por dirección remota
+	Reports      RateLimit // denuncias por usuario
+}
+
+var Limits = RateLimitsConfig{
+	Threads:      RateLimit{5, 10 * time.Minute},
+	Messages:     RateLimit{10, time.Minute},
+	Edits:        RateLimit{20, 10 * time.Minute},
+	LoginsByUser: RateLimit{5, 5 * time.Minute},
+	LoginsByAddr: RateLimit{20, 5 * time.Minute},
+	Reports:      RateLimit{5, 10 * time.Minute},
+}
+
+var threadsLimiter, messagesLimiter, editsLimiter *RateLimiter
+var loginsByUserLimiter, loginsByAddrLimiter *RateLimiter
+var reportsLimiter *RateLimiter
+
+func InitRateLimiters() {
+	threadsLimiter = NewRateLimiter("threads", Limits.Threads)
+	messagesLimiter = NewRateLimiter("messages", Limits.Messages)
+	editsLimiter = NewRateLimiter("edits", Limits.Edits)
+	loginsByUserLimiter = NewRateLimiter("logins_by_user", Limits.LoginsByUser)
+	loginsByAddrLimiter = NewRateLimiter("logins_by_addr", Limits.LoginsByAddr)
+	reportsLimiter = NewRateLimiter("reports", Limits.Reports)
+	go rateLimitRoutine()
+}
+
+func allRateLimiters() []*RateLimiter {
+	return []*RateLimiter{threadsLimiter, messagesLimiter, editsLimiter,
+		loginsByUserLimiter, loginsByAddrLimiter, reportsLimiter}
+}
+
+func rateLimitRoutine() {
+	for {
+		time.Sleep(time.Minute)
+		for _, rl := range allRateLimiters() {
+			rl.sweep()
+		}
+	}
+}
+
+// Aplica los valores actuales de Limits a los limitadores ya creados, sin
+// olvidar las peticiones que llevan registradas
+func updateRateLimiters() {
+	threadsLimiter.setLimit(Limits.Threads)
+	messagesLimiter.setLimit(Limits.Messages)
+	editsLimiter.setLimit(Limits.Edits)
+	loginsByUserLimiter.setLimit(Limits.LoginsByUser)
+	loginsByAddrLimiter.setLimit(Limits.LoginsByAddr)
+	reportsLimiter.setLimit(Limits.Reports)
+}
+
+type RateLimiter struct {
+	RateLimit
+	Name  string
+	hits  map[string][]time.Time
+	mutex sync.Mutex
+}
+
+func NewRateLimiter(name string, limit RateLimit) *RateLimiter {
+	return &RateLimiter{RateLimit: limit, Name: name, hits: make(map[string][]time.Time)}
+}
+
+func (rl *RateLimiter) setLimit(limit RateLimit) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.RateLimit = limit
+}
+
+// Registra una petición de key. Si se ha superado el límite no se registra,
+// se retorna false y el tiempo que falta para poder volver a intentarlo
+func (rl *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rl.Limit <= 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	recent := rl.recent(key, now)
+	if len(recent) >= rl.Limit {
+		return false, rl.Window - now.Sub(recent[0])
+	}
+	rl.hits[key] = append(recent, now)
+	return true, 0
+}
+
+// Deja en key solo las peticiones dentro de la ventana y las retorna. Si no
+// queda ninguna se borra la clave. Se llama con el mutex tomado
+func (rl *RateLimiter) recent(key string, now time.Time) []time.Time {
+	recent := rl.hits[key][:0]
+	for _, t := range rl.hits[key] {
+		if now.Sub(t) < rl.Window {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(rl.hits, key)
+		return nil
+	}
+	rl.hits[key] = recent
+	return recent
+}
+
+// Olvida las claves que no tienen peticiones dentro de la ventana
+func (rl *RateLimiter) sweep() {
+	if rl == nil {
+		return
+	}
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rl.Limit <= 0 {
+		rl.hits = make(map[string][]time.Time)
+		return
+	}
+	now := time.Now()
+	for key := range rl.hits {
+		rl.recent(key, now)
+	}
+}
+
+// Retorna la dirección remota de la petición sin el puerto
+func remoteAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,468 @@
+package srv
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+
+	Denuncias y moderación
+
+	Cualquier usuario puede denunciar un mensaje indicando el motivo. Las
+	denuncias se guardan en la tabla reports con una copia del autor y del
+	texto del mensaje, para que sigan teniendo sentido si el mensaje se
+	edita o se borra.
+
+	Los administradores ven las denuncias abiertas en la cola de moderación
+	y las resuelven con una de estas acciones: dismiss (descartarla), delete
+	(borrar el mensaje), close (cerrar el hilo) o ban (bloquear al autor).
+	La acción resuelve todas las denuncias abiertas del mismo mensaje.
+
+	Quien denunció ve sus denuncias resueltas la próxima vez que entra en
+	el tablón. El cliente confirma las que ha mostrado para no repetirlas.
+
+	Los filtros de contenido también mandan a la cola lo que retienen, con
+	la regla en lugar del denunciante. Descartar una de estas denuncias
+	publica el mensaje o el hilo retenido. Si lo retenido es el título o el
+	primer mensaje de un hilo, borrarlo borra el hilo entero.
+
+*/
+
+const (
+	REPORT_OPEN      = "open"
+	REPORT_DISMISSED = "dismissed"
+	REPORT_RESOLVED  = "resolved"
+)
+
+type Report struct {
+	Id          int       `json:"id"`
+	Stamp       time.Time `json:"stamp"`
+	Reporter    string    `json:"reporter"`  // vacío si la denuncia es de un filtro
+	Rule        int       `json:"rule"`      // regla de filtro que retuvo el contenido
+	MessageId   int       `json:"messageid"` // 0 si se denuncia el título del hilo
+	Thread      string    `json:"thread"`
+	ThreadTitle string    `json:"threadtitle"`
+	Author      string    `json:"author"` // autor del mensaje al denunciarlo
+	Text        string    `json:"text"`   // texto del mensaje al denunciarlo
+	Reason      string    `json:"reason"`
+	Status      string    `json:"status"`
+	Action      string    `json:"action"` // acción con la que se resolvió
+	ResolvedBy  string    `json:"resolvedby"`
+	Resolved    time.Time `json:"resolved"`
+	Notified    bool      `json:"notified"` // el denunciante ya la ha visto resuelta
+	Deleted     bool      `json:"deleted"`  // el mensaje ya no existe
+}
+
+const reportColumns = "id, stamp, reporter, rule, message, thread, author, content, reason, status, action, resolvedBy, resolved, notified"
+
+func scanReport(row interface{ Scan(...interface{}) error }) (*Report, error) {
+	rep := new(Report)
+	stamp, resolved, notified := "", "", 0
+	err := row.Scan(&rep.Id, &stamp, &rep.Reporter, &rep.Rule, &rep.MessageId, &rep.Thread, &rep.Author, &rep.Text,
+		&rep.Reason, &rep.Status, &rep.Action, &rep.ResolvedBy, &resolved, &notified)
+	if err != nil {
+		return nil, err
+	}
+	rep.Stamp, _ = time.Parse(time.RFC3339, stamp)
+	rep.Resolved, _ = time.Parse(time.RFC3339, resolved)
+	rep.Notified = (notified == 1)
+	return rep, nil
+}
+
+// Completa la denuncia con el hilo en el que está ahora el mensaje, que
+// puede haberse movido desde que se denunció
+func (rep *Report) addContext() {
+	if rep.MessageId == 0 {
+		rep.Deleted = (board.getThread(rep.Thread) == nil)
+	} else if m := board.getMessage(rep.MessageId); m != nil && m.Parent != nil {
+		rep.Thread = m.Parent.Id
+	} else {
+		rep.Deleted = true
+	}
+	if th := board.getThread(rep.Thread); th != nil {
+		rep.ThreadTitle = th.Title
+	}
+}
+
+func (rep *Report) Save() error {
+	q := "INSERT INTO reports (stamp, reporter, rule, message, thread, author, content, reason) VALUES (?,?,?,?,?,?,?,?);"
+
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec(q, rep.Stamp.UTC().Format(time.RFC3339), rep.Reporter, rep.Rule, rep.MessageId, rep.Thread,
+		rep.Author, rep.Text, rep.Reason)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	rep.Id = int(id)
+	return err
+}
+
+// Retorna la denuncia o nil si no existe
+func loadReport(id int) (*Report, error) {
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		return nil, err
+	}
+	rep, err := scanReport(db.QueryRow("SELECT "+reportColumns+" FROM reports WHERE id=?;", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return rep, err
+}
+
+// Retorna las denuncias, de la más antigua a la más reciente. Un status o
+// un reporter vacíos no filtran
+func queryReports(status string, reporter string) ([]*Report, error) {
+	conds := make([]string, 0)
+	args := make([]interface{}, 0)
+	if status != "" {
+		conds = append(conds, "status=?")
+		args = append(args, status)
+	}
+	if reporter != "" {
+		conds = append(conds, "reporter=?")
+		args = append(args, reporter)
+	}
+	q := "SELECT " + reportColumns + " FROM reports"
+	if len(conds) > 0 {
+		q += " WHERE " + strings.Join(conds, " AND ")
+	}
+	q += " ORDER BY id;"
+
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]*Report, 0)
+	for rows.Next() {
+		rep, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, rep)
+	}
+	return list, rows.Err()
+}
+
+// Retorna true si el usuario ya tiene una denuncia abierta del mensaje
+func hasOpenReport(reporter string, message int) (bool, error) {
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		return false, err
+	}
+	n := 0
+	err = db.QueryRow("SELECT COUNT(*) FROM reports WHERE reporter=? AND message=? AND status=?;",
+		reporter, message, REPORT_OPEN).Scan(&n)
+	return n > 0, err
+}
+
+// Resuelve con la acción todas las denuncias abiertas del mismo mensaje, o
+// del mismo título si la denuncia es de un título
+func resolveReports(rep *Report, action string, by string) error {
+	status := REPORT_RESOLVED
+	if action == "dismiss" {
+		status = REPORT_DISMISSED
+	}
+	cond, key := "message=?", interface{}(rep.MessageId)
+	if rep.MessageId == 0 {
+		cond, key = "message=0 AND thread=?", rep.Thread
+	}
+	return WithTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE reports SET status=?, action=?, resolvedBy=?, resolved=? WHERE "+cond+" AND status=?;",
+			status, action, by, time.Now().UTC().Format(time.RFC3339), key, REPORT_OPEN)
+		return err
+	})
+}
+
+// Marca como vistas por su denunciante las denuncias resueltas
+func markReportsNotified(reporter string, ids []int) error {
+	return WithTransaction(func(tx *sql.Tx) error {
+		for _, id := range ids {
+			_, err := tx.Exec("UPDATE reports SET notified=1 WHERE id=? AND reporter=? AND status<>?;", id, reporter, REPORT_OPEN)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Borra un mensaje reasignando sus respuestas, como al borrarlo su autor
+func deleteReportedMessage(m *Message) error {
+	return m.Parent.deleteReply(m)
+}
+
+func validateReportReason(reason string) error {
+	if strings.TrimSpace(reason) == "" {
+		return invalid("reason", "Debe indicar el motivo de la denuncia")
+	}
+	return validateReason(reason)
+}
+
+// Denuncia un mensaje. El cuerpo es el motivo
+func (a *api) reportMessage(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if user == nil {
+		a.jsonerror(w, "Usuario no autenticado. Token desconocido", 404)
+		return
+	}
+	if !a.checkCanWrite(w, user) || !a.checkRateLimit(w, reportsLimiter, user.Login) {
+		return
+	}
+	id, _ := strconv.Atoi(mux.Vars(r)["MsgId"])
+	m := board.getMessage(id)
+	if m == nil || m.Parent == nil {
+		a.jsonerror(w, "Bad msg id", 404)
+		return
+	}
+	if m.Author == user.Login {
+		a.jsonerror(w, "No puede denunciar sus propios mensajes", 404)
+		return
+	}
+	reason := ""
+	err := decodeBody(r, &reason)
+	if err == nil {
+		err = validateReportReason(reason)
+	}
+	if err != nil {
+		a.invalidRequest(w, err, "Bad report payload")
+		return
+	}
+	open, err := hasOpenReport(user.Login, m.Id)
+	if err == nil && open {
+		a.jsonerror(w, "Ya ha denunciado este mensaje", 404)
+		return
+	}
+
+	rep := &Report{Stamp: time.Now(), Reporter: user.Login, MessageId: m.Id, Thread: m.Parent.Id,
+		Author: m.Author, Text: m.Text, Reason: reason, Status: REPORT_OPEN}
+	if err == nil {
+		err = rep.Save()
+	}
+	if err != nil {
+		logError("BD ERROR: Falló guardar la denuncia", "msg", m.Id, "user", user.Login, "error", err)
+		a.jsonerror(w, "Operation failed", 404)
+		return
+	}
+	logInfo("Mensaje denunciado", "user", user.Login, "msg", m.Id, "thread", m.Parent.Id)
+	audit(r, user.Login, AUDIT_REPORT_CREATE, m.Parent.Id, m.Id, "", reason)
+	rep.addContext()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
+
+// Retorna las denuncias del usuario
+func (a *api) listOwnReports(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if user == nil {
+		a.jsonerror(w, "Usuario no autenticado. Token desconocido", 404)
+		return
+	}
+	list, err := queryReports("", user.Login)
+	if err != nil {
+		logError("BD ERROR: Falló leer las denuncias", "user", user.Login, "error", err)
+		a.jsonerror(w, "Operation failed", 404)
+		return
+	}
+	for _, rep := range list {
+		rep.addContext()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Marca como vistas las denuncias resueltas cuyos ids se envían en el cuerpo
+func (a *api) ackReports(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if user == nil {
+		a.jsonerror(w, "Usuario no autenticado. Token desconocido", 404)
+		return
+	}
+	ids := make([]int, 0)
+	err := decodeBody(r, &ids)
+	if err != nil {
+		a.invalidRequest(w, err, "Bad request payload")
+		return
+	}
+	err = markReportsNotified(user.Login, ids)
+	if err != nil {
+		logError("BD ERROR: Falló marcar las denuncias como vistas", "user", user.Login, "error", err)
+		a.jsonerror(w, "Operation failed", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ids)
+}
+
+// Cola de moderación. Con status=all retorna también las resueltas. Solo
+// contiene las denuncias de los hilos que el usuario puede moderar
+func (a *api) listReports(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if user == nil || !user.CanSomewhere(PERM_MODERATE) {
+		a.jsonerror(w, "Usuario no autenticado o no autorizado", 404)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = REPORT_OPEN
+	} else if status == "all" {
+		status = ""
+	}
+	list, err := queryReports(status, "")
+	if err != nil {
+		logError("BD ERROR: Falló leer las denuncias", "error", err)
+		a.jsonerror(w, "Operation failed", 404)
+		return
+	}
+	visible := make([]*Report, 0, len(list))
+	for _, rep := range list {
+		rep.addContext()
+		if can(user, PERM_MODERATE, board.getThread(rep.Thread), nil) {
+			visible = append(visible, rep)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(visible)
+}
+
+// Resuelve una denuncia. El valor de Cmd puede ser: dismiss|delete|close|ban.
+// Cada acción necesita además su propio permiso
+func (a *api) moderateReport(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if user == nil || !user.CanSomewhere(PERM_MODERATE) {
+		a.jsonerror(w, "Usuario no autenticado o no autorizado", 404)
+		return
+	}
+	if !a.checkCanWrite(w, user) {
+		return
+	}
+	vars := mux.Vars(r)
+	command := vars["Cmd"]
+	id, _ := strconv.Atoi(vars["ReportId"])
+	rep, err := loadReport(id)
+	if err != nil {
+		logError("BD ERROR: Falló leer la denuncia", "report", id, "error", err)
+		a.jsonerror(w, "Operation failed", 404)
+		return
+	}
+	if rep == nil || rep.Status != REPORT_OPEN {
+		a.jsonerror(w, "La denuncia no existe o ya está resuelta", 404)
+		return
+	}
+	rep.addContext()
+	m := board.getMessage(rep.MessageId)
+	thread := board.getThread(rep.Thread)
+	perms := map[string]string{"dismiss": PERM_MODERATE, "delete": PERM_DELETE, "close": PERM_CLOSE, "ban": PERM_BAN}
+	if perm, ok := perms[command]; ok {
+		target := thread
+		if command == "ban" {
+			// el bloqueo es de todo el tablón
+			target = nil
+		}
+		if !can(user, PERM_MODERATE, thread, nil) || !can(user, perm, target, m) {
+			a.jsonerror(w, "Usuario no autorizado", 404)
+			return
+		}
+	}
+
+	switch command {
+	case "dismiss":
+		err = releaseHeld(rep)
+	case "delete":
+		if (rep.MessageId != 0 && m == nil) || thread == nil {
+			a.jsonerror(w, "El mensaje ya no existe", 404)
+			return
+		}
+		if m == nil || (m.Parent.Messages[0] == m && m.Held) {
+			// el hilo retenido se borra entero
+			err = thread.Delete()
+			if err == nil {
+				board.delThread(thread)
+				logInfo("Hilo borrado", "user", user.Login, "thread", thread.Id)
+				audit(r, user.Login, AUDIT_THREAD_DELETE, thread.Id, 0, thread.Title, "")
+			}
+			break
+		}
+		if m.Parent.Messages[0] == m {
+			a.jsonerror(w, "El primer mensaje de un hilo no se puede borrar. Puede cerrar el hilo", 404)
+			return
+		}
+		err = deleteReportedMessage(m)
+		if err == nil {
+			logInfo("Se ha borrado el mensaje", "msg", m.Id, "thread", m.Parent.Id, "user", user.Login)
+			audit(r, user.Login, AUDIT_MESSAGE_DELETE, m.Parent.Id, m.Id, m.Text, "")
+		}
+	case "close":
+		if thread == nil {
+			a.jsonerror(w, "El hilo ya no existe", 404)
+			return
+		}
+		thread.IsClosed = true
+		err = thread.Update()
+		if err == nil {
+			audit(r, user.Login, AUDIT_THREAD_STATUS, thread.Id, 0, "", "close")
+		}
+	case "ban":
+		u := board.GetUser(rep.Author)
+		if u == nil {
+			a.jsonerror(w, "User not exists in the database", 404)
+			return
+		}
+		if u == user {
+			a.jsonerror(w, "Un administrador no puede bloquearse o degradarse a sí mismo", 404)
+			return
+		}
+		oldStatus := userStatus(u)
+		u.Ban(BAN_FULL, "Mensaje denunciado: "+rep.Reason, user.Login, time.Time{})
+		err = u.Save(true)
+		if err == nil {
+			err = DeleteUserSessions(u.Login)
+		}
+		if err == nil {
+			audit(r, user.Login, AUDIT_USER_PREFIX+command, "", 0, u.Login+" "+oldStatus, u.Login+" "+userStatus(u))
+		}
+	default:
+		a.jsonerror(w, "Unknown command", 404)
+		return
+	}
+	if err == nil {
+		err = resolveReports(rep, command, user.Login)
+	}
+	if err != nil {
+		logError("BD ERROR: Falló la operación sobre la denuncia", "command", command, "report", rep.Id, "user", user.Login, "error", err)
+		a.jsonerror(w, "Operation failed", 404)
+		return
+	}
+	logInfo("Denuncia resuelta", "user", user.Login, "command", command, "report", rep.Id, "msg", rep.MessageId)
+	audit(r, user.Login, AUDIT_REPORT_RESOLVE, rep.Thread, rep.MessageId, rep.Reason, command)
+
+	rep, err = loadReport(id)
+	if err != nil || rep == nil {
+		a.jsonerror(w, "Operation failed", 404)
+		return
+	}
+	rep.addContext()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
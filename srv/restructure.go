@@ -0,0 +1,218 @@
+package srv
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+)
+
+/*
+
+	Reestructuración de hilos
+
+	Operaciones de administración que cambian la forma de los hilos: renombrar
+	un hilo, cambiarlo de categoría, mover un mensaje a otro hilo, fusionar dos
+	hilos y dividir un hilo en dos. Cada operación se aplica primero en la
+	base de datos dentro de una transacción y solo si esta termina bien se
+	aplica sobre el tablón en memoria.
+
+*/
+
+// Ordena las respuestas del hilo por fecha y recalcula los campos que
+// dependen del orden. El primer mensaje no se mueve, porque de él salen el
+// autor del hilo y la protección contra el borrado
+func (t *Thread) sortMessages() {
+	if len(t.Messages) > 1 {
+		replies := t.Messages[1:]
+		sort.SliceStable(replies, func(i, j int) bool {
+			mi, mj := replies[i], replies[j]
+			if mi.Stamp.Equal(mj.Stamp) {
+				return mi.Id < mj.Id
+			}
+			return mi.Stamp.Before(mj.Stamp)
+		})
+	}
+	t.addMessage(nil)
+}
+
+// Indica si m iría antes que el primer mensaje del hilo. Al cargar el tablón
+// los mensajes se leen en el orden de sus ids, así que pasaría a ser el
+// primero y cambiaría el autor del hilo
+func (t *Thread) precedesHead(m *Message) bool {
+	if len(t.Messages) == 0 {
+		return false
+	}
+	head := t.Messages[0]
+	return m.Id < head.Id || m.Stamp.Before(head.Stamp)
+}
+
+// Cambia el título de un hilo
+func (b *Board) renameThread(th *Thread, title string) error {
+	err := WithTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE threads SET title=? WHERE id=?;", title, th.Id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	th.Title = title
+	return nil
+}
+
+// Cambia la categoría de un hilo
+func (b *Board) setThreadCategory(th *Thread, category string) error {
+	err := WithTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE threads SET category=? WHERE id=?;", category, th.Id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	th.Category = category
+	return nil
+}
+
+// Mueve un mensaje al hilo dst. Las respuestas que tenía en su hilo original
+// pasan a responder al mismo mensaje que él, y en el hilo nuevo queda como
+// respuesta al hilo
+func (b *Board) moveMessage(m *Message, dst *Thread) error {
+	src := m.Parent
+	if src == nil || dst == nil {
+		return errors.New("Hilo desconocido")
+	}
+	if src == dst {
+		return errors.New("El mensaje ya está en ese hilo")
+	}
+	if len(src.Messages) > 0 && src.Messages[0].Id == m.Id {
+		return errors.New("El primer mensaje de un hilo no se puede mover")
+	}
+	if dst.precedesHead(m) {
+		return errors.New("El mensaje es anterior al primer mensaje del hilo de destino")
+	}
+
+	err := WithTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE messages SET replyTo=? WHERE replyTo=?;", m.ReplyTo, m.Id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE messages SET thread=?, replyTo=0 WHERE id=?;", dst.Id, m.Id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, m2 := range src.Messages {
+		if m2.ReplyTo == m.Id {
+			m2.ReplyTo = m.ReplyTo
+		}
+	}
+	src.delMessage(m)
+	src.addMessage(nil)
+	m.ReplyTo = 0
+	dst.addMessage(m)
+	dst.sortMessages()
+	return nil
+}
+
+// Fusiona el hilo src dentro del hilo dst, que debe ser el más antiguo. Los
+// mensajes quedan ordenados por fecha y el hilo src desaparece. Sus denuncias pasan a dst y las
+// confirmaciones de su anuncio se olvidan
+func (b *Board) mergeThreads(dst *Thread, src *Thread) error {
+	if src == nil || dst == nil {
+		return errors.New("Hilo desconocido")
+	}
+	if src == dst {
+		return errors.New("No se puede fusionar un hilo consigo mismo")
+	}
+	for _, m := range src.Messages {
+		if dst.precedesHead(m) {
+			return errors.New("El hilo tiene mensajes anteriores al primer mensaje del hilo de destino. Fusione los hilos en sentido contrario")
+		}
+	}
+
+	err := WithTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE messages SET thread=? WHERE thread=?;", dst.Id, src.Id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE reports SET thread=? WHERE thread=?;", dst.Id, src.Id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM announcement_acks WHERE thread=?;", src.Id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM threads WHERE id=?;", src.Id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, m := range src.Messages {
+		dst.addMessage(m)
+	}
+	dst.sortMessages()
+	b.delThread(src)
+	return nil
+}
+
+// Divide un hilo en dos. El mensaje m y todos los posteriores pasan a un
+// hilo nuevo con el título indicado. Retorna el hilo nuevo
+func (b *Board) splitThread(th *Thread, m *Message, title string) (*Thread, error) {
+	at := -1
+	for i, m2 := range th.Messages {
+		if m2.Id == m.Id {
+			at = i
+			break
+		}
+	}
+	if at < 0 {
+		return nil, errors.New("El mensaje no pertenece al hilo")
+	}
+	if at == 0 {
+		return nil, errors.New("No se puede dividir un hilo por su primer mensaje")
+	}
+
+	moved := th.Messages[at:]
+	staying := make(map[int]bool)
+	for _, m2 := range th.Messages[:at] {
+		staying[m2.Id] = true
+	}
+
+	nt := NewThread(title, nil)
+	nt.Category = th.Category
+	err := WithTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT INTO threads (id,title,IsClosed,IsFixed,category) VALUES (?,?,0,0,?);", nt.Id, nt.Title, nt.Category)
+		if err != nil {
+			return err
+		}
+		for _, m2 := range moved {
+			replyTo := m2.ReplyTo
+			if staying[replyTo] {
+				replyTo = 0
+			}
+			_, err = tx.Exec("UPDATE messages SET thread=?, replyTo=? WHERE id=?;", nt.Id, replyTo, m2.Id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	th.Messages = append([]*Message{}, th.Messages[:at]...)
+	th.addMessage(nil)
+	for _, m2 := range moved {
+		if staying[m2.ReplyTo] {
+			m2.ReplyTo = 0
+		}
+		nt.addMessage(m2)
+	}
+	b.addThread(nt)
+	return nt, nil
+}
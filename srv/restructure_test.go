@@ -0,0 +1,227 @@
+package srv
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Crea con la sesión indicada un hilo con un mensaje por texto. Un texto "n>texto"
+// responde al mensaje n-ésimo del hilo, empezando en 1
+func testThread(t *testing.T, h http.Handler, session *http.Cookie, title string, texts ...string) *Thread {
+	t.Helper()
+	w := testRequest(h, session, http.MethodPost, "/board", `"`+title+`"`)
+	var th Thread
+	if err := json.NewDecoder(w.Body).Decode(&th); err != nil {
+		t.Fatalf("no se pudo crear el hilo %q: %d %s", title, w.Code, w.Body)
+	}
+	for _, text := range texts {
+		replyTo := 0
+		if i := strings.Index(text, ">"); i > 0 {
+			var n int
+			fmt.Sscan(text[:i], &n)
+			replyTo = board.getThread(th.Id).Messages[n-1].Id
+			text = text[i+1:]
+		}
+		w := testRequest(h, session, http.MethodPut, "/threads/"+th.Id, fmt.Sprintf(`{"text":%q,"replyto":%d}`, text, replyTo))
+		if w.Code != http.StatusOK {
+			t.Fatalf("no se pudo publicar %q: %d %s", text, w.Code, w.Body)
+		}
+	}
+	return board.getThread(th.Id)
+}
+
+// Retorna el resultado de una consulta COUNT(*)
+func countRows(t *testing.T, q string, args ...interface{}) int {
+	t.Helper()
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	if err := db.QueryRow(q, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// Denuncia un mensaje del hilo y confirma el hilo como anuncio visto por bob
+func reportAndAck(t *testing.T, th *Thread, m *Message) {
+	t.Helper()
+	rep := &Report{Stamp: time.Now(), Reporter: "eva", Thread: th.Id, MessageId: m.Id, Author: m.Author,
+		Text: m.Text, Reason: "prueba", Status: REPORT_OPEN}
+	if err := rep.Save(); err != nil {
+		t.Fatal(err)
+	}
+	err := WithTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT INTO announcement_acks (login, thread, stamp) VALUES ('bob',?,?);",
+			th.Id, time.Now().UTC().Format(time.RFC3339))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Mensajes, denuncias y confirmaciones de un hilo
+type threadCounts struct {
+	messages, reports, acks int
+}
+
+// Comprueba los mensajes, denuncias y confirmaciones de cada hilo en la base
+// de datos, y que al cargarla de nuevo los hilos tengan los mismos mensajes
+// en el mismo orden que en memoria
+func checkThreads(t *testing.T, want map[*Thread]threadCounts) {
+	t.Helper()
+	reloaded := CreateBoard()
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for th, c := range want {
+		got := threadCounts{
+			countRows(t, "SELECT COUNT(*) FROM messages WHERE thread=?;", th.Id),
+			countRows(t, "SELECT COUNT(*) FROM reports WHERE thread=?;", th.Id),
+			countRows(t, "SELECT COUNT(*) FROM announcement_acks WHERE thread=?;", th.Id),
+		}
+		if got != c {
+			t.Errorf("hilo %q: %+v en la base de datos, se esperaba %+v", th.Title, got, c)
+		}
+		if len(th.Messages) != c.messages || th.Len != c.messages {
+			t.Errorf("hilo %q: %d mensajes en memoria (len %d), se esperaban %d", th.Title, len(th.Messages), th.Len, c.messages)
+		}
+		r := reloaded.getThread(th.Id)
+		if r == nil {
+			t.Errorf("hilo %q: no está en la base de datos", th.Title)
+			continue
+		}
+		for i := range th.Messages {
+			if i >= len(r.Messages) || r.Messages[i].Id != th.Messages[i].Id || r.Messages[i].ReplyTo != th.Messages[i].ReplyTo {
+				t.Errorf("hilo %q: los mensajes cargados no coinciden con los de memoria en la posición %d", th.Title, i)
+				break
+			}
+		}
+		if len(th.Messages) > 0 && (th.Author != th.Messages[0].Author || r.Author != th.Author) {
+			t.Errorf("hilo %q: autor %q en memoria y %q al cargarlo", th.Title, th.Author, r.Author)
+		}
+	}
+}
+
+func TestMoveMessage(t *testing.T) {
+	h := newTestDatabase(t)
+	admin, bob, eva := testLogin(t, h, "admin"), testLogin(t, h, "bob"), testLogin(t, h, "eva")
+
+	dst := testThread(t, h, eva, "Destino", "primero de destino")
+	src := testThread(t, h, bob, "Origen", "pregunta", "1>respuesta", "2>réplica")
+	late := testThread(t, h, eva, "Posterior", "primero posterior")
+	reportAndAck(t, src, src.Messages[1])
+	moved, reply := src.Messages[1], src.Messages[2]
+
+	// el primer mensaje de un hilo no se mueve
+	path := fmt.Sprintf("/messages/%d/move/%s", src.Messages[0].Id, dst.Id)
+	if w := testRequest(h, admin, http.MethodPut, path, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("se ha movido el primer mensaje: código %d", w.Code)
+	}
+	// ni a un hilo cuyo primer mensaje es posterior
+	path = fmt.Sprintf("/messages/%d/move/%s", moved.Id, late.Id)
+	if w := testRequest(h, admin, http.MethodPut, path, ""); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "anterior al primer mensaje") {
+		t.Fatalf("se ha movido un mensaje antes del primero del destino: %d %s", w.Code, w.Body)
+	}
+	checkThreads(t, map[*Thread]threadCounts{src: {3, 1, 1}, dst: {1, 0, 0}, late: {1, 0, 0}})
+
+	path = fmt.Sprintf("/messages/%d/move/%s", moved.Id, dst.Id)
+	if w := testRequest(h, admin, http.MethodPut, path, ""); w.Code != http.StatusOK {
+		t.Fatalf("no se pudo mover el mensaje: %d %s", w.Code, w.Body)
+	}
+	if moved.Parent != dst || moved.ReplyTo != 0 {
+		t.Errorf("el mensaje movido está en %q y responde a %d", moved.Parent.Title, moved.ReplyTo)
+	}
+	if reply.ReplyTo != src.Messages[0].Id {
+		t.Errorf("la réplica responde a %d, se esperaba %d", reply.ReplyTo, src.Messages[0].Id)
+	}
+	if dst.Messages[0].Author != "eva" || dst.Messages[1] != moved {
+		t.Errorf("el hilo de destino ha cambiado de primer mensaje")
+	}
+	// la denuncia sigue anotada en el hilo donde se hizo
+	checkThreads(t, map[*Thread]threadCounts{src: {2, 1, 1}, dst: {2, 0, 0}, late: {1, 0, 0}})
+}
+
+func TestMergeThreads(t *testing.T) {
+	h := newTestDatabase(t)
+	admin, bob, eva := testLogin(t, h, "admin"), testLogin(t, h, "bob"), testLogin(t, h, "eva")
+
+	older := testThread(t, h, bob, "Antiguo", "uno", "dos")
+	newer := testThread(t, h, eva, "Nuevo", "tres", "1>cuatro")
+	reportAndAck(t, older, older.Messages[1])
+	reportAndAck(t, newer, newer.Messages[1])
+
+	// fusionar el antiguo en el nuevo cambiaría el primer mensaje
+	path := fmt.Sprintf("/threads/%s/merge/%s", newer.Id, older.Id)
+	if w := testRequest(h, admin, http.MethodPut, path, ""); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "sentido contrario") {
+		t.Fatalf("se ha fusionado en el hilo más nuevo: %d %s", w.Code, w.Body)
+	}
+	checkThreads(t, map[*Thread]threadCounts{older: {2, 1, 1}, newer: {2, 1, 1}})
+
+	path = fmt.Sprintf("/threads/%s/merge/%s", older.Id, newer.Id)
+	if w := testRequest(h, admin, http.MethodPut, path, ""); w.Code != http.StatusOK {
+		t.Fatalf("no se pudo fusionar: %d %s", w.Code, w.Body)
+	}
+	if board.getThread(newer.Id) != nil {
+		t.Error("el hilo fusionado sigue en el tablón")
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM threads WHERE id=?;", newer.Id); n != 0 {
+		t.Error("el hilo fusionado sigue en la base de datos")
+	}
+	texts := make([]string, 0)
+	for _, m := range older.Messages {
+		texts = append(texts, m.Text)
+	}
+	if strings.Join(texts, ",") != "uno,dos,tres,cuatro" || older.Author != "bob" {
+		t.Errorf("mensajes %v de %s tras la fusión", texts, older.Author)
+	}
+	// las denuncias pasan al hilo y las confirmaciones del fusionado se olvidan
+	checkThreads(t, map[*Thread]threadCounts{older: {4, 2, 1}})
+	if n := countRows(t, "SELECT COUNT(*) FROM reports WHERE thread=?;", newer.Id); n != 0 {
+		t.Errorf("quedan %d denuncias del hilo fusionado", n)
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM announcement_acks WHERE thread=?;", newer.Id); n != 0 {
+		t.Errorf("quedan %d confirmaciones del hilo fusionado", n)
+	}
+}
+
+func TestSplitThread(t *testing.T) {
+	h := newTestDatabase(t)
+	admin, bob := testLogin(t, h, "admin"), testLogin(t, h, "bob")
+
+	th := testThread(t, h, bob, "Largo", "uno", "1>dos", "2>tres", "3>cuatro")
+	reportAndAck(t, th, th.Messages[3])
+	at := th.Messages[2]
+
+	path := fmt.Sprintf("/threads/%s/split/%d", th.Id, th.Messages[0].Id)
+	if w := testRequest(h, admin, http.MethodPut, path, `"Otro"`); w.Code != http.StatusNotFound {
+		t.Fatalf("se ha dividido por el primer mensaje: código %d", w.Code)
+	}
+	checkThreads(t, map[*Thread]threadCounts{th: {4, 1, 1}})
+
+	path = fmt.Sprintf("/threads/%s/split/%d", th.Id, at.Id)
+	w := testRequest(h, admin, http.MethodPut, path, `"Otro"`)
+	var res Thread
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("no se pudo dividir: %d %s", w.Code, w.Body)
+	}
+	nt := board.getThread(res.Id)
+	if nt == nil || nt.Title != "Otro" || nt.Messages[0] != at {
+		t.Fatalf("el hilo nuevo no empieza por el mensaje de la división: %+v", nt)
+	}
+	// el primer mensaje del hilo nuevo ya no responde al hilo original y el
+	// siguiente sigue respondiéndole
+	if at.ReplyTo != 0 || nt.Messages[1].ReplyTo != at.Id {
+		t.Errorf("respuestas %d y %d tras dividir", at.ReplyTo, nt.Messages[1].ReplyTo)
+	}
+	// la denuncia y la confirmación se quedan en el hilo original
+	checkThreads(t, map[*Thread]threadCounts{th: {2, 1, 1}, nt: {2, 0, 0}})
+}
@@ -0,0 +1,300 @@
+package srv
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+
+	Roles y permisos
+
+	Cada usuario tiene el rol user, que solo le permite editar y borrar lo
+	suyo, y puede tener además los roles moderator y admin, bien en todo el
+	tablón o bien en una categoría de hilos. Un rol en una categoría solo da
+	sus permisos sobre los hilos de esa categoría; los permisos que no son
+	de un hilo (bloquear, gestionar usuarios, consultar la auditoría y
+	gestionar los filtros) solo los dan los roles globales.
+
+	El administrador global es el usuario con isAdmin, que se cambia con
+	promote y demote. El resto de roles se guarda en la tabla user_roles.
+	Los grupos del sistema también pueden dar los roles globales (ver
+	groups.go).
+
+	Todos los handlers comprueban los permisos con can.
+
+*/
+
+const (
+	ROLE_USER      = "user"
+	ROLE_MODERATOR = "moderator"
+	ROLE_ADMIN     = "admin"
+)
+
+const (
+	PERM_EDIT         = "edit"   // editar un mensaje propio o, con edit-any, cualquiera
+	PERM_DELETE       = "delete" // borrar un mensaje o un hilo propio o, con delete-any, cualquiera
+	PERM_EDIT_ANY     = "edit-any"
+	PERM_DELETE_ANY   = "delete-any"
+	PERM_CLOSE        = "close"       // cerrar y abrir hilos
+	PERM_FIX          = "fix"         // fijar y soltar hilos
+	PERM_RESTRUCTURE  = "restructure" // renombrar, fusionar, dividir, mover y cambiar de categoría
+	PERM_MODERATE     = "moderate"    // cola de moderación y contenido retenido
+	PERM_BAN          = "ban"
+	PERM_MANAGE_USERS = "manage-users"
+	PERM_AUDIT        = "audit"
+	PERM_FILTERS      = "filters"
+)
+
+var rolePermissions = map[string][]string{
+	ROLE_USER:      {},
+	ROLE_MODERATOR: {PERM_EDIT_ANY, PERM_DELETE_ANY, PERM_CLOSE, PERM_FIX, PERM_RESTRUCTURE, PERM_MODERATE},
+	ROLE_ADMIN: {PERM_EDIT_ANY, PERM_DELETE_ANY, PERM_CLOSE, PERM_FIX, PERM_RESTRUCTURE, PERM_MODERATE,
+		PERM_BAN, PERM_MANAGE_USERS, PERM_AUDIT, PERM_FILTERS},
+}
+
+// Rol de un usuario en todo el tablón o en una categoría
+type RoleGrant struct {
+	Role     string `json:"role"`
+	Category string `json:"category"` // vacía para todo el tablón
+}
+
+var validCategory = regexp.MustCompile("^[a-zA-Z0-9_-]*$")
+
+const CATEGORY_MAX = 32
+
+// Roles del usuario, incluidos el de administrador global y el de sus
+// grupos del sistema
+func (u *User) grants() []RoleGrant {
+	if u.IsAdmin {
+		return append([]RoleGrant{{ROLE_ADMIN, ""}}, u.Roles...)
+	}
+	if u.GroupRole != "" {
+		return append([]RoleGrant{{u.GroupRole, ""}}, u.Roles...)
+	}
+	return u.Roles
+}
+
+// Retorna true si alguno de los roles del usuario le da el permiso en la
+// categoría. Con la categoría vacía solo cuentan los roles globales
+func (u *User) Can(perm string, category string) bool {
+	for _, g := range u.grants() {
+		if g.Category != "" && g.Category != category {
+			continue
+		}
+		for _, p := range rolePermissions[g.Role] {
+			if p == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Retorna true si el usuario tiene el permiso en alguna categoría
+func (u *User) CanSomewhere(perm string) bool {
+	for _, g := range u.grants() {
+		if u.Can(perm, g.Category) {
+			return true
+		}
+	}
+	return false
+}
+
+// Política de permisos. Retorna true si el usuario puede hacer perm sobre
+// el mensaje m o, si m es nil, sobre el hilo th. Sin hilo solo cuentan los
+// roles globales
+func can(user *User, perm string, th *Thread, m *Message) bool {
+	if user == nil {
+		return false
+	}
+	owner := ""
+	if m != nil {
+		owner = m.Author
+	} else if th != nil {
+		owner = th.Author
+	}
+	switch perm {
+	case PERM_EDIT:
+		if owner == user.Login {
+			return true
+		}
+		perm = PERM_EDIT_ANY
+	case PERM_DELETE:
+		if owner == user.Login {
+			return true
+		}
+		perm = PERM_DELETE_ANY
+	}
+	category := ""
+	if th != nil {
+		category = th.Category
+	}
+	return user.Can(perm, category)
+}
+
+func validateCategory(category string) error {
+	if len(category) > CATEGORY_MAX {
+		return invalid("category", "La categoría tiene %d caracteres y el máximo es %d", len(category), CATEGORY_MAX)
+	}
+	if !validCategory.MatchString(category) {
+		return invalid("category", "La categoría solo puede tener letras, números, _ y -")
+	}
+	return nil
+}
+
+// Valida los roles que se asignan a un usuario
+func validateGrants(grants []RoleGrant) error {
+	for _, g := range grants {
+		if g.Role != ROLE_MODERATOR && g.Role != ROLE_ADMIN {
+			return invalid("role", "Rol desconocido: %s. Debe ser moderator o admin", g.Role)
+		}
+		if g.Role == ROLE_ADMIN && g.Category == "" {
+			return invalid("role", "El administrador global se asigna con promote")
+		}
+		if err := validateCategory(g.Category); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func grantsString(grants []RoleGrant) string {
+	list := make([]string, 0, len(grants))
+	for _, g := range grants {
+		if g.Category == "" {
+			list = append(list, g.Role)
+		} else {
+			list = append(list, g.Role+"@"+g.Category)
+		}
+	}
+	return strings.Join(list, " ")
+}
+
+// Carga los roles de la tabla user_roles en los usuarios del tablón
+func (b *Board) loadRoles(db *sql.DB) error {
+	rows, err := db.Query("SELECT login, role, category FROM user_roles ORDER BY login, category, role;")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		login, g := "", RoleGrant{}
+		err := rows.Scan(&login, &g.Role, &g.Category)
+		if err != nil {
+			return err
+		}
+		if u := b.GetUser(login); u != nil {
+			u.Roles = append(u.Roles, g)
+		}
+	}
+	return rows.Err()
+}
+
+// Sustituye los roles guardados del usuario
+func (u *User) SaveRoles(grants []RoleGrant) error {
+	err := WithTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM user_roles WHERE login=?;", u.Login)
+		if err != nil {
+			return err
+		}
+		for _, g := range grants {
+			_, err = tx.Exec("INSERT OR IGNORE INTO user_roles (login, role, category) VALUES (?,?,?);", u.Login, g.Role, g.Category)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	u.Roles = grants
+	return nil
+}
+
+// Asigna los roles que viajan en el payload a un usuario, sustituyendo los
+// que tenía
+func (a *api) setUserRoles(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if !can(user, PERM_MANAGE_USERS, nil, nil) {
+		a.jsonerror(w, "Usuario no autenticado o no autorizado", 404)
+		return
+	}
+	if !a.checkCanWrite(w, user) {
+		return
+	}
+	u := board.GetUser(mux.Vars(r)["Login"])
+	if u == nil {
+		a.jsonerror(w, "User not exists in the database", 404)
+		return
+	}
+	grants := make([]RoleGrant, 0)
+	err := decodeBody(r, &grants)
+	if err == nil {
+		err = validateGrants(grants)
+	}
+	if err != nil {
+		a.invalidRequest(w, err, "Bad roles payload")
+		return
+	}
+	old := grantsString(u.Roles)
+	err = u.SaveRoles(grants)
+	if err != nil {
+		logError("BD ERROR: Falló asignar los roles", "login", u.Login, "user", user.Login, "error", err)
+		a.jsonerror(w, "Operation failed", 404)
+		return
+	}
+	logInfo("Roles asignados", "user", user.Login, "login", u.Login, "roles", grantsString(grants))
+	audit(r, user.Login, AUDIT_USER_PREFIX+"roles", "", 0, u.Login+" "+old, u.Login+" "+grantsString(grants))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// Cambia la categoría de un hilo. La categoría viaja en el payload y puede
+// estar vacía para quitarla. Hace falta poder reestructurar en la categoría
+// de origen y en la de destino
+func (a *api) setThreadCategory(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromSession(r)
+	if user == nil {
+		a.jsonerror(w, "Usuario no autenticado. Token desconocido", 404)
+		return
+	}
+	if !a.checkCanWrite(w, user) {
+		return
+	}
+	thread := board.getThread(mux.Vars(r)["ThreadKey"])
+	if thread == nil || !can(user, PERM_RESTRUCTURE, thread, nil) {
+		a.jsonerror(w, "Bad thread key or bad user", 404)
+		return
+	}
+	category := ""
+	err := decodeBody(r, &category)
+	if err == nil {
+		err = validateCategory(category)
+	}
+	if err != nil {
+		a.invalidRequest(w, err, "Bad request payload")
+		return
+	}
+	if !user.Can(PERM_RESTRUCTURE, category) {
+		a.jsonerror(w, "No tiene permiso en la categoría de destino", 404)
+		return
+	}
+	old := thread.Category
+	err = board.setThreadCategory(thread, category)
+	if err != nil {
+		logError("BD ERROR: Falló cambiar la categoría del hilo", "thread", thread.Id, "user", user.Login, "error", err)
+		a.jsonerror(w, "Operation failed", 404)
+		return
+	}
+	logInfo("Categoría del hilo cambiada", "user", user.Login, "thread", thread.Id, "old", old, "new", category)
+	audit(r, user.Login, AUDIT_THREAD_CATEGORY, thread.Id, 0, old, category)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(thread)
+}
@@ -0,0 +1,78 @@
+package srv
+
+import (
+	"strings"
+)
+
+/*
+
+	Esquema
+
+	Las tablas base las crea bin/gbbadmin-init. Los cambios posteriores del
+	esquema se guardan aquí y se aplican en orden cada vez que arranca el
+	servidor. Cada sentencia tiene que poder ejecutarse sobre una base de
+	datos que ya la tenga aplicada.
+
+*/
+
+var schemaMigrations = []string{
+	"ALTER TABLE messages ADD COLUMN replyTo INTEGER DEFAULT 0",
+	"ALTER TABLE users ADD COLUMN banLevel INTEGER DEFAULT 0",
+	"ALTER TABLE users ADD COLUMN banReason TEXT DEFAULT ''",
+	"ALTER TABLE users ADD COLUMN bannedBy TEXT DEFAULT ''",
+	"ALTER TABLE users ADD COLUMN banExpires TEXT DEFAULT ''",
+	"UPDATE users SET banLevel=2 WHERE isBanned=1 AND banLevel=0",
+	`CREATE TABLE IF NOT EXISTS audit (id INTEGER PRIMARY KEY AUTOINCREMENT, stamp TEXT, actor TEXT,
+		action TEXT, thread TEXT DEFAULT '', message INTEGER DEFAULT 0, oldValue TEXT DEFAULT '',
+		newValue TEXT DEFAULT '', remote TEXT DEFAULT '')`,
+	"CREATE INDEX IF NOT EXISTS audit_actor ON audit (actor)",
+	"CREATE INDEX IF NOT EXISTS audit_stamp ON audit (stamp)",
+	`CREATE TABLE IF NOT EXISTS sessions (id TEXT PRIMARY KEY, user TEXT, created TEXT, stamp TEXT,
+		remote TEXT DEFAULT '')`,
+	"CREATE INDEX IF NOT EXISTS sessions_user ON sessions (user)",
+	`CREATE TABLE IF NOT EXISTS login_failures (kind TEXT, key TEXT, failures INTEGER, last TEXT,
+		lockedUntil TEXT, PRIMARY KEY (kind, key))`,
+	"ALTER TABLE messages ADD COLUMN version INTEGER DEFAULT 1",
+	`CREATE TABLE IF NOT EXISTS reports (id INTEGER PRIMARY KEY AUTOINCREMENT, stamp TEXT, reporter TEXT,
+		message INTEGER, thread TEXT, author TEXT, content TEXT, reason TEXT, status TEXT DEFAULT 'open',
+		action TEXT DEFAULT '', resolvedBy TEXT DEFAULT '', resolved TEXT DEFAULT '', notified INTEGER DEFAULT 0)`,
+	"CREATE INDEX IF NOT EXISTS reports_status ON reports (status)",
+	"CREATE INDEX IF NOT EXISTS reports_reporter ON reports (reporter)",
+	"ALTER TABLE reports ADD COLUMN rule INTEGER DEFAULT 0",
+	"ALTER TABLE messages ADD COLUMN held INTEGER DEFAULT 0",
+	"ALTER TABLE threads ADD COLUMN held INTEGER DEFAULT 0",
+	"ALTER TABLE users ADD COLUMN created TEXT DEFAULT ''",
+	`CREATE TABLE IF NOT EXISTS filter_rules (id INTEGER PRIMARY KEY AUTOINCREMENT, kind TEXT, pattern TEXT,
+		maxLinks INTEGER DEFAULT 0, action TEXT, dryRun INTEGER DEFAULT 0, created TEXT, createdBy TEXT)`,
+	"ALTER TABLE threads ADD COLUMN category TEXT DEFAULT ''",
+	`CREATE TABLE IF NOT EXISTS user_roles (login TEXT, role TEXT, category TEXT DEFAULT '',
+		PRIMARY KEY (login, role, category))`,
+	"ALTER TABLE threads ADD COLUMN pinExpires TEXT DEFAULT ''",
+	"ALTER TABLE threads ADD COLUMN pinOrder INTEGER DEFAULT 0",
+	"ALTER TABLE threads ADD COLUMN announcement INTEGER DEFAULT 0",
+	`CREATE TABLE IF NOT EXISTS announcement_acks (login TEXT, thread TEXT, stamp TEXT,
+		PRIMARY KEY (login, thread))`,
+}
+
+// Aplica sobre la base de datos los cambios de esquema pendientes
+func MigrateDatabase() error {
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		return err
+	}
+
+	for _, q := range schemaMigrations {
+		_, err := db.Exec(q)
+		if err != nil && !isAlreadyApplied(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// SQLite no tiene "ADD COLUMN IF NOT EXISTS" así que una columna ya creada
+// se detecta por el error que devuelve
+func isAlreadyApplied(err error) bool {
+	return strings.Contains(err.Error(), "duplicate column name")
+}
@@ -1,68 +1,281 @@
 package srv
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"net/http"
-	"sync"
 	"time"
 )
 
+/*
+
+	Sesiones
+
+	Al iniciar sesión el cliente recibe un token aleatorio que envía en la
+	cookie token. Las sesiones se guardan en la tabla sessions de la base de
+	datos, así que sobreviven a un reinicio del servidor. En la tabla no se
+	guarda el token sino su SHA-256, que es también el identificador con el
+	que un usuario ve y revoca sus sesiones.
+
+	Con la caducidad sliding una sesión caduca tras SessionLifetime sin
+	actividad. Con absolute caduca SessionLifetime después de crearse, se
+	use o no.
+
+*/
+
 type Session struct {
-	Id    string
-	User  string
-	Stamp time.Time
+	Id      string    `json:"id"` // SHA-256 del token
+	Token   string    `json:"-"`  // solo se conoce al crear la sesión
+	User    string    `json:"user"`
+	Created time.Time `json:"created"`
+	Stamp   time.Time `json:"stamp"` // última actividad
+	Remote  string    `json:"remote"`
+	Current bool      `json:"current"` // la sesión de la petición que la lista
 }
 
-const SESSION_TIMEALIVE = 30.0 //minutes
+// Duración de una sesión
+var SessionLifetime = 30 * time.Minute
+
+// Caducidad de las sesiones: sliding o absolute
+var SessionExpiry = "sliding"
 
-var sessionCache map[string]*Session
-var sessionMutex sync.Mutex
+// La última actividad se guarda como mucho una vez por minuto, o por décima
+// parte de SessionLifetime si es menor, para no escribir en la base de datos
+// en cada petición
+const SESSION_TOUCH_INTERVAL = time.Minute
 
-func InitSessionCache() {
-	sessionCache = make(map[string]*Session)
+// Almacén de sesiones. Get retorna nil si la sesión no existe y List con un
+// login vacío retorna las de todos los usuarios
+type SessionStore interface {
+	Create(s *Session) error
+	Get(id string) (*Session, error)
+	Touch(id string, stamp time.Time) error
+	Delete(id string) error
+	DeleteUser(login string) error
+	List(login string) ([]*Session, error)
+}
+
+var sessions SessionStore = sqliteSessionStore{}
+
+// Clave del contexto donde se anota el usuario de la petición para el log
+type requestUserKey struct{}
+
+func InitSessions() {
 	go sessionRoutine()
 }
 
-func CreateSession(login string) *Session {
-	sessionMutex.Lock()
-	defer sessionMutex.Unlock()
+// Token de 32 bytes de crypto/rand en hexadecimal
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func sessionId(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
 
+func (s *Session) Expired(now time.Time) bool {
+	if SessionExpiry == "absolute" {
+		return now.Sub(s.Created) >= SessionLifetime
+	}
+	return now.Sub(s.Stamp) >= SessionLifetime
+}
+
+// Crea una sesión para el usuario que hace la petición r
+func CreateSession(r *http.Request, login string) (*Session, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return nil, err
+	}
 	s := new(Session)
-	s.Id = RandomString(64)
+	s.Token = token
+	s.Id = sessionId(s.Token)
 	s.User = login
-	s.Stamp = time.Now()
-	sessionCache[s.Id] = s
-	return s
+	s.Created = time.Now()
+	s.Stamp = s.Created
+	s.Remote = remoteAddress(r)
+	return s, sessions.Create(s)
 }
 
-func GetUserFromSession(r *http.Request) *User {
+// Retorna la sesión válida de la petición o nil si no tiene
+func requestSession(r *http.Request) *Session {
 	token, err := r.Cookie("token")
 	if err != nil {
 		return nil
 	}
-	session := sessionCache[token.Value]
-	if session != nil {
-		session.Stamp = time.Now()
-		return board.GetUser(session.User)
+	session, err := sessions.Get(sessionId(token.Value))
+	if err != nil {
+		logError("BD ERROR: Falló leer la sesión", "error", err)
+		return nil
+	}
+	now := time.Now()
+	if session == nil || session.Expired(now) {
+		return nil
+	}
+	interval := SESSION_TOUCH_INTERVAL
+	if SessionLifetime/10 < interval {
+		interval = SessionLifetime / 10
+	}
+	if now.Sub(session.Stamp) >= interval {
+		err = sessions.Touch(session.Id, now)
+		if err != nil {
+			logError("BD ERROR: Falló actualizar la sesión", "user", session.User, "error", err)
+		}
 	}
-	return nil
+	return session
 }
 
-func sessionRoutine() {
-	for {
-		sessionMutex.Lock()
-		defer sessionMutex.Unlock()
+func GetUserFromSession(r *http.Request) *User {
+	session := requestSession(r)
+	if session == nil {
+		return nil
+	}
+	u := board.GetUser(session.User)
+	if u != nil && !u.CanRead() {
+		return nil
+	}
+	if u != nil {
+		if login, ok := r.Context().Value(requestUserKey{}).(*string); ok {
+			*login = u.Login
+		}
+	}
+	return u
+}
+
+// Elimina todas las sesiones abiertas de un usuario
+func DeleteUserSessions(login string) error {
+	err := sessions.DeleteUser(login)
+	if err != nil {
+		logError("BD ERROR: Falló eliminar las sesiones", "user", login, "error", err)
+	}
+	return err
+}
 
-		for _, session := range sessionCache {
-			now := time.Now()
-			diff := now.Sub(session.Stamp)
+func sessionRoutine() {
+	for runBackground(deleteExpiredSessions) {
+		time.Sleep(10 * time.Second)
+	}
+}
 
-			if diff.Minutes() >= SESSION_TIMEALIVE {
-				delete(sessionCache, session.Id)
-				logEvent(fmt.Sprintf("Sesión de %s eliminada por inactividad", session.User))
+func deleteExpiredSessions() {
+	all, err := sessions.List("")
+	if err != nil {
+		logError("BD ERROR: Falló leer las sesiones", "error", err)
+	}
+	now := time.Now()
+	for _, session := range all {
+		if session.Expired(now) {
+			err = sessions.Delete(session.Id)
+			if err != nil {
+				logError("BD ERROR: Falló eliminar la sesión", "user", session.User, "error", err)
+			} else {
+				logInfo("Sesión caducada", "user", session.User)
 			}
 		}
-		sessionMutex.Unlock()
-		time.Sleep(10 * time.Second)
 	}
 }
+
+// Prepara la petición para que GetUserFromSession anote en ella su usuario
+func withRequestUser(r *http.Request) (*http.Request, *string) {
+	login := new(string)
+	return r.WithContext(context.WithValue(r.Context(), requestUserKey{}, login)), login
+}
+
+/*
+	Almacén de sesiones en SQLite
+*/
+
+type sqliteSessionStore struct{}
+
+const sessionColumns = "id, user, created, stamp, remote"
+
+func scanSession(row interface{ Scan(...interface{}) error }) (*Session, error) {
+	s := new(Session)
+	created, stamp := "", ""
+	err := row.Scan(&s.Id, &s.User, &created, &stamp, &s.Remote)
+	if err != nil {
+		return nil, err
+	}
+	s.Created, _ = time.Parse(time.RFC3339, created)
+	s.Stamp, _ = time.Parse(time.RFC3339, stamp)
+	return s, nil
+}
+
+func (sqliteSessionStore) exec(q string, args ...interface{}) error {
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(q, args...)
+	return err
+}
+
+func (st sqliteSessionStore) Create(s *Session) error {
+	return st.exec("INSERT INTO sessions ("+sessionColumns+") VALUES (?,?,?,?,?);",
+		s.Id, s.User, s.Created.UTC().Format(time.RFC3339), s.Stamp.UTC().Format(time.RFC3339), s.Remote)
+}
+
+func (sqliteSessionStore) Get(id string) (*Session, error) {
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		return nil, err
+	}
+	s, err := scanSession(db.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE id=?;", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return s, err
+}
+
+func (st sqliteSessionStore) Touch(id string, stamp time.Time) error {
+	return st.exec("UPDATE sessions SET stamp=? WHERE id=?;", stamp.UTC().Format(time.RFC3339), id)
+}
+
+func (st sqliteSessionStore) Delete(id string) error {
+	return st.exec("DELETE FROM sessions WHERE id=?;", id)
+}
+
+func (st sqliteSessionStore) DeleteUser(login string) error {
+	return st.exec("DELETE FROM sessions WHERE user=?;", login)
+}
+
+func (sqliteSessionStore) List(login string) ([]*Session, error) {
+	q := "SELECT " + sessionColumns + " FROM sessions"
+	args := make([]interface{}, 0)
+	if login != "" {
+		q += " WHERE user=?"
+		args = append(args, login)
+	}
+	q += " ORDER BY stamp DESC;"
+
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]*Session, 0)
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
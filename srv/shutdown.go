@@ -0,0 +1,180 @@
+package srv
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+
+	Señales del servidor
+
+	Con SIGINT o SIGTERM el servidor deja de aceptar conexiones, espera como
+	mucho ShutdownTimeout a que terminen las peticiones y las tareas en
+	segundo plano en curso, cierra la base de datos y el log y termina.
+
+	Con SIGHUP vuelve a leer la configuración, el certificado TLS y la tabla
+	de usuarios. Las direcciones, el socket, la base de datos y el uso de
+	TLS solo cambian al reiniciar el servidor.
+
+*/
+
+// Tiempo que se espera a las peticiones en curso al detener el servidor
+var ShutdownTimeout = 15 * time.Second
+
+// Vuelve a leer la configuración y la aplica con SwapConfig. La fija el
+// programa principal, que es quien sabe de dónde se leyó
+var ReloadConfig func() error
+
+// Tareas en segundo plano que el servidor deja terminar antes de detenerse.
+// Al detenerse no empieza ninguna más
+var background sync.WaitGroup
+var backgroundMutex sync.Mutex
+var stopping bool
+
+// Ejecuta f como tarea en segundo plano, como cada pasada de las rutinas
+// periódicas. Si el servidor se está deteniendo no la ejecuta y retorna false
+func runBackground(f func()) bool {
+	backgroundMutex.Lock()
+	if stopping {
+		backgroundMutex.Unlock()
+		return false
+	}
+	background.Add(1)
+	backgroundMutex.Unlock()
+	defer background.Done()
+	f()
+	return true
+}
+
+// Impide que empiecen nuevas tareas y espera a las que están en curso
+func stopBackground() {
+	backgroundMutex.Lock()
+	stopping = true
+	backgroundMutex.Unlock()
+	background.Wait()
+}
+
+// Atiende las señales del proceso y los errores de los servidores hasta que
+// el servidor se detiene. No retorna
+func serveSignals(errc chan error, servers ...*http.Server) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case err := <-errc:
+			logError("El servidor se ha detenido", "error", err)
+			shutdown(servers, -1)
+		case sig := <-sigc:
+			if sig == syscall.SIGHUP {
+				reload()
+			} else {
+				logInfo("Deteniendo el servidor", "signal", sig.String())
+				shutdown(servers, 0)
+			}
+		}
+	}
+}
+
+func shutdown(servers []*http.Server, code int) {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			logWarn("Quedaron peticiones sin terminar al detener el servidor", "listen", server.Addr, "error", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		stopBackground()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logWarn("Quedaron tareas en segundo plano sin terminar al detener el servidor")
+	}
+	cancel()
+
+	closeDatabase()
+	if SocketPath != "" {
+		os.Remove(SocketPath)
+	}
+	logInfo("Servidor detenido")
+	CloseLog()
+	os.Exit(code)
+}
+
+// Cada operación abre su propia conexión bajo el mutex de la base de datos,
+// así que cerrarla es esperar a que termine la operación en curso y marcarla
+// como cerrada. Desde entonces GetConnection retorna ErrDatabaseClosed
+func closeDatabase() {
+	mutex.Lock()
+	databaseClosed = true
+	mutex.Unlock()
+}
+
+// Cerrojo de la configuración. Cada petición lo toma para leer mientras
+// se atiende y SwapConfig para escribir, así que una petición ve entera la
+// configuración anterior o la nueva
+var configLock sync.RWMutex
+
+func (a *api) lockConfig(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		configLock.RLock()
+		defer configLock.RUnlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Aplica con apply una configuración ya leída y comprobada. Las direcciones,
+// el socket y la base de datos conservan su valor hasta reiniciar
+func SwapConfig(apply func()) {
+	configLock.Lock()
+	defer configLock.Unlock()
+	listen, socket, db, tls, admin := ListenAddress, SocketPath, DatabasePath, TLSCertFile != "", AdminListenAddress
+	apply()
+	if listen != ListenAddress || socket != SocketPath || db != DatabasePath || tls != (TLSCertFile != "") || admin != AdminListenAddress {
+		logWarn("Los cambios de listen, socket, db, admin_listen y el uso de TLS se aplican al reiniciar el servidor")
+		ListenAddress, SocketPath, DatabasePath, AdminListenAddress = listen, socket, db, admin
+	}
+}
+
+func reload() {
+	logInfo("Recargando la configuración y la tabla de usuarios")
+	if ReloadConfig != nil {
+		err := ReloadConfig()
+		if err != nil {
+			logError("No se pudo recargar la configuración, se mantiene la anterior", "error", err)
+		} else {
+			err = InitLog(LogOptions)
+			if err != nil {
+				logError("No se pudo configurar el log, se mantiene el anterior", "error", err)
+			}
+			updateRateLimiters()
+		}
+	}
+
+	if serverCerts != nil {
+		if TLSCertFile != "" {
+			serverCerts.setFiles(TLSCertFile, TLSKeyFile)
+		}
+		err := serverCerts.reload()
+		if err != nil {
+			logError("No se pudo recargar el certificado, se mantiene el anterior", "cert", serverCerts.certFile, "error", err)
+		} else {
+			logInfo("Certificado recargado", "cert", serverCerts.certFile)
+		}
+	}
+
+	err := board.LoadUsers()
+	if err != nil {
+		logError("BD ERROR: Falló recargar la tabla de usuarios", "error", err)
+	}
+}
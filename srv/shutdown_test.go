@@ -0,0 +1,42 @@
+package srv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStopBackgroundWaitsAndRefuses(t *testing.T) {
+	t.Cleanup(func() { stopping = false })
+
+	started, finished := make(chan struct{}), make(chan struct{})
+	go runBackground(func() {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		close(finished)
+	})
+	<-started
+
+	stopBackground()
+	select {
+	case <-finished:
+	default:
+		t.Fatal("stopBackground ha retornado con una tarea en curso")
+	}
+	if runBackground(func() { t.Fatal("se ha ejecutado una tarea tras detenerse") }) {
+		t.Fatal("runBackground no indica que el servidor se está deteniendo")
+	}
+}
+
+func TestClosedDatabaseRefusesConnections(t *testing.T) {
+	t.Cleanup(func() { databaseClosed = false })
+	closeDatabase()
+	db, err := GetConnection()
+	defer CloseConnection(db)
+	if err != ErrDatabaseClosed {
+		t.Fatalf("se esperaba ErrDatabaseClosed y se obtuvo %v", err)
+	}
+	// el mutex queda libre, así que una segunda llamada tampoco se bloquea
+	if _, err := GetConnection(); err != ErrDatabaseClosed {
+		t.Fatalf("se esperaba ErrDatabaseClosed y se obtuvo %v", err)
+	}
+}
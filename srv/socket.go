@@ -0,0 +1,136 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+/*
+
+	Socket local
+
+	Además de TCP el servidor puede escuchar en un socket Unix. Quien se
+	conecta por él queda identificado por el UID de su proceso (SO_PEERCRED)
+	y puede abrir sesión sin contraseña con el login de su usuario del
+	sistema. Las conexiones TCP siguen necesitando contraseña.
+
+*/
+
+// Ruta del socket. Vacía para no escuchar en un socket local
+var SocketPath = ""
+
+// Permisos del socket en octal. Quien puede conectarse se identifica por su
+// UID, así que por defecto cualquier usuario local puede hacerlo
+var SocketMode = "0666"
+
+// Grupo al que se asigna el socket. Vacío para no cambiarlo
+var SocketGroup = ""
+
+type peerUIDKey struct{}
+
+// Sesión abierta por el socket local
+type LocalSession struct {
+	Login string `json:"login"`
+	Token string `json:"token"`
+}
+
+// Crea el socket, eliminando el de una ejecución anterior, y le aplica los
+// permisos y el grupo configurados
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	mode, err := strconv.ParseUint(SocketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("permisos del socket no válidos: %s", SocketMode)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, os.FileMode(mode))
+	if err == nil && SocketGroup != "" {
+		var g *user.Group
+		g, err = user.LookupGroup(SocketGroup)
+		if err == nil {
+			gid, _ := strconv.Atoi(g.Gid)
+			err = os.Chown(path, -1, gid)
+		}
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Guarda en el contexto de las conexiones por socket el UID del proceso que
+// se conecta
+func peerContext(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	uid, err := peerUID(uc)
+	if err != nil {
+		logWarn("No se pudo identificar al proceso conectado al socket", "error", err)
+		return ctx
+	}
+	return context.WithValue(ctx, peerUIDKey{}, uid)
+}
+
+// Retorna el login del usuario del sistema que hace la petición por el
+// socket local
+func peerLogin(r *http.Request) (string, error) {
+	uid, ok := r.Context().Value(peerUIDKey{}).(uint32)
+	if !ok {
+		return "", errors.New("Solo disponible a través del socket local")
+	}
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return "", fmt.Errorf("El UID %d no corresponde a ningún usuario del sistema", uid)
+	}
+	return u.Username, nil
+}
+
+// Abre una sesión sin contraseña para el usuario del sistema conectado por el
+// socket local
+func (a *api) localAuth(w http.ResponseWriter, r *http.Request) {
+	login, err := peerLogin(r)
+	if err != nil {
+		a.jsonerror(w, err.Error(), 403)
+		return
+	}
+	u := board.GetUser(login)
+	if u == nil {
+		logWarn("Se intenta acceder por el socket local con usuario desconocido", "user", login)
+		audit(r, login, AUDIT_LOGIN_FAILED, "", 0, "", "unknown user (socket)")
+		a.jsonerror(w, "El usuario "+login+" no existe en el tablón", 404)
+		return
+	}
+	if !u.CanRead() {
+		logWarn("Inicio de sesión de un usuario bloqueado", "user", login)
+		audit(r, login, AUDIT_LOGIN_FAILED, "", 0, "", "banned (socket)")
+		a.jsonerror(w, u.BanMessage(), 403)
+		return
+	}
+	u.applyGroups()
+	s, err := CreateSession(r, login)
+	if err != nil {
+		logError("BD ERROR: Falló crear la sesión", "user", login, "error", err)
+		a.jsonerror(w, "No se pudo crear la sesión", 500)
+		return
+	}
+	logInfo("Sesión iniciada por el socket local", "user", login)
+	audit(r, login, AUDIT_LOGIN, "", 0, "", "socket")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LocalSession{Login: login, Token: s.Token})
+}
@@ -0,0 +1,85 @@
+package srv
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Contraseña de los usuarios de la base de datos de pruebas
+const testPassword = "secret"
+
+// Prepara una base de datos temporal con las tablas de bin/gbbadmin-init y
+// las migraciones, y carga de ella el tablón. Crea los usuarios admin, que
+// es administrador, bob y eva. Retorna el router de la API
+func newTestDatabase(t *testing.T) http.Handler {
+	t.Helper()
+	oldBoard, oldPath := board, DatabasePath
+	limiters := allRateLimiters()
+	t.Cleanup(func() {
+		board, DatabasePath = oldBoard, oldPath
+		threadsLimiter, messagesLimiter, editsLimiter = limiters[0], limiters[1], limiters[2]
+		loginsByUserLimiter, loginsByAddrLimiter, reportsLimiter = limiters[3], limiters[4], limiters[5]
+	})
+
+	DatabasePath = filepath.Join(t.TempDir(), "gbb.db")
+	db, err := sql.Open(DB_DRIVER, DatabasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(testPassword)))
+	for _, q := range []string{
+		"CREATE TABLE users (login VARCHAR(50) PRIMARY KEY, password TEXT, isAdmin INTEGER, isBanned INTEGER);",
+		"CREATE TABLE threads (id VARCHAR(32) PRIMARY KEY, title VARCHAR(64) NULL,  isClosed INTEGER, isFixed INTEGER);",
+		"CREATE TABLE messages (id INTEGER PRIMARY KEY AUTOINCREMENT, thread VARCHAR(32), author VARCHAR(255) NOT NULL, stamp TEXT, content TEXT);",
+		"INSERT INTO users VALUES ('admin','" + hash + "',1,0), ('bob','" + hash + "',0,0), ('eva','" + hash + "',0,0);",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := MigrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	board = CreateBoard()
+	if err := board.Load(); err != nil {
+		t.Fatal(err)
+	}
+	// los limitadores sin su rutina, que no hace falta en las pruebas
+	threadsLimiter = NewRateLimiter("threads", RateLimit{1000, Limits.Threads.Window})
+	messagesLimiter = NewRateLimiter("messages", RateLimit{1000, Limits.Messages.Window})
+	editsLimiter = NewRateLimiter("edits", RateLimit{1000, Limits.Edits.Window})
+	loginsByUserLimiter = NewRateLimiter("logins_by_user", RateLimit{1000, Limits.LoginsByUser.Window})
+	loginsByAddrLimiter = NewRateLimiter("logins_by_addr", RateLimit{1000, Limits.LoginsByAddr.Window})
+	reportsLimiter = NewRateLimiter("reports", RateLimit{1000, Limits.Reports.Window})
+	return NewServer().Router()
+}
+
+// Hace una petición a la API con la cookie de sesión indicada, que puede
+// ser nil
+func testRequest(h http.Handler, session *http.Cookie, method string, path string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if session != nil {
+		r.AddCookie(session)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// Inicia sesión con uno de los usuarios de la base de datos de pruebas
+func testLogin(t *testing.T, h http.Handler, login string) *http.Cookie {
+	t.Helper()
+	w := testRequest(h, nil, http.MethodPost, "/users/"+login, `"`+testPassword+`"`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("no se pudo iniciar sesión con %s: %d %s", login, w.Code, w.Body)
+	}
+	return &http.Cookie{Name: "token", Value: strings.Trim(strings.TrimSpace(w.Body.String()), `"`)}
+}
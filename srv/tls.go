@@ -0,0 +1,73 @@
+package srv
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+/*
+
+	HTTPS
+
+	Si la configuración indica un certificado y su clave el servidor solo
+	atiende peticiones HTTPS. Al recibir SIGHUP (ver shutdown.go) vuelve a
+	leer los dos ficheros, de forma que se puede renovar el certificado sin
+	reiniciar el servidor. Si la lectura falla se sigue usando el
+	certificado anterior.
+
+*/
+
+// Certificado y clave en PEM. Vacíos para servir HTTP sin cifrar
+var TLSCertFile = ""
+var TLSKeyFile = ""
+
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	mutex    sync.RWMutex
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	return cr, cr.reload()
+}
+
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	cr.cert = &cert
+	return nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mutex.RLock()
+	defer cr.mutex.RUnlock()
+	return cr.cert, nil
+}
+
+// Cambia los ficheros que se leen en la próxima recarga
+func (cr *certReloader) setFiles(certFile string, keyFile string) {
+	cr.certFile = certFile
+	cr.keyFile = keyFile
+}
+
+// Certificado del servidor, que se recarga al recibir SIGHUP
+var serverCerts *certReloader
+
+// Configuración TLS del servidor con el certificado recargable
+func serverTLSConfig() (*tls.Config, error) {
+	cr, err := newCertReloader(TLSCertFile, TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	serverCerts = cr
+	return &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}, nil
+}
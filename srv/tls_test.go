@@ -0,0 +1,101 @@
+package srv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Escribe en dir un certificado autofirmado para cn y su clave
+func writeSelfSignedCert(t *testing.T, dir string, cn string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{cn},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err == nil {
+		err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func servedName(t *testing.T, cr *certReloader) string {
+	t.Helper()
+	cert, err := cr.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloaderReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSignedCert(t, dir, "uno.example")
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, cr); name != "uno.example" {
+		t.Fatalf("se sirve %s en lugar de uno.example", name)
+	}
+
+	// se renuevan los ficheros y se recarga
+	writeSelfSignedCert(t, dir, "dos.example")
+	if err := cr.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, cr); name != "dos.example" {
+		t.Fatalf("tras recargar se sirve %s en lugar de dos.example", name)
+	}
+
+	// una clave que no casa con el certificado no sustituye al anterior
+	other := t.TempDir()
+	_, otherKey := writeSelfSignedCert(t, other, "tres.example")
+	cr.setFiles(certFile, otherKey)
+	if err := cr.reload(); err == nil {
+		t.Fatal("se ha aceptado una clave que no es la del certificado")
+	}
+	if name := servedName(t, cr); name != "dos.example" {
+		t.Fatalf("tras un fallo se sirve %s en lugar del certificado anterior", name)
+	}
+}
+
+func TestCertReloaderMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	_, err := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err == nil {
+		t.Fatal("se ha creado sin certificado")
+	}
+}
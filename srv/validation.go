@@ -0,0 +1,218 @@
+package srv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+/*
+
+	Validación de la entrada
+
+	Los títulos, los mensajes, los logins y los motivos de bloqueo se
+	validan antes de guardarse. Ninguno puede llevar caracteres de control
+	(salvo saltos de línea y tabuladores en los mensajes), porque una
+	secuencia de escape guardada en el tablón se enviaría tal cual a las
+	terminales del resto de usuarios.
+
+	Un error de validación se responde con el código 422 y un objeto con el
+	campo que lo provocó y el motivo, para que el cliente pueda indicarlo.
+	Los cuerpos de las peticiones que superan BodyMax se cortan y se
+	responden con 413.
+
+*/
+
+type ValidationConfig struct {
+	TitleMax     int    // caracteres de un título
+	MessageMax   int    // bytes del texto de un mensaje
+	LoginMax     int    // caracteres de un login
+	BodyMax      int    // bytes del cuerpo de una petición
+	TitlePattern string // expresión regular que deben cumplir los títulos, vacía para no exigir ninguna
+}
+
+var Validation = ValidationConfig{
+	TitleMax:   64,
+	MessageMax: 16 * 1024,
+	LoginMax:   32,
+	BodyMax:    64 * 1024,
+}
+
+// Error de validación de un campo de la petición
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"error"`
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func invalid(field string, format string, a ...interface{}) *ValidationError {
+	return &ValidationError{Field: field, Message: fmt.Sprintf(format, a...)}
+}
+
+// Expresión de TitlePattern ya compilada. Se compila de nuevo si la
+// configuración cambia al recargarla
+var titlePattern struct {
+	source string
+	re     *regexp.Regexp
+	mutex  sync.Mutex
+}
+
+func compiledTitlePattern() (*regexp.Regexp, error) {
+	titlePattern.mutex.Lock()
+	defer titlePattern.mutex.Unlock()
+	if titlePattern.re == nil || titlePattern.source != Validation.TitlePattern {
+		re, err := regexp.Compile(Validation.TitlePattern)
+		if err != nil {
+			return nil, err
+		}
+		titlePattern.source, titlePattern.re = Validation.TitlePattern, re
+	}
+	return titlePattern.re, nil
+}
+
+// Comprueba que una configuración de validación es utilizable
+func CheckValidationConfig(v ValidationConfig) error {
+	for name, n := range map[string]int{"title_max": v.TitleMax, "message_max": v.MessageMax,
+		"login_max": v.LoginMax, "body_max": v.BodyMax} {
+		if n <= 0 {
+			return fmt.Errorf("validation.%s: debe ser mayor que 0: %d", name, n)
+		}
+	}
+	if v.TitlePattern != "" {
+		if _, err := regexp.Compile(v.TitlePattern); err != nil {
+			return fmt.Errorf("validation.title_pattern: %s", err)
+		}
+	}
+	return nil
+}
+
+// Retorna el primer carácter no permitido en un texto o -1 si no hay
+// ninguno. Se rechazan los caracteres de control C0 y C1 y DEL, que es con
+// los que empiezan las secuencias de escape de las terminales. multiline
+// permite además saltos de línea y tabuladores
+func forbiddenRune(text string, multiline bool) rune {
+	for _, c := range text {
+		if multiline && (c == '\n' || c == '\t') {
+			continue
+		}
+		if c < 0x20 || (c >= 0x7f && c <= 0x9f) {
+			return c
+		}
+	}
+	return -1
+}
+
+// Comprueba los caracteres de un texto y retorna el error del campo si no
+// son válidos
+func checkCharacters(field string, name string, text string, multiline bool) *ValidationError {
+	if !utf8.ValidString(text) {
+		return invalid(field, "%s no es UTF-8 válido", name)
+	}
+	if c := forbiddenRune(text, multiline); c >= 0 {
+		return invalid(field, "%s contiene el carácter de control %U, que no está permitido", name, c)
+	}
+	return nil
+}
+
+// Valida el título de un hilo
+func validateTitle(title string) error {
+	if strings.TrimSpace(title) == "" {
+		return invalid("title", "El título no puede estar vacío")
+	}
+	if n := utf8.RuneCountInString(title); n > Validation.TitleMax {
+		return invalid("title", "El título tiene %d caracteres y el máximo es %d", n, Validation.TitleMax)
+	}
+	if err := checkCharacters("title", "El título", title, false); err != nil {
+		return err
+	}
+	if Validation.TitlePattern != "" {
+		re, err := compiledTitlePattern()
+		if err != nil {
+			return err
+		}
+		if !re.MatchString(title) {
+			return invalid("title", "El título contiene caracteres no permitidos")
+		}
+	}
+	return nil
+}
+
+// Valida el texto de un mensaje
+func validateMessage(text string) error {
+	if strings.TrimSpace(text) == "" {
+		return invalid("text", "El mensaje no puede estar vacío")
+	}
+	if len(text) > Validation.MessageMax {
+		return invalid("text", "El mensaje ocupa %d bytes y el máximo es %d", len(text), Validation.MessageMax)
+	}
+	if err := checkCharacters("text", "El mensaje", text, true); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Valida un login nuevo
+func validateLogin(login string) error {
+	if len(login) > Validation.LoginMax {
+		return invalid("login", "El login tiene %d caracteres y el máximo es %d", len(login), Validation.LoginMax)
+	}
+	if !validLogin.MatchString(login) {
+		return invalid("login", "El login solo puede tener letras, números y _")
+	}
+	return nil
+}
+
+// Valida el motivo de un bloqueo, que es opcional
+func validateReason(reason string) error {
+	if n := utf8.RuneCountInString(reason); n > Validation.MessageMax {
+		return invalid("reason", "El motivo tiene %d caracteres y el máximo es %d", n, Validation.MessageMax)
+	}
+	if err := checkCharacters("reason", "El motivo", reason, false); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Limita el tamaño del cuerpo de todas las peticiones
+func (a *api) limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, int64(Validation.BodyMax))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Lee el cuerpo JSON de la petición en v
+func decodeBody(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil && strings.Contains(err.Error(), "request body too large") {
+		return invalid("body", "La petición supera el máximo de %d bytes", Validation.BodyMax)
+	}
+	return err
+}
+
+// Responde con el error de validación o, si err es de otro tipo, con
+// defaultText y el código 404
+func (a *api) invalidRequest(w http.ResponseWriter, err error, defaultText string) {
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		a.jsonerror(w, defaultText, 404)
+		return
+	}
+	code := http.StatusUnprocessableEntity
+	if verr.Field == "body" {
+		code = http.StatusRequestEntityTooLarge
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(verr)
+}
@@ -0,0 +1,149 @@
+package srv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateTitle(t *testing.T) {
+	tests := []struct {
+		name  string
+		title string
+		ok    bool
+	}{
+		{"normal", "Hola, ¿qué tal?", true},
+		{"vacío", "  ", false},
+		{"demasiado largo", strings.Repeat("ñ", Validation.TitleMax+1), false},
+		{"justo el máximo", strings.Repeat("ñ", Validation.TitleMax), true},
+		{"secuencia de escape", "\x1b[2Jborrado", false},
+		{"campana", "ding\a", false},
+		{"DEL", "a\x7fb", false},
+		{"control C1", "a\u009bb", false},
+		{"salto de línea", "dos\nlíneas", false},
+		{"tabulador", "a\tb", false},
+		{"UTF-8 no válido", "a\xffb", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTitle(tt.title)
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("validateTitle(%q) = %v", tt.title, err)
+				}
+				return
+			}
+			verr, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("validateTitle(%q) = %#v, se esperaba un *ValidationError", tt.title, err)
+			}
+			if verr.Field != "title" {
+				t.Errorf("campo %q, se esperaba title", verr.Field)
+			}
+		})
+	}
+}
+
+func TestValidateMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		ok   bool
+	}{
+		{"varias líneas y tabuladores", "uno\n\tdos\n", true},
+		{"vacío", "\n\n", false},
+		{"demasiado largo", strings.Repeat("a", Validation.MessageMax+1), false},
+		{"secuencia de escape", "color \x1b[31mrojo", false},
+		{"retorno de carro", "a\rb", false},
+		{"control C1", "a\u0085b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMessage(tt.text)
+			if tt.ok != (err == nil) {
+				t.Fatalf("validateMessage(%q) = %v", tt.text, err)
+			}
+			if err != nil && err.(*ValidationError).Field != "text" {
+				t.Errorf("campo %q, se esperaba text", err.(*ValidationError).Field)
+			}
+		})
+	}
+}
+
+func TestTitlePattern(t *testing.T) {
+	old := Validation
+	t.Cleanup(func() { Validation = old })
+
+	Validation.TitlePattern = `^[\p{L}\p{N} ]+$`
+	if err := validateTitle("Hola 2026"); err != nil {
+		t.Fatalf("título válido rechazado: %v", err)
+	}
+	if err, ok := validateTitle("Hola!").(*ValidationError); !ok || err.Field != "title" {
+		t.Fatalf("título que no cumple el patrón: %v", err)
+	}
+
+	// al cambiar la configuración se compila el patrón nuevo
+	Validation.TitlePattern = `^[a-z]+$`
+	if validateTitle("Hola") == nil {
+		t.Fatal("se sigue usando el patrón anterior")
+	}
+	Validation.TitlePattern = ""
+	if err := validateTitle("Hola!"); err != nil {
+		t.Fatalf("sin patrón se rechaza el título: %v", err)
+	}
+}
+
+// Comprueba el código de la respuesta y que el cuerpo sea exactamente
+// {field, error} con el campo indicado
+func checkValidationResponse(t *testing.T, w *httptest.ResponseRecorder, code int, field string) {
+	t.Helper()
+	res := w.Result()
+	if res.StatusCode != code {
+		t.Fatalf("código %d, se esperaba %d", res.StatusCode, code)
+	}
+	var body map[string]string
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("el cuerpo no es un objeto JSON: %v", err)
+	}
+	if len(body) != 2 || body["field"] != field || body["error"] == "" {
+		t.Fatalf("cuerpo %v, se esperaba {field: %q, error}", body, field)
+	}
+}
+
+func TestValidationResponses(t *testing.T) {
+	h := newTestDatabase(t)
+	bob := testLogin(t, h, "bob")
+
+	w := testRequest(h, bob, http.MethodPost, "/board", `"\u001b[2Jborrado"`)
+	checkValidationResponse(t, w, http.StatusUnprocessableEntity, "title")
+
+	w = testRequest(h, bob, http.MethodPost, "/board", `"Un hilo"`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("no se pudo crear el hilo: %d %s", w.Code, w.Body)
+	}
+	var th Thread
+	if err := json.NewDecoder(w.Body).Decode(&th); err != nil {
+		t.Fatal(err)
+	}
+	w = testRequest(h, bob, http.MethodPut, "/threads/"+th.Id, `{"text":"rojo \u001b[31m"}`)
+	checkValidationResponse(t, w, http.StatusUnprocessableEntity, "text")
+	w = testRequest(h, bob, http.MethodPut, "/threads/"+th.Id, `{"text":"uno\n\tdos"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("mensaje válido rechazado: %d %s", w.Code, w.Body)
+	}
+
+	old := Validation
+	t.Cleanup(func() { Validation = old })
+	Validation.TitlePattern = `^[a-z ]+$`
+	w = testRequest(h, bob, http.MethodPost, "/board", `"Mayúsculas"`)
+	checkValidationResponse(t, w, http.StatusUnprocessableEntity, "title")
+
+	Validation.BodyMax = 64
+	w = testRequest(h, bob, http.MethodPut, "/threads/"+th.Id, `{"text":"`+strings.Repeat("a", 100)+`"}`)
+	checkValidationResponse(t, w, http.StatusRequestEntityTooLarge, "body")
+	if n := len(board.getThread(th.Id).Messages); n != 1 {
+		t.Fatalf("el hilo tiene %d mensajes, se esperaba 1", n)
+	}
+}